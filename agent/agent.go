@@ -3,64 +3,99 @@ package agent
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/sofuture/kubernotes/cluster"
 )
 
+// How long to wait after reacting to local jobs stopping before reacting
+// again, so a job that fails as soon as it starts isn't restarted in a tight
+// loop.
+const localResyncDelay = time.Second
+
+// The longest to wait before watching local jobs again, after failing to.
+const localWatchMaxBackoff = 30 * time.Second
+
 type Agent struct {
 	Bind            string
 	NodeName        string
 	CPUShares       int
 	BlockIOShares   int
 	MemoryMegabytes int
+	HeartbeatTTL    time.Duration
+	Labels          map[string]string
 	Namespace       *cluster.Namespace
 	Node            *cluster.Node
 
 	ClusterBackend cluster.Backend
 	Local          Local
+
+	// syncs prompted by the cluster and by local jobs take turns
+	syncMu sync.Mutex
 }
 
-func (a *Agent) Run() (err error) {
-	// connect to Systemd
+// Run the agent until it fails, or the context is cancelled.
+func (a *Agent) Run(ctx context.Context) (err error) {
+	// connect to whatever runs our jobs
 	err = a.Local.Connect()
 	if err != nil {
-		return fmt.Errorf("cannot connect to systemd, maybe you need to be root? %v", err)
+		return err
 	}
+	defer a.Local.Disconnect()
 
 	// join cluster
-	err = a.joinCluster()
+	err = a.joinCluster(ctx)
 	if err != nil {
 		return err
 	}
 
 	// sync state with cluster
-	err = a.syncState()
+	err = a.sync(ctx)
 	if err != nil {
 		return err
 	}
 
-	errs := make(chan error, 1)
+	// stop watching and heartbeating when we return, whatever the reason
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
 
 	// listen for changes
 	go func() {
-		err = a.watchCluster()
+		err := a.watchCluster(ctx)
 		if err != nil {
 			errs <- err
 		}
 	}()
 
+	// and for local jobs failing
+	go a.watchLocal(ctx)
+
+	// let the cluster know we're still alive
+	go a.heartbeat(ctx)
+
 	// spawn api
 	go func() {
-		err = a.SpawnAPI()
+		err := a.SpawnAPI(ctx)
 		if err != nil {
 			errs <- err
 		}
 	}()
 
-	return <-errs
+	select {
+	case err = <-errs:
+		return err
+	case <-ctx.Done():
+		log.Println("shutting down agent")
+		return nil
+	}
 }
 
-func (a *Agent) joinCluster() error {
+func (a *Agent) joinCluster(ctx context.Context) error {
 	var err error
 
 	a.Node = &cluster.Node{
@@ -77,25 +112,92 @@ func (a *Agent) joinCluster() error {
 		Endpoint: a.Bind,
 	}
 
-	err = a.Namespace.CreateNode(a.ClusterBackend, a.Node)
+	err = a.Namespace.CreateNode(ctx, a.ClusterBackend, a.Node)
 	if err != nil {
 		return fmt.Errorf("Could not join cluster: %v", err)
 	}
 
+	// publish what we know about ourselves, letting configured labels
+	// override detected ones
+	labels := DetectLabels()
+	for k, v := range a.Labels {
+		labels[k] = v
+	}
+
+	err = a.Node.SetLabels(ctx, a.ClusterBackend, labels)
+	if err != nil {
+		return fmt.Errorf("Could not publish node labels: %v", err)
+	}
+
+	// joining heartbeats with the default ttl, so make sure ours applies
+	return a.Node.Heartbeat(ctx, a.ClusterBackend, a.heartbeatTTL())
+}
+
+func (a *Agent) heartbeatTTL() time.Duration {
+	if a.HeartbeatTTL == 0 {
+		return cluster.DefaultHeartbeatTTL
+	}
+	return a.HeartbeatTTL
+}
+
+func (a *Agent) heartbeat(ctx context.Context) {
+	ttl := a.heartbeatTTL()
+
+	// refresh well inside the ttl, so a single slow write doesn't get us
+	// marked as down
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		node := a.getNode()
+		err := node.Heartbeat(ctx, a.ClusterBackend, ttl)
+		if err != nil {
+			log.Println("unable to send heartbeat", err)
+		}
+
+		// jobs can die or be restarted without the cluster changing, so
+		// check on them as often as we heartbeat
+		a.reportState(ctx)
+	}
+}
+
+// Get a copy of our Node, which syncs reload.
+func (a *Agent) getNode() cluster.Node {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	return *a.Node
+}
+
+// Bring local jobs in line with the cluster, and report how they're doing.
+func (a *Agent) sync(ctx context.Context) error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	err := a.syncState(ctx)
+	if err != nil {
+		return err
+	}
+	a.reportState(ctx)
 	return nil
 }
 
-func (a *Agent) syncState() error {
+func (a *Agent) syncState(ctx context.Context) error {
 	log.Println("updating local state to match cluster")
 
-	err := a.Node.Load(a.ClusterBackend)
+	err := a.Node.Load(ctx, a.ClusterBackend)
 	if err != nil {
 		return err
 	}
 
 	// get list of jobs we should be running
 	log.Println("getting jobs we should be running according to cluster")
-	clusterJobs, err := a.Node.GetJobs(a.ClusterBackend)
+	clusterJobs, err := a.Node.GetJobs(ctx, a.ClusterBackend)
 	if err != nil {
 		return err
 	}
@@ -107,24 +209,39 @@ func (a *Agent) syncState() error {
 		return err
 	}
 
-	// helper func to create a systemd job
-	createJob := func(job *cluster.Job) error {
-		log.Println("job", job.ID, "needs to be created locally")
-		err = a.Local.CreateJob(job)
+	// helper func to start a local job
+	startJob := func(job *cluster.Job) {
+		log.Println("starting local job", job.ID)
+		err := a.Local.StartJob(job)
 		if err != nil {
-			log.Println("unable to create local job", job.ID)
-			return err
+			log.Println("unable to start local job", job.ID, err)
 		}
-		return nil
 	}
 
-	// helper func to start a systemd job
-	startJob := func(job *cluster.Job) {
-		log.Println("starting local job", job.ID)
-		err = a.Local.StartJob(job)
+	// helper func to stop and destroy a local job
+	destroyJob := func(job *cluster.Job) {
+		log.Println("destroying local job", job.ID)
+		err := a.Local.StopJob(job)
+		if err != nil {
+			log.Println("unable to stop local job", job.ID, err)
+		}
+
+		err = a.Local.DestroyJob(job)
+		if err != nil {
+			log.Println("unable to destroy local job", job.ID, err)
+		}
+	}
+
+	// helper func to create and start a local job. failing to is left for
+	// the next sync to retry, rather than stopping us looking after the rest
+	createJob := func(job *cluster.Job) {
+		log.Println("job", job.ID, "needs to be created locally")
+		err := a.Local.CreateJob(job)
 		if err != nil {
-			log.Println("unable to start local job", job.ID)
+			log.Println("unable to create local job", job.ID, err)
+			return
 		}
+		startJob(job)
 	}
 
 	// make sure each job exists locally and is in correct state
@@ -139,72 +256,173 @@ func (a *Agent) syncState() error {
 		// loop through local jobs to see if we know about this job
 		// we're supposed to be running
 		for _, localJob := range localJobs {
+			if localJob.ID != clusterJob.ID {
+				continue
+			}
+			found = true
+
+			// if its unit file has changed, replace it
+			if localJob.UnitFile != "" && localJob.UnitFile != clusterJob.UnitFile {
+				log.Println("job", clusterJob.ID, "changed, recreating it locally")
+				destroyJob(&localJob)
+				createJob(&clusterJob)
+				continue
+			}
 
-			// if we know about the job, make sure it's running
-			if localJob.ID == clusterJob.ID {
-				found = true
-				if !clusterJob.IsRunning {
-					startJob(&clusterJob)
-				}
+			// otherwise, make sure it's running
+			if !localJob.IsRunning {
+				startJob(&clusterJob)
 			}
 		}
 
 		// if we didn't find the job locally, we need to create and start it
 		if !found {
-			err = createJob(&clusterJob)
-			if err != nil {
-				// we're going to ignore failure to start, because we don't do anything
-				// (like unschedule) with it currently
-				startJob(&clusterJob)
-			}
+			createJob(&clusterJob)
 		}
 	}
 
-	// try to destroy orphaned local jobs
+	// destroy orphaned local jobs
 	for _, localJob := range localJobs {
 		if _, shouldHave := seenJobs[localJob.ID]; !shouldHave {
-			log.Println("destroying local job", localJob.ID)
-			err = a.Local.StopJob(&localJob)
-			if err != nil {
-				log.Println("unable to stop local job", localJob.ID)
-				err = nil
-			}
+			destroyJob(&localJob)
+		}
+	}
 
-			err = a.Local.DestroyJob(&localJob)
-			if err != nil {
-				log.Println("unable to destroy local job", localJob.ID)
-				err = nil
-			}
+	return nil
+}
+
+// Publish what we can see of each job we run, so the cluster knows whether
+// they're actually up, and stop publishing jobs we no longer run. Only states
+// that changed are written. Failing to report is logged, and left for the next
+// report to put right.
+func (a *Agent) reportState(ctx context.Context) {
+	reported, err := a.Namespace.GetRunStates(ctx, a.ClusterBackend, a.NodeName)
+	if err != nil {
+		log.Println("unable to get reported job states", err)
+		return
+	}
+	localJobs, err := a.Local.GetManagedJobs()
+	if err != nil {
+		log.Println("unable to get local jobs", err)
+		return
+	}
+
+	previous := make(map[string]string)
+	for _, state := range reported {
+		previous[state.ID], _ = state.Serialize()
+	}
+
+	for _, localJob := range localJobs {
+		state, err := a.Local.GetJobState(&localJob)
+		if err != nil {
+			log.Println("unable to get state of local job", localJob.ID, err)
+			continue
+		}
+		state.ID = localJob.ID
+		state.Node = a.NodeName
+
+		json, _ := state.Serialize()
+		last, ok := previous[state.ID]
+		delete(previous, state.ID)
+		if ok && json == last {
+			continue
+		}
+
+		err = a.Namespace.SaveRunState(ctx, a.ClusterBackend, state)
+		if err != nil {
+			log.Println("unable to report state of local job", localJob.ID, err)
 		}
 	}
 
-	return err
+	// whatever's left we don't run any more
+	for jobID := range previous {
+		err = a.Namespace.DeleteRunState(ctx, a.ClusterBackend, a.NodeName, jobID)
+		if err != nil {
+			log.Println("unable to remove reported state of job", jobID, err)
+		}
+	}
 }
 
-func (a *Agent) watchCluster() error {
+func (a *Agent) watchCluster(ctx context.Context) error {
 	// listen for changes, then run syncState
 	log.Println("listening for schedule changes")
 
 	for {
-		err := a.watchClusterOnce()
+		err := a.watchClusterOnce(ctx)
+
+		// being cancelled interrupts the watch, which isn't a failure
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (a *Agent) watchClusterOnce() (err error) {
+func (a *Agent) watchClusterOnce(ctx context.Context) (err error) {
 	// listen for changes since we've last synced
-	lastSeen := a.Node.LastModifiedIndex
+	node := a.getNode()
 
-	lastSeen, err = a.Node.WatchForChanges(a.ClusterBackend, lastSeen)
-	if err != nil {
-		return err
-	}
-	err = a.syncState()
+	_, err = node.WatchForChanges(ctx, a.ClusterBackend, node.LastModifiedIndex)
 	if err != nil {
 		return err
 	}
+	return a.sync(ctx)
+}
 
-	return nil
+func (a *Agent) watchLocal(ctx context.Context) {
+	// listen for local jobs changing, and run syncState if any have failed,
+	// rather than waiting for the cluster to change
+	log.Println("listening for local job changes")
+
+	backoff := localResyncDelay
+	for {
+		changed, err := a.Local.WatchForChanges(ctx)
+
+		// being cancelled interrupts the watch, which isn't a failure
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the cluster watch keeps jobs running meanwhile, so keep trying
+		if err != nil {
+			log.Println("unable to watch local jobs, retrying in", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > localWatchMaxBackoff {
+				backoff = localWatchMaxBackoff
+			}
+			continue
+		}
+		backoff = localResyncDelay
+
+		failed := false
+		for _, state := range changed {
+			if state.IsFailed() {
+				log.Println("local job", state.ID, "is", state.String())
+				failed = true
+			}
+		}
+
+		// either way, let the cluster know what changed
+		if failed {
+			err = a.sync(ctx)
+			if err != nil {
+				log.Println("unable to sync after local jobs failed", err)
+			}
+		} else {
+			a.reportState(ctx)
+		}
+
+		select {
+		case <-time.After(localResyncDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -1,7 +1,12 @@
 package agent
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/sofuture/kubernotes/cluster"
 	"github.com/sofuture/kubernotes/testtools"
@@ -20,8 +25,8 @@ BlockIOWeight=10
 WantedBy=multi-user.target
 `
 
-func getTestingAgent() (*Agent, TestLocal) {
-	local := TestLocal{}
+func getTestingAgent() (*Agent, *Fake) {
+	local := NewFake()
 	agent := &Agent{
 		Bind:            "127.0.0.1:23142",
 		NodeName:        "testnode",
@@ -36,21 +41,25 @@ func getTestingAgent() (*Agent, TestLocal) {
 }
 
 func TestEmptyAgentJoinSync(t *testing.T) {
+	ctx := context.Background()
+
 	agent, _ := getTestingAgent()
-	err := agent.joinCluster()
+	err := agent.joinCluster(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = agent.syncState()
+	err = agent.syncState(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestAgentTracksAssignedJobs(t *testing.T) {
+	ctx := context.Background()
+
 	agent, local := getTestingAgent()
-	err := agent.joinCluster()
+	err := agent.joinCluster(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +69,7 @@ func TestAgentTracksAssignedJobs(t *testing.T) {
 		t.Fatal("unable to load job", err)
 	}
 
-	err = agent.Namespace.CreateJob(agent.ClusterBackend, job)
+	err = agent.Namespace.CreateJob(ctx, agent.ClusterBackend, job)
 	if err != nil {
 		t.Fatal("unable to create job", err)
 	}
@@ -69,81 +78,393 @@ func TestAgentTracksAssignedJobs(t *testing.T) {
 		t.Fatal("agent.Node not initialized")
 	}
 
-	err = agent.Node.AssignJob(agent.ClusterBackend, job.ID)
+	err = agent.Node.AssignJob(ctx, agent.ClusterBackend, job.ID)
 	if err != nil {
 		t.Fatal("unable to assign job", err)
 	}
 
-	err = agent.syncState()
+	err = agent.syncState(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, ok := local["testjob"]
-	if !ok {
+	if !isManaged(local, "testjob") {
 		t.Fatal("local job not created")
 	}
 
-	err = agent.Node.UnassignJob(agent.ClusterBackend, job.ID)
+	err = agent.Node.UnassignJob(ctx, agent.ClusterBackend, job.ID)
 	if err != nil {
 		t.Fatal("unable to unassign job", err)
 	}
 
-	err = agent.syncState()
+	err = agent.syncState(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, ok = local["testjob"]
-	if ok {
+	if isManaged(local, "testjob") {
 		t.Fatal("local job not destroyed")
 	}
 
-	err = agent.watchClusterOnce()
+	err = agent.watchClusterOnce(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-// simple mock local backend for testing
-type TestLocal map[string]cluster.Job
+func isManaged(local Local, jobID string) bool {
+	jobs, _ := local.GetManagedJobs()
+	for _, job := range jobs {
+		if job.ID == jobID {
+			return true
+		}
+	}
+	return false
+}
+
+// Get whether each job we're managing is running.
+func getLocalState(t *testing.T, local Local) map[string]bool {
+	jobs, err := local.GetManagedJobs()
+	if err != nil {
+		t.Fatal("unable to get local jobs", err)
+	}
 
-func (t TestLocal) Connect() error {
-	return nil
+	state := make(map[string]bool)
+	for _, job := range jobs {
+		state[job.ID] = job.IsRunning
+	}
+	return state
 }
 
-func (t TestLocal) Disconnect() {}
+// Create an agent with a fake local, that's joined a cluster kept in memory,
+// and been assigned the provided jobs.
+func getReconcilingAgent(t *testing.T, assigned []string) (*Agent, *Fake) {
+	ctx := context.Background()
+
+	local := NewFake()
+	agent := &Agent{
+		Bind:            "127.0.0.1:23142",
+		NodeName:        "testnode",
+		CPUShares:       1000,
+		BlockIOShares:   1000,
+		MemoryMegabytes: 1000,
+		Namespace:       cluster.NewNamespace("testnamespace"),
+		Local:           local,
+		ClusterBackend:  cluster.NewMemory(),
+	}
+
+	err := agent.joinCluster(ctx)
+	if err != nil {
+		t.Fatal("unable to join cluster", err)
+	}
+
+	for _, jobID := range assigned {
+		job, err := cluster.LoadJob(jobID, unitFile)
+		if err != nil {
+			t.Fatal("unable to load job", err)
+		}
+		err = agent.Namespace.CreateJob(ctx, agent.ClusterBackend, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
 
-func (t TestLocal) GetManagedJobs() ([]cluster.Job, error) {
-	ret := make([]cluster.Job, 0)
-	for _, j := range t {
-		ret = append(ret, j)
+		node, err := agent.Namespace.GetNode(ctx, agent.ClusterBackend, agent.NodeName)
+		if err != nil {
+			t.Fatal("unable to get node", err)
+		}
+		err = node.AssignJob(ctx, agent.ClusterBackend, jobID)
+		if err != nil {
+			t.Fatal("unable to assign job", err)
+		}
 	}
-	return ret, nil
+
+	return agent, local
 }
 
-func (t TestLocal) CreateJob(job *cluster.Job) error {
-	t[job.ID] = *job
-	return nil
+func TestAgentReconcilesLocalJobs(t *testing.T) {
+	ctx := context.Background()
+
+	changedUnitFile := strings.Replace(unitFile, "echo 'foo'", "echo 'bar'", 1)
+
+	// a job the agent already had before syncing
+	existing := func(id string, unit string, running bool) func(*Fake) {
+		return func(local *Fake) {
+			_ = local.CreateJob(&cluster.Job{ID: id, UnitFile: unit})
+			if running {
+				_ = local.StartJob(&cluster.Job{ID: id})
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		assigned []string
+		local    []func(*Fake)
+		calls    []string
+		state    map[string]bool
+	}{
+		{
+			name:     "new job",
+			assigned: []string{"a"},
+			calls:    []string{"create a", "start a"},
+			state:    map[string]bool{"a": true},
+		},
+		{
+			name:     "job not running",
+			assigned: []string{"a"},
+			local:    []func(*Fake){existing("a", unitFile, false)},
+			calls:    []string{"start a"},
+			state:    map[string]bool{"a": true},
+		},
+		{
+			name:     "job that died",
+			assigned: []string{"a"},
+			local:    []func(*Fake){existing("a", unitFile, true), func(local *Fake) { local.Kill("a") }},
+			calls:    []string{"start a"},
+			state:    map[string]bool{"a": true},
+		},
+		{
+			name:     "running job",
+			assigned: []string{"a"},
+			local:    []func(*Fake){existing("a", unitFile, true)},
+			state:    map[string]bool{"a": true},
+		},
+		{
+			name:  "orphaned job",
+			local: []func(*Fake){existing("b", unitFile, true)},
+			calls: []string{"stop b", "destroy b"},
+			state: map[string]bool{},
+		},
+		{
+			name:     "job with a changed unit file",
+			assigned: []string{"a"},
+			local:    []func(*Fake){existing("a", changedUnitFile, true)},
+			calls:    []string{"stop a", "destroy a", "create a", "start a"},
+			state:    map[string]bool{"a": true},
+		},
+		{
+			name:     "job that fails to be created",
+			assigned: []string{"a", "b"},
+			local:    []func(*Fake){func(local *Fake) { local.FailCreate("a", true) }},
+			calls:    []string{"create a", "create b", "start b"},
+			state:    map[string]bool{"b": true},
+		},
+		{
+			name:     "job that fails to start",
+			assigned: []string{"a"},
+			local:    []func(*Fake){func(local *Fake) { local.FailStart("a", true) }},
+			calls:    []string{"create a", "start a"},
+			state:    map[string]bool{"a": false},
+		},
+	}
+
+	for _, test := range tests {
+		agent, local := getReconcilingAgent(t, test.assigned)
+		for _, setup := range test.local {
+			setup(local)
+		}
+		local.Calls()
+
+		err := agent.syncState(ctx)
+		if err != nil {
+			t.Fatal(test.name, "unable to sync state", err)
+		}
+
+		calls := local.Calls()
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Fatal(test.name, "expected calls", test.calls, "but got", calls)
+		}
+		state := getLocalState(t, local)
+		if !reflect.DeepEqual(state, test.state) {
+			t.Fatal(test.name, "expected local jobs", test.state, "but got", state)
+		}
+	}
 }
 
-func (t TestLocal) StartJob(job *cluster.Job) error {
-	j := t[job.ID]
-	j.IsRunning = true
-	return nil
+func TestAgentRetriesFailedJobs(t *testing.T) {
+	ctx := context.Background()
+
+	agent, local := getReconcilingAgent(t, []string{"a"})
+	local.FailCreate("a", true)
+
+	err := agent.syncState(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+	if isManaged(local, "a") {
+		t.Fatal("expected a not to have been created")
+	}
+
+	// the next sync tries again, and gets further
+	local.FailCreate("a", false)
+	local.FailStart("a", true)
+	err = agent.syncState(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+	if state := getLocalState(t, local); !reflect.DeepEqual(state, map[string]bool{"a": false}) {
+		t.Fatal("expected a to have been created, but not started", state)
+	}
+
+	local.FailStart("a", false)
+	err = agent.syncState(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+	if state := getLocalState(t, local); !reflect.DeepEqual(state, map[string]bool{"a": true}) {
+		t.Fatal("expected a to be running", state)
+	}
 }
 
-func (t TestLocal) StopJob(job *cluster.Job) error {
-	j := t[job.ID]
-	j.IsRunning = false
-	return nil
+func TestAgentReportsJobStates(t *testing.T) {
+	ctx := context.Background()
+
+	agent, local := getReconcilingAgent(t, []string{"a", "b"})
+	err := agent.syncState(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+
+	getReported := func() map[string]string {
+		states, err := agent.Namespace.GetRunStates(ctx, agent.ClusterBackend, agent.NodeName)
+		if err != nil {
+			t.Fatal("unable to get run states", err)
+		}
+		reported := make(map[string]string)
+		for _, state := range states {
+			if state.Node != agent.NodeName {
+				t.Fatal("expected state to be reported by this node", state)
+			}
+			reported[state.ID] = state.String()
+		}
+		return reported
+	}
+
+	agent.reportState(ctx)
+	expected := map[string]string{"a": "active (running)", "b": "active (running)"}
+	if reported := getReported(); !reflect.DeepEqual(reported, expected) {
+		t.Fatal("expected both jobs to be reported running", reported)
+	}
+
+	// jobs that die are reported, without touching the ones that didn't
+	bPath := "/kubernotes/clusters/testnamespace/runstates/testnode/b"
+	_, bIndex, _ := agent.ClusterBackend.ReadKey(ctx, bPath)
+
+	local.Kill("a")
+	agent.reportState(ctx)
+	expected = map[string]string{"a": "failed (failed)", "b": "active (running)"}
+	if reported := getReported(); !reflect.DeepEqual(reported, expected) {
+		t.Fatal("expected a to be reported failed", reported)
+	}
+	if _, index, _ := agent.ClusterBackend.ReadKey(ctx, bPath); index != bIndex {
+		t.Fatal("expected b's unchanged state not to be written again")
+	}
+
+	// jobs we no longer run aren't reported
+	node, err := agent.Namespace.GetNode(ctx, agent.ClusterBackend, agent.NodeName)
+	if err != nil {
+		t.Fatal("unable to get node", err)
+	}
+	err = node.UnassignJob(ctx, agent.ClusterBackend, "b")
+	if err != nil {
+		t.Fatal("unable to unassign job", err)
+	}
+	err = agent.syncState(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+
+	agent.reportState(ctx)
+	expected = map[string]string{"a": "active (running)"}
+	if reported := getReported(); !reflect.DeepEqual(reported, expected) {
+		t.Fatal("expected only a to be reported, restarted", reported)
+	}
 }
 
-func (t TestLocal) DestroyJob(job *cluster.Job) error {
-	delete(t, job.ID)
-	return nil
+func TestAgentRestartsJobsThatFail(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	agent, local := getReconcilingAgent(t, []string{"a"})
+	err := agent.sync(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+	local.Calls()
+
+	done := make(chan struct{})
+	go func() {
+		agent.watchLocal(ctx)
+		close(done)
+	}()
+
+	// the job dying locally is enough to restart it, without the cluster
+	// changing
+	local.Kill("a")
+	eventually(t, "job to be restarted", func() bool {
+		return getLocalState(t, local)["a"]
+	})
+	if calls := local.Calls(); !reflect.DeepEqual(calls, []string{"start a"}) {
+		t.Fatal("expected a to be started again", calls)
+	}
+
+	cancel()
+	<-done
+
+	// and the cluster was told how it's doing
+	states, err := agent.Namespace.GetRunStates(context.Background(), agent.ClusterBackend, agent.NodeName)
+	if err != nil {
+		t.Fatal("unable to get run states", err)
+	}
+	if len(states) != 1 || !states[0].IsRunning() {
+		t.Fatal("expected a to be reported running", states)
+	}
+}
+
+func TestAgentKeepsWatchingJobsAfterFailing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	agent, local := getReconcilingAgent(t, []string{"a"})
+	err := agent.sync(ctx)
+	if err != nil {
+		t.Fatal("unable to sync state", err)
+	}
+	local.Calls()
+
+	local.FailWatch(true)
+	go agent.watchLocal(ctx)
+
+	// failing to watch doesn't stop the agent noticing jobs dying later
+	time.Sleep(50 * time.Millisecond)
+	local.FailWatch(false)
+	local.Kill("a")
+	eventually(t, "job to be restarted", func() bool {
+		return getLocalState(t, local)["a"]
+	})
 }
 
-func (t TestLocal) GetLogs(job *cluster.Job, count int) (string, error) {
-	return "", nil
+func TestAgentAPIStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// two agents in one process each serve their own API
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		agent, _ := getTestingAgent()
+		agent.Bind = "127.0.0.1:0"
+		go func() { errs <- agent.SpawnAPI(ctx) }()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal("expected the api to stop cleanly", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the api to stop when the context is done")
+		}
+	}
 }
@@ -1,16 +1,20 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func (a *Agent) SpawnAPI() error {
+// Serve the agent's API on its bind address until the context is done.
+func (a *Agent) SpawnAPI(ctx context.Context) error {
 	listener, err := net.Listen("tcp", a.Bind)
 	if err != nil {
 		return err
@@ -19,8 +23,27 @@ func (a *Agent) SpawnAPI() error {
 
 	log.Println("api listening on", a.Bind)
 
+	// closing the listener is the only way to stop serving
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	server := &http.Server{Handler: a.apiHandler()}
+	err = server.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Get the handler for the agent's API. It has a mux of its own, so several
+// agents can serve in one process.
+func (a *Agent) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+
 	// /logs endpoint to display logs over http
-	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 
 		// accept jobid via querystring ?job=id
 		jobID := r.FormValue("job")
@@ -55,5 +78,18 @@ func (a *Agent) SpawnAPI() error {
 		}
 	})
 
-	return http.Serve(listener, nil)
+	// /jobs endpoint to list the jobs managed locally by this agent
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := a.Local.GetManagedJobs()
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "unable to list jobs: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	})
+
+	return mux
 }
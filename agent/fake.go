@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+// Local that only pretends to run jobs, recording what it's asked to do, for
+// testing agents without systemd. Faults can be injected to see how an agent
+// copes with jobs that can't be created or started, or that die.
+type Fake struct {
+	mu    sync.Mutex
+	jobs  map[string]cluster.Job
+	calls []string
+
+	failCreate map[string]bool
+	failStart  map[string]bool
+	failWatch  bool
+	killed     map[string]bool
+
+	// jobs that died since they were last watched for, and closed and
+	// replaced whenever another does, to wake watchers
+	died    []cluster.RunState
+	changed chan struct{}
+}
+
+// Create a new Fake job management backend, managing no jobs.
+func NewFake() *Fake {
+	return &Fake{
+		jobs:       make(map[string]cluster.Job),
+		failCreate: make(map[string]bool),
+		failStart:  make(map[string]bool),
+		killed:     make(map[string]bool),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Nothing to connect to.
+func (f *Fake) Connect() error {
+	return nil
+}
+
+// Nothing to disconnect from.
+func (f *Fake) Disconnect() {}
+
+// Get the jobs we're pretending to manage, ordered by ID.
+func (f *Fake) GetManagedJobs() ([]cluster.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ids := make([]string, 0, len(f.jobs))
+	for id := range f.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jobs := make([]cluster.Job, len(ids))
+	for i, id := range ids {
+		jobs[i] = f.jobs[id]
+	}
+	return jobs, nil
+}
+
+// Pretend to create a job, stopped, unless creating it has been made to fail.
+func (f *Fake) CreateJob(job *cluster.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("create", job)
+	if f.failCreate[job.ID] {
+		return fmt.Errorf("could not create job %s", job.ID)
+	}
+
+	f.jobs[job.ID] = cluster.Job{ID: job.ID, UnitFile: job.UnitFile}
+	return nil
+}
+
+// Pretend to start a job, unless starting it has been made to fail.
+func (f *Fake) StartJob(job *cluster.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("start", job)
+	local, ok := f.jobs[job.ID]
+	if !ok {
+		return fmt.Errorf("job %s does not exist", job.ID)
+	}
+	if f.failStart[job.ID] {
+		return fmt.Errorf("could not start job %s", job.ID)
+	}
+
+	local.IsRunning = true
+	f.jobs[job.ID] = local
+	delete(f.killed, job.ID)
+	return nil
+}
+
+// Pretend to stop a job.
+func (f *Fake) StopJob(job *cluster.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("stop", job)
+	local, ok := f.jobs[job.ID]
+	if !ok {
+		return fmt.Errorf("job %s does not exist", job.ID)
+	}
+
+	local.IsRunning = false
+	f.jobs[job.ID] = local
+	return nil
+}
+
+// Forget a job.
+func (f *Fake) DestroyJob(job *cluster.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record("destroy", job)
+	if _, ok := f.jobs[job.ID]; !ok {
+		return fmt.Errorf("job %s does not exist", job.ID)
+	}
+
+	delete(f.jobs, job.ID)
+	delete(f.killed, job.ID)
+	return nil
+}
+
+// Get whether a job is running, or has died.
+func (f *Fake) GetJobState(job *cluster.Job) (*cluster.RunState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	local, ok := f.jobs[job.ID]
+	if !ok {
+		return nil, fmt.Errorf("unable to get state of job %s: no such job", job.ID)
+	}
+
+	switch {
+	case local.IsRunning:
+		return &cluster.RunState{ID: job.ID, ActiveState: "active", SubState: "running"}, nil
+	case f.killed[job.ID]:
+		return &cluster.RunState{ID: job.ID, ActiveState: "failed", SubState: "failed", ExitCode: 9}, nil
+	}
+	return &cluster.RunState{ID: job.ID, ActiveState: "inactive", SubState: "dead"}, nil
+}
+
+// Jobs don't write anything.
+func (f *Fake) GetLogs(job *cluster.Job, count int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.jobs[job.ID]; !ok {
+		return "", fmt.Errorf("unable to get logs for job %s: no such job", job.ID)
+	}
+	return "", nil
+}
+
+// Make creating a job fail, or succeed again.
+func (f *Fake) FailCreate(jobID string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failCreate[jobID] = fail
+}
+
+// Make starting a job fail, or succeed again.
+func (f *Fake) FailStart(jobID string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failStart[jobID] = fail
+}
+
+// Make watching for jobs dying fail, or succeed again.
+func (f *Fake) FailWatch(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failWatch = fail
+}
+
+// Have a running job die, as though it crashed.
+func (f *Fake) Kill(jobID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	local, ok := f.jobs[jobID]
+	if ok && local.IsRunning {
+		local.IsRunning = false
+		f.jobs[jobID] = local
+		f.killed[jobID] = true
+
+		f.died = append(f.died, cluster.RunState{ID: jobID, ActiveState: "failed", SubState: "failed", ExitCode: 9})
+		close(f.changed)
+		f.changed = make(chan struct{})
+	}
+}
+
+// Block until jobs die, or the context is done.
+func (f *Fake) WatchForChanges(ctx context.Context) ([]cluster.RunState, error) {
+	f.mu.Lock()
+	if f.failWatch {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("fake failure watching jobs")
+	}
+	for len(f.died) == 0 {
+		wait := f.changed
+		f.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+
+	died := f.died
+	f.died = nil
+	return died, nil
+}
+
+// Get what we've been asked to do since the last time, such as "start job1",
+// in the order we were asked.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *Fake) record(call string, job *cluster.Job) {
+	f.calls = append(f.calls, call+" "+job.ID)
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Determine facts about the machine we're running on, for jobs to constrain on.
+func DetectLabels() map[string]string {
+	labels := map[string]string{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}
+
+	hostname, err := os.Hostname()
+	if err == nil {
+		labels["hostname"] = hostname
+	}
+
+	kernel, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err == nil {
+		labels["kernel"] = strings.TrimSpace(string(kernel))
+	}
+
+	return labels
+}
+
+// Parse labels given in the form key=value.
+func ParseLabels(raw []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range raw {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("label %s must be in the form key=value", label)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/cluster"
 )
 
@@ -13,7 +15,7 @@ type Local interface {
 	// Disconnect from the job management backend.
 	Disconnect()
 
-	// Retrieve the list of jobs that we're managing.
+	// Retrieve the list of jobs that we're managing, with their unit files if known.
 	GetManagedJobs() ([]cluster.Job, error)
 
 	// Create a job.
@@ -28,6 +30,14 @@ type Local interface {
 	// Destroy an existing job.
 	DestroyJob(job *cluster.Job) error
 
+	// Get what can be seen of a job, such as whether it's running and how it
+	// last exited.
+	GetJobState(job *cluster.Job) (*cluster.RunState, error)
+
+	// Block until jobs we manage change state, such as when they fail, or the
+	// context is done. Returns what the jobs that changed changed to.
+	WatchForChanges(ctx context.Context) ([]cluster.RunState, error)
+
 	// GetLogs
 	GetLogs(job *cluster.Job, count int) (string, error)
 }
@@ -0,0 +1,846 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/unit"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+// Where cgroup v2 is mounted.
+const cgroupMount = "/sys/fs/cgroup"
+
+// The controllers we limit jobs with, if they're available.
+var cgroupControllers = []string{"cpu", "memory", "io"}
+
+// How long to wait before restarting a job, and for a job to exit once it's
+// asked to stop before it's killed, unless its unit file says otherwise. Both
+// are systemd's defaults.
+const (
+	defaultRestartSec     = 100 * time.Millisecond
+	defaultTimeoutStopSec = 90 * time.Second
+)
+
+// Runs jobs as child processes of the agent, for hosts without systemd, such
+// as containers and CI. The Service section of each job's unit file says how
+// to run it, and what each job writes is kept in a log file. Jobs are limited
+// with cgroup v2 when it's available. Jobs stop when the agent does.
+type Process struct {
+	Namespace string
+	NodeName  string
+
+	// Where unit files and logs are kept.
+	Dir string
+
+	// The cgroup v2 directory each job gets a cgroup under. Jobs aren't
+	// limited if it's empty.
+	CgroupRoot string
+
+	mu        sync.Mutex
+	processes map[string]*process
+
+	// jobs whose processes have exited since they were last watched for, and
+	// closed and replaced whenever another does, to wake watchers
+	exited  map[string]bool
+	changed chan struct{}
+}
+
+// A job we've started, and are keeping running.
+type process struct {
+	service *service
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	log *os.File
+
+	// what we've seen of it, named as systemd names them
+	subState  string
+	restarts  int
+	exitCode  int
+	startedAt time.Time
+	exitedAt  time.Time
+
+	// closed when we're asked to stop, and once we have
+	stop chan struct{}
+	done chan struct{}
+}
+
+// What we need from the Service section of a unit file to run a job.
+type service struct {
+	ExecStart        []string
+	Argv0            string
+	IgnoreFailure    bool
+	Environment      []string
+	WorkingDirectory string
+	User             string
+	Restart          string
+	RestartSec       time.Duration
+	TimeoutStopSec   time.Duration
+}
+
+// Create a new Process job management backend, keeping unit files and logs in
+// dir. Jobs are limited with cgroup v2 if it's mounted.
+func NewProcess(namespace string, nodeName string, dir string) *Process {
+	p := &Process{
+		Namespace: namespace,
+		NodeName:  nodeName,
+		Dir:       dir,
+		processes: make(map[string]*process),
+		exited:    make(map[string]bool),
+		changed:   make(chan struct{}),
+	}
+
+	_, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers"))
+	if err == nil {
+		p.CgroupRoot = filepath.Join(cgroupMount, "kubernotes")
+	}
+	return p
+}
+
+// Create the directory unit files and logs are kept in, and the cgroup jobs
+// are limited in. If we can't use the cgroup, jobs are run without limits.
+func (p *Process) Connect() error {
+	err := os.MkdirAll(p.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create job directory %v", err)
+	}
+
+	if p.CgroupRoot != "" {
+		err = enableControllers(p.CgroupRoot)
+		if err != nil {
+			log.Println("running jobs without limits, unable to set up cgroup", p.CgroupRoot, err)
+			p.CgroupRoot = ""
+		}
+	}
+	return nil
+}
+
+// Stop every job, as nobody would be looking after them once we're gone.
+func (p *Process) Disconnect() {
+	p.mu.Lock()
+	ids := make([]string, 0, len(p.processes))
+	for id := range p.processes {
+		ids = append(ids, id)
+	}
+	p.mu.Unlock()
+
+	for _, id := range ids {
+		err := p.StopJob(&cluster.Job{ID: id})
+		if err != nil {
+			log.Println("unable to stop local job", id, err)
+		}
+	}
+}
+
+// Write the unit file for a job to disk, once we know we can run it.
+func (p *Process) CreateJob(job *cluster.Job) error {
+	_, err := parseService(job.UnitFile)
+	if err != nil {
+		return fmt.Errorf("could not create job %s %v", job.ID, err)
+	}
+
+	err = ioutil.WriteFile(p.getUnitPath(job), []byte(job.UnitFile), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write job unit file %v", err)
+	}
+	return nil
+}
+
+// Start a job from its unit file, restarting it as the unit file says, until
+// it's stopped.
+func (p *Process) StartJob(job *cluster.Job) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	running, ok := p.processes[job.ID]
+	if ok {
+		select {
+		case <-running.done:
+		default:
+			return nil
+		}
+	}
+
+	unitFile, err := ioutil.ReadFile(p.getUnitPath(job))
+	if err != nil {
+		return fmt.Errorf("could not read job unit file %v", err)
+	}
+	svc, err := parseService(string(unitFile))
+	if err != nil {
+		return fmt.Errorf("could not start job %s %v", job.ID, err)
+	}
+
+	// limits are taken from the unit file, as they are by systemd. Instances
+	// share their job's unit file, so it's loaded as the job's.
+	jobID, _ := cluster.ParseInstanceID(job.ID)
+	limits, err := cluster.LoadJob(jobID, string(unitFile))
+	if err != nil {
+		return fmt.Errorf("could not start job %s %v", job.ID, err)
+	}
+	limits.ID = job.ID
+	job = limits
+
+	proc := &process{
+		service: svc,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	err = p.exec(job, proc)
+	if err != nil {
+		return err
+	}
+
+	p.processes[job.ID] = proc
+	go p.supervise(job, proc)
+	return nil
+}
+
+// Ask a job to stop, killing it if it doesn't in time.
+func (p *Process) StopJob(job *cluster.Job) error {
+	p.mu.Lock()
+	proc, ok := p.processes[job.ID]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-proc.done:
+		return nil
+	default:
+	}
+
+	proc.askToStop()
+	proc.signal(syscall.SIGTERM)
+	select {
+	case <-proc.done:
+		return nil
+	case <-time.After(proc.service.TimeoutStopSec):
+	}
+
+	log.Println("job", job.ID, "did not stop in time, killing it")
+	proc.signal(syscall.SIGKILL)
+	<-proc.done
+	return nil
+}
+
+// Remove the unit file and cgroup of a stopped job. Its log is kept.
+func (p *Process) DestroyJob(job *cluster.Job) error {
+	p.mu.Lock()
+	delete(p.processes, job.ID)
+	p.mu.Unlock()
+
+	err := os.Remove(p.getUnitPath(job))
+	if err != nil {
+		return fmt.Errorf("could not delete job unit file %v", err)
+	}
+
+	if p.CgroupRoot != "" {
+		err = os.Remove(p.getCgroupPath(job))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("unable to remove cgroup for job", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// Get a list of all local Jobs that we are responsible for (belong to our kubernotes node), along with their unit files.
+func (p *Process) GetManagedJobs() ([]cluster.Job, error) {
+	startsWith := p.getServicePrefix()
+	localJobs := make([]cluster.Job, 0)
+
+	files, err := ioutil.ReadDir(p.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list job unit files %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, startsWith) || !strings.HasSuffix(name, ".service") {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(name, startsWith), ".service")
+		running := false
+		if proc, ok := p.processes[id]; ok {
+			select {
+			case <-proc.done:
+			default:
+				running = true
+			}
+		}
+
+		unitFile, err := ioutil.ReadFile(filepath.Join(p.Dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read job unit file %v", err)
+		}
+
+		localJobs = append(localJobs, cluster.Job{
+			ID:        id,
+			UnitFile:  string(unitFile),
+			IsRunning: running,
+		})
+	}
+
+	return localJobs, nil
+}
+
+// Get what can be seen of a job, whether it's running and how it last exited.
+func (p *Process) GetJobState(job *cluster.Job) (*cluster.RunState, error) {
+	_, err := os.Stat(p.getUnitPath(job))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get state of job %s: %v", job.ID, err)
+	}
+
+	p.mu.Lock()
+	proc, ok := p.processes[job.ID]
+	p.mu.Unlock()
+
+	// created, but never started
+	if !ok {
+		return &cluster.RunState{ID: job.ID, ActiveState: "inactive", SubState: "dead"}, nil
+	}
+	return proc.state(job.ID), nil
+}
+
+// Block until jobs' processes exit, or the context is done. Jobs that are
+// being restarted, or have been destroyed since, are included as they are now.
+func (p *Process) WatchForChanges(ctx context.Context) ([]cluster.RunState, error) {
+	p.mu.Lock()
+	for len(p.exited) == 0 {
+		wait := p.changed
+		p.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.exited))
+	for id := range p.exited {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	p.exited = make(map[string]bool)
+
+	states := make([]cluster.RunState, 0, len(ids))
+	for _, id := range ids {
+		state := cluster.RunState{ID: id, ActiveState: "inactive", SubState: "dead"}
+		if proc, ok := p.processes[id]; ok {
+			state = *proc.state(id)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Get the last count lines a job has written.
+func (p *Process) GetLogs(job *cluster.Job, count int) (string, error) {
+	logs, err := ioutil.ReadFile(p.getLogPath(job))
+	if err != nil {
+		return "", fmt.Errorf("unable to get logs for job %s: %v", job.ID, err)
+	}
+
+	lines := strings.SplitAfter(string(logs), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// Wait for a job to exit, and restart it if its unit file says to, until it's
+// stopped.
+func (p *Process) supervise(job *cluster.Job, proc *process) {
+	defer close(proc.done)
+
+	for {
+		err := proc.cmd.Wait()
+		proc.log.Close()
+		log.Println("local job", job.ID, "exited", proc.cmd.ProcessState)
+		proc.exited(err)
+		p.notify(job.ID)
+
+		select {
+		case <-proc.stop:
+			return
+		default:
+		}
+		if !proc.service.shouldRestart(err, proc.cmd.ProcessState) {
+			return
+		}
+
+		proc.setSubState("auto-restart")
+		select {
+		case <-proc.stop:
+			proc.setSubState("dead")
+			return
+		case <-time.After(proc.service.RestartSec):
+		}
+
+		log.Println("restarting local job", job.ID)
+		err = p.exec(job, proc)
+		if err != nil {
+			log.Println("unable to restart local job", job.ID, err)
+			proc.setSubState("failed")
+			p.notify(job.ID)
+			return
+		}
+
+		proc.mu.Lock()
+		proc.restarts++
+		proc.mu.Unlock()
+	}
+}
+
+// Let watchers know a job's process has exited.
+func (p *Process) notify(jobID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.exited[jobID] = true
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Start the process for a job, writing what it outputs to its log, and
+// limiting it if we can.
+func (p *Process) exec(job *cluster.Job, proc *process) error {
+	svc := proc.service
+
+	logFile, err := os.OpenFile(p.getLogPath(job), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open job log %v", err)
+	}
+
+	cmd, err := svc.command()
+	if err != nil {
+		logFile.Close()
+		return fmt.Errorf("could not start job %s %v", job.ID, err)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	// its own process group, so whatever it starts is stopped along with it
+	cmd.SysProcAttr.Setpgid = true
+
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	err = cmd.Start()
+	if err != nil {
+		logFile.Close()
+		return fmt.Errorf("could not start job %s %v", job.ID, err)
+	}
+	proc.cmd = cmd
+	proc.log = logFile
+	proc.subState = "running"
+	proc.startedAt = time.Now()
+
+	// the job runs unlimited for the moment it takes to move it into its cgroup
+	if p.CgroupRoot != "" {
+		err = p.limit(job, cmd.Process.Pid)
+		if err != nil {
+			log.Println("running job", job.ID, "without limits", err)
+		}
+	}
+	return nil
+}
+
+// Move a job's process into a cgroup of its own, limited to the resources the
+// job asked for.
+func (p *Process) limit(job *cluster.Job, pid int) error {
+	path := p.getCgroupPath(job)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create cgroup %v", err)
+	}
+
+	limits := map[string]string{
+		"memory.max": strconv.Itoa(job.MemoryLimitMegabytes * 1024 * 1024),
+		"cpu.weight": strconv.Itoa(cpuWeight(job.CPUShares)),
+		"io.weight":  strconv.Itoa(ioWeight(job.BlockIOWeight)),
+	}
+	for file, value := range limits {
+		err = ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+		if err != nil {
+			log.Println("unable to set", file, "for job", job.ID, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	if err != nil {
+		return fmt.Errorf("could not move job into cgroup %v", err)
+	}
+	return nil
+}
+
+// Record how a job's process exited.
+func (proc *process) exited(err error) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	proc.exitedAt = time.Now()
+	proc.exitCode = 0
+	if status, ok := proc.cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		proc.exitCode = status.ExitStatus()
+		if status.Signaled() {
+			proc.exitCode = int(status.Signal())
+		}
+	}
+
+	proc.subState = "dead"
+	if clean, _ := proc.service.exitedCleanly(err, proc.cmd.ProcessState); !clean {
+		proc.subState = "failed"
+	}
+}
+
+func (proc *process) setSubState(subState string) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	proc.subState = subState
+}
+
+// Get what we've seen of a job's process, as systemd would describe it.
+func (proc *process) state(id string) *cluster.RunState {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	state := &cluster.RunState{
+		ID:        id,
+		SubState:  proc.subState,
+		Restarts:  proc.restarts,
+		ExitCode:  proc.exitCode,
+		StartedAt: proc.startedAt,
+		ExitedAt:  proc.exitedAt,
+	}
+	switch proc.subState {
+	case "running":
+		state.ActiveState = "active"
+		state.MainPID = proc.cmd.Process.Pid
+	case "auto-restart":
+		state.ActiveState = "activating"
+	case "failed":
+		state.ActiveState = "failed"
+	default:
+		state.ActiveState = "inactive"
+	}
+	return state
+}
+
+// Ask a job not to be restarted, however many times it's asked at once.
+func (proc *process) askToStop() {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	select {
+	case <-proc.stop:
+	default:
+		close(proc.stop)
+	}
+}
+
+// Send a signal to everything a job is running.
+func (proc *process) signal(sig syscall.Signal) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	if proc.cmd != nil && proc.cmd.Process != nil {
+		syscall.Kill(-proc.cmd.Process.Pid, sig)
+	}
+}
+
+func (p *Process) getServicePrefix() string {
+	return fmt.Sprintf("kubernotes-%s-%s-", p.Namespace, p.NodeName)
+}
+
+func (p *Process) getUnitPath(job *cluster.Job) string {
+	return filepath.Join(p.Dir, p.getServicePrefix()+job.ID+".service")
+}
+
+func (p *Process) getLogPath(job *cluster.Job) string {
+	return filepath.Join(p.Dir, p.getServicePrefix()+job.ID+".log")
+}
+
+func (p *Process) getCgroupPath(job *cluster.Job) string {
+	return filepath.Join(p.CgroupRoot, p.getServicePrefix()+job.ID)
+}
+
+// Create a cgroup, and let the cgroups below it be limited. The controllers
+// have to be enabled all the way down from the root.
+func enableControllers(path string) error {
+	available, err := ioutil.ReadFile(filepath.Join(cgroupMount, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	enable := make([]string, 0)
+	for _, controller := range strings.Fields(string(available)) {
+		for _, wanted := range cgroupControllers {
+			if controller == wanted {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return fmt.Errorf("none of %v are available", cgroupControllers)
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(cgroupMount, path)
+	if err != nil {
+		return err
+	}
+
+	dir := cgroupMount
+	for _, part := range append([]string{""}, strings.Split(rel, string(filepath.Separator))...) {
+		dir = filepath.Join(dir, part)
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convert systemd's CPUShares to a cgroup v2 cpu.weight, as systemd does.
+func cpuWeight(shares int) int {
+	return clampWeight(shares * 100 / 1024)
+}
+
+// Convert systemd's BlockIOWeight to a cgroup v2 io.weight, as systemd does.
+func ioWeight(weight int) int {
+	return clampWeight(weight * 100 / 500)
+}
+
+func clampWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	if weight > 10000 {
+		return 10000
+	}
+	return weight
+}
+
+// Read what we need to run a job from its unit file.
+func parseService(unitFile string) (*service, error) {
+	opts, err := unit.Deserialize(strings.NewReader(unitFile))
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &service{
+		Restart:        "no",
+		RestartSec:     defaultRestartSec,
+		TimeoutStopSec: defaultTimeoutStopSec,
+	}
+	for _, opt := range opts {
+		if opt.Section != "Service" {
+			continue
+		}
+
+		switch opt.Name {
+		case "ExecStart":
+			err = svc.setExecStart(opt.Value)
+		case "Environment":
+			var env []string
+			env, err = splitWords(opt.Value)
+			svc.Environment = append(svc.Environment, env...)
+		case "WorkingDirectory":
+			svc.WorkingDirectory = opt.Value
+		case "User":
+			svc.User = opt.Value
+		case "Restart":
+			svc.Restart = opt.Value
+			switch opt.Value {
+			case "no", "always", "on-success", "on-failure", "on-abnormal", "on-abort":
+			default:
+				err = fmt.Errorf("unsupported Restart %s", opt.Value)
+			}
+		case "RestartSec":
+			svc.RestartSec, err = parseSeconds(opt.Value)
+		case "TimeoutStopSec":
+			svc.TimeoutStopSec, err = parseSeconds(opt.Value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %v", opt.Name, err)
+		}
+	}
+
+	if len(svc.ExecStart) == 0 {
+		return nil, fmt.Errorf("unit file has no ExecStart")
+	}
+	return svc, nil
+}
+
+// Read the command that runs the service. Like systemd, the command may be
+// prefixed with - to ignore it failing, or @ to pass its second word as its
+// name. Other prefixes are ignored.
+func (svc *service) setExecStart(value string) error {
+	words, err := splitWords(value)
+	if err != nil || len(words) == 0 {
+		return err
+	}
+
+	path := words[0]
+	argv0 := false
+	for len(path) > 1 && strings.ContainsRune("-@+!:", rune(path[0])) {
+		switch path[0] {
+		case '-':
+			svc.IgnoreFailure = true
+		case '@':
+			argv0 = true
+		}
+		path = path[1:]
+	}
+
+	args := words[1:]
+	if argv0 {
+		if len(args) == 0 {
+			return fmt.Errorf("%s has no name to run it as", path)
+		}
+		svc.Argv0 = args[0]
+		args = args[1:]
+	}
+
+	svc.ExecStart = append([]string{path}, args...)
+	return nil
+}
+
+// Make the command that runs the service.
+func (svc *service) command() (*exec.Cmd, error) {
+	cmd := exec.Command(svc.ExecStart[0], svc.ExecStart[1:]...)
+	if svc.Argv0 != "" {
+		cmd.Args[0] = svc.Argv0
+	}
+	cmd.Env = append(os.Environ(), svc.Environment...)
+	cmd.Dir = svc.WorkingDirectory
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	if svc.User != "" {
+		u, err := user.Lookup(svc.User)
+		if err != nil {
+			return nil, fmt.Errorf("unknown User %s %v", svc.User, err)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		if uid != os.Getuid() {
+			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		}
+	}
+	return cmd, nil
+}
+
+// Decide whether a job should be restarted after exiting, as systemd would.
+func (svc *service) shouldRestart(err error, state *os.ProcessState) bool {
+	clean, signaled := svc.exitedCleanly(err, state)
+
+	switch svc.Restart {
+	case "always":
+		return true
+	case "on-success":
+		return clean
+	case "on-failure":
+		return !clean
+	case "on-abnormal", "on-abort":
+		return signaled
+	}
+	return false
+}
+
+// Decide whether a job exited cleanly, and whether it was killed by a signal
+// that's not a clean exit. Exiting cleanly means exiting with 0, unless
+// failure is ignored, or being stopped by a signal that asks a process to
+// stop.
+func (svc *service) exitedCleanly(err error, state *os.ProcessState) (clean bool, signaled bool) {
+	clean = err == nil || svc.IgnoreFailure
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signaled = true
+		switch status.Signal() {
+		case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE:
+			clean = true
+			signaled = false
+		}
+	}
+	return clean, signaled
+}
+
+// Split a unit file value into words, the way systemd does, keeping quoted
+// words together.
+func splitWords(value string) ([]string, error) {
+	words := make([]string, 0)
+	var word []rune
+	inWord := false
+	var quote rune
+
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word = append(word, runes[i])
+			inWord = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word = append(word, r)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, string(word))
+				word = nil
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", value)
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// Parse a time span in seconds, or with a unit, as systemd does.
+func parseSeconds(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
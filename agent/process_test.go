@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+func newTestProcess(t *testing.T) (*Process, func()) {
+	dir, err := ioutil.TempDir("", "kubernotes-process")
+	if err != nil {
+		t.Fatal("unable to create directory", err)
+	}
+
+	// leave the host's cgroups alone
+	p := NewProcess("test", "testnode", dir)
+	p.CgroupRoot = ""
+
+	err = p.Connect()
+	if err != nil {
+		t.Fatal("unable to connect", err)
+	}
+	return p, func() {
+		p.Disconnect()
+		os.RemoveAll(dir)
+	}
+}
+
+func startTestJob(t *testing.T, p *Process, id string, service string) *cluster.Job {
+	job := &cluster.Job{ID: id, UnitFile: "[Service]\n" + service}
+	err := p.CreateJob(job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+	err = p.StartJob(job)
+	if err != nil {
+		t.Fatal("unable to start job", err)
+	}
+	return job
+}
+
+// Wait for a condition, failing if it takes too long.
+func eventually(t *testing.T, what string, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isRunning(p *Process, id string) bool {
+	jobs, _ := p.GetManagedJobs()
+	for _, job := range jobs {
+		if job.ID == id {
+			return job.IsRunning
+		}
+	}
+	return false
+}
+
+func TestParseService(t *testing.T) {
+	svc, err := parseService(`[Service]
+ExecStart=-@/bin/sh greeter -c 'echo "$A $B"'
+Environment=A=1 "B=two words"
+Environment=C=3
+WorkingDirectory=/tmp
+Restart=on-failure
+RestartSec=2
+TimeoutStopSec=500ms
+`)
+	if err != nil {
+		t.Fatal("unable to parse service", err)
+	}
+
+	expected := &service{
+		ExecStart:        []string{"/bin/sh", "-c", `echo "$A $B"`},
+		Argv0:            "greeter",
+		IgnoreFailure:    true,
+		Environment:      []string{"A=1", "B=two words", "C=3"},
+		WorkingDirectory: "/tmp",
+		Restart:          "on-failure",
+		RestartSec:       2 * time.Second,
+		TimeoutStopSec:   500 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(svc, expected) {
+		t.Fatal("unexpected service", svc)
+	}
+
+	for _, unitFile := range []string{
+		"[Service]\nType=simple\n",
+		"[Service]\nExecStart=/bin/true\nRestart=sometimes\n",
+		"[Service]\nExecStart=/bin/echo 'unterminated\n",
+	} {
+		_, err = parseService(unitFile)
+		if err == nil {
+			t.Fatal("expected unit file to be rejected", unitFile)
+		}
+	}
+}
+
+func TestProcessRunsJob(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	job := startTestJob(t, p, "greeter", `ExecStart=/bin/sh -c 'echo "$GREETING from $(pwd)"; echo oops >&2'
+Environment="GREETING=hello there"
+WorkingDirectory=`+p.Dir+`
+`)
+	eventually(t, "job to finish", func() bool { return !isRunning(p, job.ID) })
+
+	logs, err := p.GetLogs(job, 20)
+	if err != nil {
+		t.Fatal("unable to get logs", err)
+	}
+	if logs != "hello there from "+p.Dir+"\noops\n" {
+		t.Fatal("unexpected logs", logs)
+	}
+
+	// only the most recent lines are returned
+	logs, _ = p.GetLogs(job, 1)
+	if logs != "oops\n" {
+		t.Fatal("expected only the last line", logs)
+	}
+
+	// the job is still managed until it's destroyed
+	jobs, _ := p.GetManagedJobs()
+	if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Fatal("expected the job to be managed", jobs)
+	}
+
+	err = p.DestroyJob(job)
+	if err != nil {
+		t.Fatal("unable to destroy job", err)
+	}
+	jobs, _ = p.GetManagedJobs()
+	if len(jobs) != 0 {
+		t.Fatal("expected no jobs once destroyed", jobs)
+	}
+}
+
+func TestProcessRunsInstance(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	job := (&cluster.Job{ID: "web", UnitFile: "[Service]\nExecStart=/bin/sleep 10\nMemoryLimit=10M\n"}).Instance(1)
+	err := p.CreateJob(job)
+	if err != nil {
+		t.Fatal("unable to create instance", err)
+	}
+	err = p.StartJob(job)
+	if err != nil {
+		t.Fatal("unable to start instance", err)
+	}
+
+	if !isRunning(p, job.ID) {
+		t.Fatal("expected the instance to be running", job.ID)
+	}
+}
+
+func TestProcessRestartsJob(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	job := startTestJob(t, p, "flaky", `ExecStart=/bin/sh -c 'echo ran; exit 1'
+Restart=on-failure
+RestartSec=0.01
+`)
+	ran := func() int {
+		logs, _ := p.GetLogs(job, 100)
+		return strings.Count(logs, "ran")
+	}
+	eventually(t, "job to be restarted", func() bool { return ran() >= 3 })
+
+	err := p.StopJob(job)
+	if err != nil {
+		t.Fatal("unable to stop job", err)
+	}
+	if isRunning(p, job.ID) {
+		t.Fatal("expected the job to be stopped")
+	}
+
+	// once stopped, it stays stopped
+	stoppedAt := ran()
+	time.Sleep(50 * time.Millisecond)
+	if ran() != stoppedAt {
+		t.Fatal("expected the job not to be restarted once stopped")
+	}
+
+	// a job that succeeds isn't restarted on failure
+	job = startTestJob(t, p, "steady", "ExecStart=/bin/true\nRestart=on-failure\nRestartSec=0.01\n")
+	eventually(t, "job to finish", func() bool { return !isRunning(p, job.ID) })
+}
+
+func TestProcessKillsJobThatWontStop(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	job := startTestJob(t, p, "stubborn", `ExecStart=/bin/sh -c 'trap "" TERM; echo started; while true; do sleep 0.01; done'
+TimeoutStopSec=0.1
+`)
+	eventually(t, "job to start", func() bool {
+		logs, _ := p.GetLogs(job, 1)
+		return logs == "started\n"
+	})
+
+	start := time.Now()
+	err := p.StopJob(job)
+	if err != nil {
+		t.Fatal("unable to stop job", err)
+	}
+	if isRunning(p, job.ID) || time.Since(start) > 2*time.Second {
+		t.Fatal("expected the job to be killed once it didn't stop in time")
+	}
+
+	// a stopped job can be started again
+	err = p.StartJob(job)
+	if err != nil {
+		t.Fatal("unable to start job again", err)
+	}
+	if !isRunning(p, job.ID) {
+		t.Fatal("expected the job to be running again")
+	}
+}
+
+func TestProcessStopsJobOnceWhenAskedTogether(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	job := startTestJob(t, p, "popular", "ExecStart=/bin/sleep 10\n")
+
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- p.StopJob(job) }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatal("unable to stop job", err)
+		}
+	}
+
+	if isRunning(p, job.ID) {
+		t.Fatal("expected the job to have stopped")
+	}
+}
+
+func TestProcessReportsJobState(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	// created, but not started
+	job := &cluster.Job{ID: "sleeper", UnitFile: "[Service]\nExecStart=/bin/sleep 60\n"}
+	err := p.CreateJob(job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+	state, err := p.GetJobState(job)
+	if err != nil {
+		t.Fatal("unable to get job state", err)
+	}
+	if state.String() != "inactive (dead)" {
+		t.Fatal("expected a job that hasn't started to be inactive", state)
+	}
+
+	err = p.StartJob(job)
+	if err != nil {
+		t.Fatal("unable to start job", err)
+	}
+	state, _ = p.GetJobState(job)
+	if state.String() != "active (running)" || state.MainPID == 0 || state.StartedAt.IsZero() {
+		t.Fatal("expected a running job", state)
+	}
+
+	// being stopped isn't a failure
+	err = p.StopJob(job)
+	if err != nil {
+		t.Fatal("unable to stop job", err)
+	}
+	state, _ = p.GetJobState(job)
+	if state.String() != "inactive (dead)" || state.ExitedAt.IsZero() {
+		t.Fatal("expected a stopped job to be inactive", state)
+	}
+
+	// restarts are counted, and how the job last exited is kept
+	job = startTestJob(t, p, "flaky", "ExecStart=/bin/sh -c 'exit 3'\nRestart=on-failure\nRestartSec=0.01\n")
+	eventually(t, "job to be restarted", func() bool {
+		state, _ = p.GetJobState(job)
+		return state.Restarts >= 2
+	})
+	err = p.StopJob(job)
+	if err != nil {
+		t.Fatal("unable to stop job", err)
+	}
+	state, _ = p.GetJobState(job)
+	if state.ExitCode != 3 {
+		t.Fatal("expected the job's exit code", state)
+	}
+
+	// jobs that fail without being restarted stay failed
+	job = startTestJob(t, p, "broken", "ExecStart=/bin/sh -c 'exit 1'\n")
+	eventually(t, "job to fail", func() bool {
+		state, _ = p.GetJobState(job)
+		return state.String() == "failed (failed)"
+	})
+
+	_, err = p.GetJobState(&cluster.Job{ID: "missing"})
+	if err == nil {
+		t.Fatal("expected no state for a job that doesn't exist")
+	}
+}
+
+func TestProcessWatchesForJobsExiting(t *testing.T) {
+	p, cleanup := newTestProcess(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	job := startTestJob(t, p, "broken", "ExecStart=/bin/sh -c 'exit 1'\n")
+	changed, err := p.WatchForChanges(ctx)
+	if err != nil {
+		t.Fatal("unable to watch for changes", err)
+	}
+	if len(changed) != 1 || changed[0].ID != job.ID || changed[0].String() != "failed (failed)" {
+		t.Fatal("expected the job to have failed", changed)
+	}
+
+	// nothing else has changed, so we wait until we give up
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.WatchForChanges(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected to give up watching", err)
+	}
+}
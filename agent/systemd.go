@@ -6,19 +6,32 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	systemd "github.com/coreos/go-systemd/dbus"
+	"golang.org/x/net/context"
 
 	"github.com/sofuture/kubernotes/cluster"
 )
 
+// How many unit changes systemd can tell us about before we've looked at
+// them. Any more are missed, and we list every unit again to catch up.
+const unitUpdateBuffer = 256
+
 type Systemd struct {
 	Namespace string
 	NodeName  string
 
 	conn *systemd.Conn
+
+	// changes to units as systemd signals them, and whether we've listed
+	// every unit since we last missed any
+	updates chan *systemd.SubStateUpdate
+	errs    chan error
+	listed  bool
 }
 
 // Create a new Systemd job management backend.
@@ -29,18 +42,34 @@ func NewSystemd(namespace string, nodeName string) *Systemd {
 	}
 }
 
-// Connect to Systemd over dbus.
+// Connect to Systemd over dbus, and subscribe to changes to units.
 func (s *Systemd) Connect() (err error) {
 	s.conn, err = systemd.NewSystemdConnection()
-	return err
+	if err != nil {
+		return fmt.Errorf("cannot connect to systemd, maybe you need to be root? %v", err)
+	}
+
+	err = s.conn.Subscribe()
+	if err != nil {
+		s.conn.Close()
+		return fmt.Errorf("cannot subscribe to systemd unit changes %v", err)
+	}
+
+	s.updates = make(chan *systemd.SubStateUpdate, unitUpdateBuffer)
+	s.errs = make(chan error, 1)
+	s.listed = false
+	s.conn.SetSubStateSubscriber(s.updates, s.errs)
+	return nil
 }
 
-// Disconnect from Systemd.
+// Unsubscribe from changes to units, and disconnect from Systemd.
 func (s *Systemd) Disconnect() {
+	s.conn.SetSubStateSubscriber(nil, nil)
+	s.conn.Unsubscribe()
 	s.conn.Close()
 }
 
-// Create a unit file on disk for a service that represents the given job. Reload Systemd.
+// Create a unit file on disk for a service that represents the given job, with a drop-in that limits it to the resources it was scheduled with. Reload Systemd.
 func (s *Systemd) CreateJob(job *cluster.Job) error {
 	path := s.getServicePath(job)
 
@@ -50,6 +79,17 @@ func (s *Systemd) CreateJob(job *cluster.Job) error {
 		return fmt.Errorf("could not write job unit file %v", err)
 	}
 
+	// drop-ins override the unit file, so the job gets what the scheduler
+	// counted against this node, whatever its unit file asks for
+	err = os.MkdirAll(s.getDropInDir(job), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create job drop-in directory %v", err)
+	}
+	err = ioutil.WriteFile(s.getLimitsPath(job), []byte(getLimitsDropIn(job)), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write job limits drop-in %v", err)
+	}
+
 	return s.conn.Reload()
 }
 
@@ -67,7 +107,7 @@ func (s *Systemd) StopJob(job *cluster.Job) error {
 	return err
 }
 
-// Destroy a Systemd services unit file, and reload Systemd.
+// Destroy a Systemd services unit file and its drop-ins, and reload Systemd.
 func (s *Systemd) DestroyJob(job *cluster.Job) error {
 	path := s.getServicePath(job)
 
@@ -77,13 +117,18 @@ func (s *Systemd) DestroyJob(job *cluster.Job) error {
 		return fmt.Errorf("could not delete job unit file %v", err)
 	}
 
+	err = os.RemoveAll(s.getDropInDir(job))
+	if err != nil {
+		return fmt.Errorf("could not delete job drop-ins %v", err)
+	}
+
 	// reload systemd
 	return s.conn.Reload()
 }
 
-// Get a list of all local Jobs that we are responsible for (belong to our kubernotes node).
+// Get a list of all local Jobs that we are responsible for (belong to our kubernotes node), along with their unit files.
 func (s *Systemd) GetManagedJobs() ([]cluster.Job, error) {
-	startsWith := fmt.Sprintf("kubernotes-%s-%s-", s.Namespace, s.NodeName)
+	startsWith := s.getServicePrefix()
 	localJobs := make([]cluster.Job, 0)
 
 	// get all units that Systemd knows about
@@ -97,16 +142,139 @@ func (s *Systemd) GetManagedJobs() ([]cluster.Job, error) {
 		if strings.HasPrefix(unit.Name, startsWith) {
 			name := strings.TrimPrefix(unit.Name, startsWith)
 			name = strings.TrimSuffix(name, ".service")
-			localJobs = append(localJobs, cluster.Job{
+			job := cluster.Job{
 				ID:        name,
 				IsRunning: unit.SubState == "running",
-			})
+			}
+
+			// units we didn't write are left as they are
+			unitFile, err := ioutil.ReadFile(s.getServicePath(&job))
+			if err == nil {
+				job.UnitFile = string(unitFile)
+			}
+			localJobs = append(localJobs, job)
 		}
 	}
 
 	return localJobs, nil
 }
 
+// Get what Systemd knows about the service for the specified job.
+func (s *Systemd) GetJobState(job *cluster.Job) (*cluster.RunState, error) {
+	serviceName := s.getServiceName(job)
+
+	unitProps, err := s.conn.GetUnitProperties(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get state of job %s: %v", job.ID, err)
+	}
+	serviceProps, err := s.conn.GetUnitTypeProperties(serviceName, "Service")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get state of job %s: %v", job.ID, err)
+	}
+
+	// NRestarts is only known to newer versions of systemd
+	state := &cluster.RunState{ID: job.ID}
+	state.ActiveState, _ = unitProps["ActiveState"].(string)
+	state.SubState, _ = unitProps["SubState"].(string)
+	if pid, ok := serviceProps["MainPID"].(uint32); ok {
+		state.MainPID = int(pid)
+	}
+	if restarts, ok := serviceProps["NRestarts"].(uint32); ok {
+		state.Restarts = int(restarts)
+	}
+	if code, ok := serviceProps["ExecMainStatus"].(int32); ok {
+		state.ExitCode = int(code)
+	}
+	state.StartedAt = timestampProperty(serviceProps["ExecMainStartTimestamp"])
+	state.ExitedAt = timestampProperty(serviceProps["ExecMainExitTimestamp"])
+	return state, nil
+}
+
+// Block until the units of our jobs change state, or the context is done. The
+// first changes seen are the state of every unit we manage, as they are again
+// after any changes have been missed.
+func (s *Systemd) WatchForChanges(ctx context.Context) ([]cluster.RunState, error) {
+	if !s.listed {
+		states, err := s.listUnits()
+		if err != nil {
+			return nil, err
+		}
+		s.listed = true
+		if len(states) > 0 {
+			return states, nil
+		}
+	}
+
+	for {
+		select {
+		case update := <-s.updates:
+			ids := make(map[string]bool)
+			s.addUpdate(ids, update)
+
+			// take whatever else has changed meanwhile along with it
+			for more := true; more; {
+				select {
+				case update = <-s.updates:
+					s.addUpdate(ids, update)
+				default:
+					more = false
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+
+			states := make([]cluster.RunState, 0, len(ids))
+			for id := range ids {
+				// units that have gone were destroyed
+				state, err := s.GetJobState(&cluster.Job{ID: id})
+				if err != nil {
+					continue
+				}
+				states = append(states, *state)
+			}
+			sort.Sort(byID(states))
+			return states, nil
+		case err := <-s.errs:
+			s.listed = false
+			return nil, fmt.Errorf("problem watching for unit changes %v", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Get the state of every unit of our jobs that systemd has loaded.
+func (s *Systemd) listUnits() ([]cluster.RunState, error) {
+	units, err := s.conn.ListUnits()
+	if err != nil {
+		return nil, fmt.Errorf("problem listing units %v", err)
+	}
+
+	states := make([]cluster.RunState, 0)
+	for _, unit := range units {
+		id, ok := s.getJobID(unit.Name)
+		if !ok {
+			continue
+		}
+		states = append(states, cluster.RunState{
+			ID:          id,
+			ActiveState: unit.ActiveState,
+			SubState:    unit.SubState,
+		})
+	}
+	sort.Sort(byID(states))
+	return states, nil
+}
+
+// Note the job whose unit changed, if it's one of ours.
+func (s *Systemd) addUpdate(ids map[string]bool, update *systemd.SubStateUpdate) {
+	id, ok := s.getJobID(update.UnitName)
+	if ok {
+		ids[id] = true
+	}
+}
+
 // Get a chunk of logs since the specified position. If the position is not specified, the last 20 lines will be returned.
 func (s *Systemd) GetLogs(job *cluster.Job, count int) (string, error) {
 	serviceName := s.getServiceName(job)
@@ -123,13 +291,66 @@ func (s *Systemd) GetLogs(job *cluster.Job, count int) (string, error) {
 	return out.String(), nil
 }
 
+func (s *Systemd) getServicePrefix() string {
+	return fmt.Sprintf("kubernotes-%s-%s-", s.Namespace, s.NodeName)
+}
+
+// Get the ID of the job a unit runs, if it's one of ours.
+func (s *Systemd) getJobID(unitName string) (string, bool) {
+	prefix := s.getServicePrefix()
+	if !strings.HasPrefix(unitName, prefix) || !strings.HasSuffix(unitName, ".service") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(unitName, prefix), ".service"), true
+}
+
 func (s *Systemd) getServiceName(job *cluster.Job) string {
-	return fmt.Sprintf("kubernotes-%s-%s-%s.service",
-		s.Namespace,
-		s.NodeName,
-		job.ID)
+	return fmt.Sprintf("%s%s.service", s.getServicePrefix(), job.ID)
 }
 
 func (s *Systemd) getServicePath(job *cluster.Job) string {
 	return fmt.Sprintf("/lib/systemd/system/%s", s.getServiceName(job))
 }
+
+func (s *Systemd) getDropInDir(job *cluster.Job) string {
+	return s.getServicePath(job) + ".d"
+}
+
+func (s *Systemd) getLimitsPath(job *cluster.Job) string {
+	return s.getDropInDir(job) + "/50-kubernotes-limits.conf"
+}
+
+// Get a drop-in that turns on accounting for the job's service, and limits it
+// to the resources the job was scheduled with. Limits the job doesn't have are
+// left to its unit file.
+func getLimitsDropIn(job *cluster.Job) string {
+	var dropIn bytes.Buffer
+	dropIn.WriteString("[Service]\n")
+	if job.CPUShares > 0 {
+		fmt.Fprintf(&dropIn, "CPUAccounting=true\nCPUShares=%d\n", job.CPUShares)
+	}
+	if job.BlockIOWeight > 0 {
+		fmt.Fprintf(&dropIn, "BlockIOAccounting=true\nBlockIOWeight=%d\n", job.BlockIOWeight)
+	}
+	if job.MemoryLimitMegabytes > 0 {
+		fmt.Fprintf(&dropIn, "MemoryAccounting=true\nMemoryLimit=%dM\n", job.MemoryLimitMegabytes)
+	}
+	return dropIn.String()
+}
+
+// Convert a timestamp property, in microseconds since the epoch, to a time.
+// Timestamps that were never set are zero.
+func timestampProperty(value interface{}) time.Time {
+	usec, ok := value.(uint64)
+	if !ok || usec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(usec/1e6), int64(usec%1e6)*1e3)
+}
+
+// Sorts RunStates by job ID.
+type byID []cluster.RunState
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i].ID < b[j].ID }
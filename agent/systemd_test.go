@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+func TestLimitsDropIn(t *testing.T) {
+	// jobs loaded without limits get the defaults, and are still limited
+	job, err := cluster.LoadJob("testjob", "[Service]\nExecStart=/bin/true\n")
+	if err != nil {
+		t.Fatal("unable to load job", err)
+	}
+
+	dropIn := getLimitsDropIn(job)
+	expected := `[Service]
+CPUAccounting=true
+CPUShares=1000
+BlockIOAccounting=true
+BlockIOWeight=1000
+MemoryAccounting=true
+MemoryLimit=100M
+`
+	if dropIn != expected {
+		t.Fatal("unexpected drop-in", dropIn)
+	}
+
+	// the drop-in wins over whatever the unit file asks for
+	job, err = cluster.LoadJob("testjob", unitFile)
+	if err != nil {
+		t.Fatal("unable to load job", err)
+	}
+	job.MemoryLimitMegabytes = 0
+
+	dropIn = getLimitsDropIn(job)
+	expected = `[Service]
+CPUAccounting=true
+CPUShares=10
+BlockIOAccounting=true
+BlockIOWeight=10
+`
+	if dropIn != expected {
+		t.Fatal("unexpected drop-in", dropIn)
+	}
+}
+
+func TestSystemdOnlyWatchesItsOwnUnits(t *testing.T) {
+	s := NewSystemd("test", "n1")
+
+	units := map[string]string{
+		"kubernotes-test-n1-web@1.service": "web@1",
+		"kubernotes-test-n1-db.service":    "db",
+		"kubernotes-test-n2-web@1.service": "",
+		"kubernotes-other-n1-db.service":   "",
+		"kubernotes-test-n1-db.socket":     "",
+		"sshd.service":                     "",
+	}
+	for name, expected := range units {
+		id, ok := s.getJobID(name)
+		if ok != (expected != "") || id != expected {
+			t.Fatal("unexpected job for unit", name, id, ok)
+		}
+	}
+}
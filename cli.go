@@ -2,19 +2,34 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/voxelbrain/goptions"
+	"golang.org/x/net/context"
 
+	"github.com/sofuture/kubernotes/cluster"
 	"github.com/sofuture/kubernotes/cmd"
+	"github.com/sofuture/kubernotes/scheduler"
 )
 
 // run agent
 type AgentOptions struct {
-	Bind            string `goptions:"-b, --bind, description='bind for agent to listen on'"`
-	NodeName        string `goptions:"-n, --name, obligatory, description='node name'"`
-	CPUShares       int    `goptions:"-c, --cpu, description='cpu shares available to scheduler'"`
-	BlockIOShares   int    `goptions:"-i, --io, description='block io shares available to scheduler'"`
-	MemoryMegabytes int    `goptions:"-m, --memory, description='memory megabytes available to scheduler'"`
+	Bind            string        `goptions:"-b, --bind, description='bind for agent to listen on'"`
+	NodeName        string        `goptions:"-n, --name, obligatory, description='node name'"`
+	CPUShares       int           `goptions:"-c, --cpu, description='cpu shares available to scheduler'"`
+	BlockIOShares   int           `goptions:"-i, --io, description='block io shares available to scheduler'"`
+	MemoryMegabytes int           `goptions:"-m, --memory, description='memory megabytes available to scheduler'"`
+	HeartbeatTTL    time.Duration `goptions:"-t, --ttl, description='how long the node is considered alive after each heartbeat'"`
+	Labels          []string      `goptions:"-l, --label, description='key=value label for jobs to constrain on, may be repeated'"`
+	Local           string        `goptions:"-L, --local, description='how to run jobs, systemd or process'"`
+	LocalDir        string        `goptions:"--local-dir, description='where jobs run as processes keep their unit files and logs'"`
+}
+
+// configure namespace
+type ConfigOptions struct {
+	Strategy string `goptions:"-s, --strategy, description='default scheduling strategy (firstfit, binpack, spread)'"`
 }
 
 // create jobs
@@ -23,9 +38,22 @@ type CreateOptions struct {
 	UnitFile *os.File `goptions:"-f, --file, obligatory, description='service unit file'"`
 }
 
+// run a single node cluster in one process, without etcd
+type DevOptions struct {
+	Bind            string   `goptions:"-b, --bind, description='bind for agent to listen on'"`
+	NodeName        string   `goptions:"-n, --name, description='node name'"`
+	CPUShares       int      `goptions:"-c, --cpu, description='cpu shares available to scheduler'"`
+	BlockIOShares   int      `goptions:"-i, --io, description='block io shares available to scheduler'"`
+	MemoryMegabytes int      `goptions:"-m, --memory, description='memory megabytes available to scheduler'"`
+	UnitFiles       []string `goptions:"-f, --file, description='service unit file to start as a job named after it, may be repeated'"`
+	Local           string   `goptions:"-L, --local, description='how to run jobs, process or systemd'"`
+	LocalDir        string   `goptions:"--local-dir, description='where jobs run as processes keep their unit files and logs, temporary if not given'"`
+}
+
 // destroy jobs
 type DestroyOptions struct {
-	Name string `goptions:"-n, --name, obligatory, description='job to destroy'"`
+	Name  string `goptions:"-n, --name, obligatory, description='job to destroy'"`
+	Force bool   `goptions:"-f, --force, description='destroy even if the assigned node is not responding'"`
 }
 
 // list jobs
@@ -33,9 +61,28 @@ type ListOptions struct {
 	Name string `goptions:"-n, --name, description='job to view status for'"`
 }
 
+// copy a namespace to another backend
+type MigrateOptions struct {
+	To string `goptions:"-t, --to, obligatory, description='backend URL to copy the namespace to, such as file:///var/lib/kubernotes.db'"`
+}
+
+// keep placing pending jobs, and moving jobs off of failed nodes
+type SchedulerOptions struct {
+	Interval time.Duration `goptions:"-i, --interval, description='how often to look for work when nothing has changed'"`
+	LeaseTTL time.Duration `goptions:"-t, --ttl, description='how long another scheduler waits to take over after the leader dies'"`
+}
+
+// change how many instances of a job run
+type ScaleOptions struct {
+	Name     string `goptions:"-n, --name, obligatory, description='job to scale'"`
+	Replicas int    `goptions:"-r, --replicas, obligatory, description='number of instances to run, each on a different node'"`
+}
+
 // start jobs
 type StartOptions struct {
-	Name string `goptions:"-n, --name, obligatory, description='job to start'"`
+	Name    string `goptions:"-n, --name, obligatory, description='job to start'"`
+	DryRun  bool   `goptions:"-d, --dry-run, description='show where the job would run, and what it would preempt, without starting it'"`
+	Explain bool   `goptions:"-x, --explain, description='show the decision made about every node, implies --dry-run'"`
 }
 
 // display cluster status
@@ -48,36 +95,59 @@ type StopOptions struct {
 
 // get output from jobs
 type TailOptions struct {
-	Name  string `goptions:"-n, --name, obligatory, description='job to watch'"`
+	Name  string `goptions:"-n, --name, obligatory, description='job, or instance of it (job@N), to watch'"`
 	Count int    `goptions:"-c, --count, description='number of lines to display'"`
 }
 
 // full cli options struct
 type Cli struct {
-	EtcdServers []string      `goptions:"-e, --etcd, description='etcd servers to connect to'"`
+	EtcdServers []string      `goptions:"-e, --etcd, description='etcd servers to connect to, when no backend is given'"`
+	Timeout     time.Duration `goptions:"-T, --timeout, description='how long to wait on each call to the backend, 0 to wait indefinitely'"`
+	Backend     string        `goptions:"--backend, description='backend URL to store the cluster in, such as etcd://localhost:2379 or file:///var/lib/kubernotes.db, dev keeps it in memory unless given one'"`
 	Namespace   string        `goptions:"-c, --namespace, description='cluster namespace'"`
 	Help        goptions.Help `goptions:"-h, --help, description='Show this help'"`
 
-	Verb    goptions.Verbs
-	Agent   AgentOptions   `goptions:"agent"`
-	Create  CreateOptions  `goptions:"create"`
-	Destroy DestroyOptions `goptions:"destroy"`
-	List    ListOptions    `goptions:"list"`
-	Start   StartOptions   `goptions:"start"`
-	Status  StatusOptions  `goptions:"status"`
-	Stop    StopOptions    `goptions:"stop"`
-	Tail    TailOptions    `goptions:"tail"`
+	Verb      goptions.Verbs
+	Agent     AgentOptions     `goptions:"agent"`
+	Config    ConfigOptions    `goptions:"config"`
+	Create    CreateOptions    `goptions:"create"`
+	Destroy   DestroyOptions   `goptions:"destroy"`
+	Dev       DevOptions       `goptions:"dev"`
+	List      ListOptions      `goptions:"list"`
+	Migrate   MigrateOptions   `goptions:"migrate"`
+	Scale     ScaleOptions     `goptions:"scale"`
+	Scheduler SchedulerOptions `goptions:"scheduler"`
+	Start     StartOptions     `goptions:"start"`
+	Status    StatusOptions    `goptions:"status"`
+	Stop      StopOptions      `goptions:"stop"`
+	Tail      TailOptions      `goptions:"tail"`
 }
 
 func runCli() (err error) {
 	options := &Cli{
 		EtcdServers: []string{"http://localhost:2379"},
 		Namespace:   "kubernotes",
+		Timeout:     cluster.DefaultTimeout,
 		Agent: AgentOptions{
 			Bind:            "127.0.0.1:10004",
 			CPUShares:       4000,
 			BlockIOShares:   4000,
 			MemoryMegabytes: 4000,
+			HeartbeatTTL:    cluster.DefaultHeartbeatTTL,
+			Local:           "systemd",
+			LocalDir:        "/var/lib/kubernotes",
+		},
+		Dev: DevOptions{
+			Bind:            "127.0.0.1:10004",
+			NodeName:        "dev",
+			CPUShares:       4000,
+			BlockIOShares:   4000,
+			MemoryMegabytes: 4000,
+			Local:           "process",
+		},
+		Scheduler: SchedulerOptions{
+			Interval: scheduler.DefaultInterval,
+			LeaseTTL: cluster.DefaultLeaseTTL,
 		},
 		Tail: TailOptions{
 			Count: 20,
@@ -86,28 +156,80 @@ func runCli() (err error) {
 
 	goptions.ParseAndFail(options)
 
+	// interrupting long running verbs, like agent and scheduler, shuts them
+	// down cleanly
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		cancel()
+	}()
+
+	// dev runs its own backend unless it's given one, everything else
+	// connects to one
+	var backend cluster.Backend
+	if options.Verb != "" && (options.Verb != "dev" || options.Backend != "") {
+		backend, err = getBackend(options)
+		if err != nil {
+			return err
+		}
+		backend = cluster.WithTimeout(backend, options.Timeout)
+	}
+
 	switch options.Verb {
 	case "agent":
-		err = cmd.Agent(options.EtcdServers, options.Namespace, options.Agent.Bind,
+		err = cmd.Agent(ctx, backend, options.Namespace, options.Agent.Bind,
 			options.Agent.NodeName, options.Agent.CPUShares, options.Agent.BlockIOShares,
-			options.Agent.MemoryMegabytes)
+			options.Agent.MemoryMegabytes, options.Agent.HeartbeatTTL,
+			options.Agent.Labels, options.Agent.Local, options.Agent.LocalDir)
 	case "status":
-		err = cmd.Status(options.EtcdServers, options.Namespace)
+		err = cmd.Status(ctx, backend, options.Namespace)
 	case "list":
-		err = cmd.List(options.EtcdServers, options.Namespace, options.List.Name)
+		err = cmd.List(ctx, backend, options.Namespace, options.List.Name)
+	case "config":
+		err = cmd.Config(ctx, backend, options.Namespace, options.Config.Strategy)
 	case "create":
-		err = cmd.Create(options.EtcdServers, options.Namespace, options.Create.Name, options.Create.UnitFile)
+		err = cmd.Create(ctx, backend, options.Namespace, options.Create.Name, options.Create.UnitFile)
 	case "destroy":
-		err = cmd.Destroy(options.EtcdServers, options.Namespace, options.Destroy.Name)
+		err = cmd.Destroy(ctx, backend, options.Namespace, options.Destroy.Name, options.Destroy.Force)
+	case "dev":
+		err = cmd.Dev(ctx, backend, options.Namespace, options.Dev.Bind, options.Dev.NodeName, options.Dev.CPUShares,
+			options.Dev.BlockIOShares, options.Dev.MemoryMegabytes, options.Dev.UnitFiles,
+			options.Dev.Local, options.Dev.LocalDir)
+	case "migrate":
+		err = cmd.Migrate(ctx, backend, options.Namespace, options.Migrate.To)
+	case "scale":
+		err = cmd.Scale(ctx, backend, options.Namespace, options.Scale.Name, options.Scale.Replicas)
+	case "scheduler":
+		err = cmd.Scheduler(ctx, backend, options.Namespace, options.Scheduler.Interval,
+			options.Scheduler.LeaseTTL)
 	case "start":
-		err = cmd.Start(options.EtcdServers, options.Namespace, options.Start.Name)
+		err = cmd.Start(ctx, backend, options.Namespace, options.Start.Name, options.Start.DryRun,
+			options.Start.Explain)
 	case "stop":
-		err = cmd.Stop(options.EtcdServers, options.Namespace, options.Stop.Name)
+		err = cmd.Stop(ctx, backend, options.Namespace, options.Stop.Name)
 	case "tail":
-		err = cmd.Tail(options.EtcdServers, options.Namespace, options.Tail.Name, options.Tail.Count)
+		err = cmd.Tail(ctx, backend, options.Namespace, options.Tail.Name, options.Tail.Count)
 	default:
 		goptions.PrintHelp()
 	}
 
 	return err
 }
+
+// Connect to the backend the cluster is stored in, etcd's v2 API at the etcd
+// servers unless a backend URL is given.
+func getBackend(options *Cli) (cluster.Backend, error) {
+	if options.Backend != "" {
+		return cluster.NewBackend(options.Backend)
+	}
+
+	etcd, err := cluster.NewEtcd(options.EtcdServers)
+	if err != nil {
+		return nil, err
+	}
+	return etcd, nil
+}
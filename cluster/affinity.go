@@ -0,0 +1,37 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// Determine if a job can run alongside the jobs already on a node, returning
+// the rule that prevents it if not. Anti-affinity works both ways, so a job
+// can't be placed next to a job that's asked to be kept away from it.
+func checkAffinity(job *Job, running []Job) error {
+	jobID, _ := ParseInstanceID(job.ID)
+
+	present := make(map[string]bool)
+	for _, other := range running {
+		otherID, _ := ParseInstanceID(other.ID)
+		present[otherID] = true
+
+		for _, avoid := range job.AntiAffinity {
+			if avoid == otherID {
+				return fmt.Errorf("job %s must not run with job %s", jobID, otherID)
+			}
+		}
+		for _, avoid := range other.AntiAffinity {
+			if avoid == jobID {
+				return fmt.Errorf("job %s must not run with job %s", otherID, jobID)
+			}
+		}
+	}
+
+	for _, with := range job.Affinity {
+		if !present[with] {
+			return fmt.Errorf("job %s must run with job %s", jobID, with)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func TestCheckAffinity(t *testing.T) {
+	running := []Job{
+		{ID: "app"},
+		{ID: "db@1", AntiAffinity: []string{"backup"}},
+	}
+
+	tests := []struct {
+		job     Job
+		allowed bool
+	}{
+		{Job{ID: "cache", Affinity: []string{"app"}}, true},
+		{Job{ID: "cache", Affinity: []string{"web"}}, false},
+		{Job{ID: "db@2", AntiAffinity: []string{"db"}}, false},
+		{Job{ID: "worker", AntiAffinity: []string{"web"}}, true},
+		{Job{ID: "backup"}, false},
+	}
+
+	for _, test := range tests {
+		err := checkAffinity(&test.job, running)
+		if (err == nil) != test.allowed {
+			t.Fatal("job", test.job.ID, "expected allowed to be", test.allowed, err)
+		}
+	}
+}
+
+func TestSchedulerHonorsAffinity(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	for _, name := range []string{"a", "b"} {
+		node := &Node{Namespace: "test", Name: name, CPUShares: 1000}
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+
+	schedule := func(job *Job) *JobStatus {
+		err := c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+		status, err := c.Schedule(ctx, tb, job)
+		if err != nil {
+			t.Fatal("got an error scheduling job", job.ID, err)
+		}
+		return status
+	}
+
+	// the sidecar has nothing to run next to yet
+	cache := &Job{ID: "cache", CPUShares: 100, Affinity: []string{"app"}}
+	status := schedule(cache)
+	if !status.IsPending() || !strings.Contains(status.Reason, "must run with job app") {
+		t.Fatal("expected cache to be pending on app", status.Reason)
+	}
+
+	app := &Job{ID: "app", CPUShares: 100}
+	status = schedule(app)
+	if status.Node != "a" {
+		t.Fatal("expected app on a, but it's on", status.Node)
+	}
+
+	// now it can follow the app
+	status, err := c.Schedule(ctx, tb, cache)
+	if err != nil {
+		t.Fatal("got an error scheduling cache", err)
+	}
+	if status.Node != "a" {
+		t.Fatal("expected cache next to app on a, but it's on", status.Node)
+	}
+
+	// and a job that avoids the app goes elsewhere
+	batch := &Job{ID: "batch", CPUShares: 100, AntiAffinity: []string{"app"}}
+	status = schedule(batch)
+	if status.Node != "b" {
+		t.Fatal("expected batch away from app on b, but it's on", status.Node)
+	}
+
+	// leaving nowhere for a job that avoids both
+	lonely := &Job{ID: "lonely", CPUShares: 100, AntiAffinity: []string{"app", "batch"}}
+	status = schedule(lonely)
+	if !status.IsPending() {
+		t.Fatal("expected lonely to be pending")
+	}
+	for _, reason := range []string{"a: job lonely must not run with job app", "b: job lonely must not run with job batch"} {
+		if !strings.Contains(status.Reason, reason) {
+			t.Fatal("expected pending reason to explain", reason, "got", status.Reason)
+		}
+	}
+}
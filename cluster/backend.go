@@ -1,27 +1,234 @@
 package cluster
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
 )
 
-// Interface to make our Cluster backend pluggable
+// Interface to make our Cluster backend pluggable. Every call is made within a
+// context, so it can be given a deadline or cancelled.
 type Backend interface {
 
 	// Watch the specified key for changes since the provided index.
-	WatchForChanges(key string, since uint64) (uint64, error)
+	WatchForChanges(ctx context.Context, key string, since uint64) (uint64, error)
 
 	// Write the specified value to the provided key. If directory is true, create a directory. Only write the key if the current revision matches the prevIndex provided (i.e. has not been externally modified).
-	WriteKey(key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error
+	WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error
+
+	// Write the specified value to the provided key, expiring it automatically once ttl has elapsed. Writing the key again before it expires refreshes the ttl. The prevExist and prevIndex conditions behave as they do for WriteKey.
+	WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error
 
 	// Read the value and last modified index of the specified key.
-	ReadKey(key string) (string, uint64, error)
+	ReadKey(ctx context.Context, key string) (string, uint64, error)
 
 	// Read the immediate child values, and last modified index of the specified key.
-	ReadKeyChildren(key string) ([]string, uint64, error)
+	ReadKeyChildren(ctx context.Context, key string) ([]string, uint64, error)
 
 	// Determine if the specified key exists.
-	CheckIfKeyExists(key string) (bool, error)
+	CheckIfKeyExists(ctx context.Context, key string) (bool, error)
 
 	// Delete the specified key. If directory is true, delete all it's children as well.
-	DeleteKey(key string, directory bool) error
+	DeleteKey(ctx context.Context, key string, directory bool) error
+
+	// Check every comparison, then make every write. If any comparison fails, nothing is written and a ConflictError is returned. Backends that can only write one key at a time, like etcd's v2 API, finish the writes of a transaction that was interrupted part way through the next time one is made.
+	Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error
+}
+
+// How long each call to a backend may take, unless otherwise specified.
+const DefaultTimeout = 10 * time.Second
+
+// Connect to the backend at the provided URL. The scheme picks the kind of
+// backend, etcd:// for etcd followed by a comma separated list of servers,
+// such as etcd://host1:2379,host2:2379. Only etcd's v2 keys API is supported,
+// so it has to be enabled on servers that disable it by default, there's no
+// backend for the v3 API.
+// Single host clusters can be kept in a file instead, such as
+// file:///var/lib/kubernotes.db.
+func NewBackend(rawURL string) (Backend, error) {
+	parts := strings.SplitN(rawURL, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("backend %s is not a URL", rawURL)
+	}
+	scheme, location := parts[0], parts[1]
+
+	switch scheme {
+	case "etcd":
+		e, err := NewEtcd(getEndpoints(location))
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	case "etcd3", "etcdv3":
+		return nil, fmt.Errorf("etcd's v3 API isn't supported, use etcd:// with the v2 API enabled")
+	case "file":
+		f, err := NewFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %s", scheme)
+	}
+}
+
+// Give each call to a backend, other than watches, a deadline of timeout from
+// when it's made, so an unreachable backend doesn't hang us. A timeout of 0
+// leaves calls to the context they're made with.
+func WithTimeout(backend Backend, timeout time.Duration) Backend {
+	if timeout <= 0 {
+		return backend
+	}
+	return &timeoutBackend{Backend: backend, timeout: timeout}
+}
+
+// Watches are left to run until they see a change or are cancelled.
+type timeoutBackend struct {
+	Backend
+	timeout time.Duration
+}
+
+func (t *timeoutBackend) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.WriteKey(ctx, key, value, directory, prevExist, prevIndex)
+}
+
+func (t *timeoutBackend) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.WriteKeyWithTTL(ctx, key, value, ttl, prevExist, prevIndex)
+}
+
+func (t *timeoutBackend) ReadKey(ctx context.Context, key string) (string, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.ReadKey(ctx, key)
+}
+
+func (t *timeoutBackend) ReadKeyChildren(ctx context.Context, key string) ([]string, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.ReadKeyChildren(ctx, key)
+}
+
+func (t *timeoutBackend) CheckIfKeyExists(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.CheckIfKeyExists(ctx, key)
+}
+
+func (t *timeoutBackend) DeleteKey(ctx context.Context, key string, directory bool) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.DeleteKey(ctx, key, directory)
+}
+
+func (t *timeoutBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Backend.Txn(ctx, compares, writes)
+}
+
+// Make every write to a backend conditional on the fence, such as an
+// election's lease, still holding, so somebody who has lost it can't keep
+// writing alongside whoever has taken over. Writes that can't be made part of
+// a transaction, those with a ttl or to directories, check the fence first
+// instead, which narrows the window rather than closing it.
+func Fenced(backend Backend, fence txn.Compare) Backend {
+	return &fencedBackend{Backend: backend, fence: fence}
+}
+
+// Reads and watches aren't fenced.
+type fencedBackend struct {
+	Backend
+	fence txn.Compare
+}
+
+func (f *fencedBackend) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	if directory {
+		err := f.check(ctx)
+		if err != nil {
+			return err
+		}
+		return f.Backend.WriteKey(ctx, key, value, directory, prevExist, prevIndex)
+	}
+
+	return f.Txn(ctx,
+		[]txn.Compare{{Key: key, PrevExist: prevExist, PrevIndex: prevIndex}},
+		[]txn.Write{{Key: key, Value: value}})
+}
+
+func (f *fencedBackend) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	err := f.check(ctx)
+	if err != nil {
+		return err
+	}
+	return f.Backend.WriteKeyWithTTL(ctx, key, value, ttl, prevExist, prevIndex)
+}
+
+func (f *fencedBackend) DeleteKey(ctx context.Context, key string, directory bool) error {
+	if directory {
+		err := f.check(ctx)
+		if err != nil {
+			return err
+		}
+		return f.Backend.DeleteKey(ctx, key, directory)
+	}
+
+	// deleting a key that doesn't exist fails, as it would without the fence
+	return f.Txn(ctx,
+		[]txn.Compare{{Key: key, PrevExist: etcd.PrevExist}},
+		[]txn.Write{{Key: key, Delete: true}})
+}
+
+func (f *fencedBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	fenced := make([]txn.Compare, 0, len(compares)+1)
+	fenced = append(fenced, f.fence)
+	fenced = append(fenced, compares...)
+	return f.Backend.Txn(ctx, fenced, writes)
+}
+
+// Make sure the fence still holds, without writing anything.
+func (f *fencedBackend) check(ctx context.Context) error {
+	return f.Backend.Txn(ctx, []txn.Compare{f.fence}, nil)
+}
+
+// Split a comma separated list of servers into URLs of their endpoints.
+func getEndpoints(servers string) []string {
+	endpoints := strings.Split(servers, ",")
+	for i, endpoint := range endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoints[i] = "http://" + endpoint
+		}
+	}
+	return endpoints
+}
+
+// Determine if a key is the provided directory, or is somewhere below it.
+func isBelow(key string, dir string) bool {
+	return dir == "/" || key == dir || strings.HasPrefix(key, dir+"/")
+}
+
+// Returned by a Backend when a conditional write fails, because the key was
+// modified since prevIndex, or did or didn't exist contrary to prevExist.
+// Callers can reload what they were writing and try again.
+type ConflictError struct {
+	Key   string
+	Cause error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("optimistic lock of key failed %s %v", e.Key, e.Cause)
+}
+
+// Determine if an error is the result of a conditional write failing.
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
 }
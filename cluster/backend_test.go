@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewBackendFromURL(t *testing.T) {
+	backend, err := NewBackend("etcd://localhost:2379")
+	if err != nil {
+		t.Fatal("unable to create etcd backend", err)
+	}
+	if _, ok := backend.(*Etcd); !ok {
+		t.Fatal("expected an etcd backend", backend)
+	}
+
+	for _, rawURL := range []string{"localhost:2379", "zookeeper://localhost:2181", "etcd3://localhost:2379"} {
+		_, err = NewBackend(rawURL)
+		if err == nil {
+			t.Fatal("expected", rawURL, "to be rejected")
+		}
+	}
+}
+
+func TestGetEndpoints(t *testing.T) {
+	endpoints := getEndpoints("a:2379,https://b:2379")
+	if !reflect.DeepEqual(endpoints, []string{"http://a:2379", "https://b:2379"}) {
+		t.Fatal("unexpected endpoints", endpoints)
+	}
+}
+
+// Records the deadline of the last read.
+type deadlineBackend struct {
+	*Memory
+	deadline time.Time
+}
+
+func (d *deadlineBackend) ReadKey(ctx context.Context, key string) (string, uint64, error) {
+	d.deadline, _ = ctx.Deadline()
+	return d.Memory.ReadKey(ctx, key)
+}
+
+func TestWithTimeout(t *testing.T) {
+	ctx := context.Background()
+	d := &deadlineBackend{Memory: NewMemory()}
+
+	// no timeout leaves the backend alone
+	if WithTimeout(d, 0) != Backend(d) {
+		t.Fatal("expected no timeout to leave the backend as it was")
+	}
+
+	_, _, _ = WithTimeout(d, time.Minute).ReadKey(ctx, "/key")
+	if d.deadline.IsZero() || d.deadline.Sub(time.Now()) > time.Minute {
+		t.Fatal("expected the read to be given a deadline", d.deadline)
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operators a Constraint can use to compare a label to its value.
+const (
+	ConstraintEqual    = "=="
+	ConstraintNotEqual = "!="
+)
+
+// Represents a rule about which Nodes a job may run on, based on their labels.
+type Constraint struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// Parse a constraint in the form key==value or key!=value.
+func ParseConstraint(raw string) (*Constraint, error) {
+	for _, op := range []string{ConstraintEqual, ConstraintNotEqual} {
+		parts := strings.SplitN(raw, op, 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("constraint %s has no label", raw)
+		}
+
+		return &Constraint{
+			Key:      key,
+			Operator: op,
+			Value:    strings.TrimSpace(parts[1]),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("constraint %s must be in the form label==value or label!=value", raw)
+}
+
+// Determine if a set of labels satisfies the constraint. A missing label
+// never equals anything.
+func (c *Constraint) Matches(labels map[string]string) bool {
+	value, ok := labels[c.Key]
+	switch c.Operator {
+	case ConstraintEqual:
+		return ok && value == c.Value
+	case ConstraintNotEqual:
+		return !ok || value != c.Value
+	default:
+		return false
+	}
+}
+
+func (c Constraint) String() string {
+	return c.Key + c.Operator + c.Value
+}
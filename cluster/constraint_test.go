@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestParseConstraint(t *testing.T) {
+	constraint, err := ParseConstraint("arch == amd64")
+	if err != nil {
+		t.Fatal("error parsing constraint", err)
+	}
+	if constraint.Key != "arch" || constraint.Operator != ConstraintEqual || constraint.Value != "amd64" {
+		t.Fatal("constraint not parsed correctly", constraint)
+	}
+
+	constraint, err = ParseConstraint("disk!=spinning")
+	if err != nil {
+		t.Fatal("error parsing constraint", err)
+	}
+	if constraint.Key != "disk" || constraint.Operator != ConstraintNotEqual || constraint.Value != "spinning" {
+		t.Fatal("constraint not parsed correctly", constraint)
+	}
+
+	for _, raw := range []string{"arch", "==amd64", "arch=amd64"} {
+		_, err = ParseConstraint(raw)
+		if err == nil {
+			t.Fatal("expected error parsing constraint", raw)
+		}
+	}
+}
+
+func TestConstraintMatches(t *testing.T) {
+	labels := map[string]string{"arch": "amd64", "disk": "ssd"}
+
+	tests := []struct {
+		constraint Constraint
+		expected   bool
+	}{
+		{Constraint{"arch", ConstraintEqual, "amd64"}, true},
+		{Constraint{"arch", ConstraintEqual, "arm"}, false},
+		{Constraint{"arch", ConstraintNotEqual, "arm"}, true},
+		{Constraint{"disk", ConstraintNotEqual, "ssd"}, false},
+		{Constraint{"gpu", ConstraintEqual, "yes"}, false},
+		{Constraint{"gpu", ConstraintNotEqual, "yes"}, true},
+	}
+
+	for _, test := range tests {
+		if test.constraint.Matches(labels) != test.expected {
+			t.Fatal("constraint", test.constraint, "expected match to be", test.expected)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// How long leadership is held after it was last refreshed, unless otherwise
+// specified.
+const DefaultLeaseTTL = 15 * time.Second
+
+// Represents one of several processes vying to be the only one performing a
+// role in a namespace, such as scheduling. Leadership is a lease that expires
+// unless the leader keeps refreshing it, so if the leader dies somebody else
+// takes over once the lease runs out.
+type Election struct {
+	Namespace string
+	Role      string
+	Candidate string
+	TTL       time.Duration
+
+	isLeader          bool
+	lastModifiedIndex uint64
+}
+
+// Create an Election for a role, on behalf of a uniquely named candidate.
+func NewElection(namespace string, role string, candidate string, ttl time.Duration) *Election {
+	if ttl == 0 {
+		ttl = DefaultLeaseTTL
+	}
+
+	return &Election{
+		Namespace: namespace,
+		Role:      role,
+		Candidate: candidate,
+		TTL:       ttl,
+	}
+}
+
+// Try to become the leader, or refresh our lease if we already are. This
+// needs to be called well within the ttl to hold on to leadership. Returns
+// whether we're the leader until the ttl elapses.
+func (e *Election) Campaign(ctx context.Context, backend Backend) (bool, error) {
+	path := getLeaderPath(e.Namespace, e.Role)
+
+	// refresh our lease, as long as nobody has taken it from us
+	if e.isLeader {
+		err := backend.WriteKeyWithTTL(ctx, path, e.Candidate, e.TTL, etcd.PrevExist, e.lastModifiedIndex)
+		if err == nil {
+			return e.confirm(ctx, backend)
+		}
+
+		log.Println("lost leadership of", e.Role, err)
+		e.isLeader = false
+	}
+
+	// take the lease, if nobody holds it
+	err := backend.WriteKeyWithTTL(ctx, path, e.Candidate, e.TTL, etcd.PrevNoExist, 0)
+	if err == nil {
+		return e.confirm(ctx, backend)
+	}
+
+	// either somebody else holds it, or we couldn't reach the backend
+	held, existsErr := backend.CheckIfKeyExists(ctx, path)
+	if existsErr != nil {
+		return false, fmt.Errorf("problem checking %s leader %v", e.Role, existsErr)
+	}
+	if !held {
+		return false, fmt.Errorf("problem campaigning for %s leader %v", e.Role, err)
+	}
+
+	return false, nil
+}
+
+// Make sure the lease we wrote is still ours, and pick up its index so we can
+// refresh it.
+func (e *Election) confirm(ctx context.Context, backend Backend) (bool, error) {
+	leader, index, err := backend.ReadKey(ctx, getLeaderPath(e.Namespace, e.Role))
+	if err != nil {
+		e.isLeader = false
+		return false, fmt.Errorf("problem confirming %s leader %v", e.Role, err)
+	}
+
+	e.isLeader = leader == e.Candidate
+	e.lastModifiedIndex = index
+	return e.isLeader, nil
+}
+
+// Give up leadership, if we have it, so somebody else can take over without
+// waiting for the lease to expire.
+func (e *Election) Resign(ctx context.Context, backend Backend) error {
+	if !e.isLeader {
+		return nil
+	}
+	e.isLeader = false
+
+	path := getLeaderPath(e.Namespace, e.Role)
+	leader, _, err := backend.ReadKey(ctx, path)
+	if err != nil || leader != e.Candidate {
+		// it's already expired, or been taken over
+		return nil
+	}
+
+	err = backend.DeleteKey(ctx, path, false)
+	if err != nil {
+		return fmt.Errorf("problem resigning %s leader %v", e.Role, err)
+	}
+	return nil
+}
+
+// Get a comparison that only holds while the lease we last campaigned for is
+// still ours, unrefreshed, for making writes conditional on our leadership.
+func (e *Election) Fence() txn.Compare {
+	return txn.Compare{
+		Key:       getLeaderPath(e.Namespace, e.Role),
+		PrevExist: etcd.PrevExist,
+		PrevIndex: e.lastModifiedIndex,
+	}
+}
+
+// Determine if we were the leader as of the last campaign.
+func (e *Election) IsLeader() bool {
+	return e.isLeader
+}
+
+// Get the name of the current leader of a role, or an empty string if nobody
+// holds it.
+func (n *Namespace) GetLeader(ctx context.Context, backend Backend, role string) (string, error) {
+	path := getLeaderPath(n.namespace, role)
+
+	held, err := backend.CheckIfKeyExists(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("problem checking %s leader %v", role, err)
+	}
+	if !held {
+		return "", nil
+	}
+
+	leader, _, err := backend.ReadKey(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("problem retrieving %s leader %v", role, err)
+	}
+	return leader, nil
+}
@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func TestElectionLeadershipChangesHands(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+	c := NewNamespace("test")
+
+	first := NewElection("test", "scheduler", "first", 0)
+	second := NewElection("test", "scheduler", "second", 0)
+
+	leader, err := c.GetLeader(ctx, tb, "scheduler")
+	if err != nil || leader != "" {
+		t.Fatal("expected nobody to lead before campaigning", leader, err)
+	}
+
+	leading, err := first.Campaign(ctx, tb)
+	if err != nil || !leading || !first.IsLeader() {
+		t.Fatal("expected first to become leader", err)
+	}
+
+	// staying leader refreshes the lease
+	leading, err = first.Campaign(ctx, tb)
+	if err != nil || !leading {
+		t.Fatal("expected first to remain leader", err)
+	}
+
+	leader, err = c.GetLeader(ctx, tb, "scheduler")
+	if err != nil || leader != "first" {
+		t.Fatal("expected first to lead", leader, err)
+	}
+
+	// once the lease expires, somebody else can take over
+	delete(tb, getLeaderPath("test", "scheduler"))
+
+	leading, err = second.Campaign(ctx, tb)
+	if err != nil || !leading {
+		t.Fatal("expected second to take over", err)
+	}
+
+	leader, err = c.GetLeader(ctx, tb, "scheduler")
+	if err != nil || leader != "second" {
+		t.Fatal("expected second to lead", leader, err)
+	}
+
+	// and resigning lets somebody else in straight away
+	err = second.Resign(ctx, tb)
+	if err != nil || second.IsLeader() {
+		t.Fatal("expected second to resign", err)
+	}
+
+	leader, err = c.GetLeader(ctx, tb, "scheduler")
+	if err != nil || leader != "" {
+		t.Fatal("expected nobody to lead after resigning", leader, err)
+	}
+}
+
+func TestElectionOnlyOneCandidateLeads(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	first := NewElection("test", "scheduler", "first", time.Minute)
+	second := NewElection("test", "scheduler", "second", 50*time.Millisecond)
+
+	leading, err := second.Campaign(ctx, m)
+	if err != nil || !leading {
+		t.Fatal("expected second to become leader", err)
+	}
+
+	// nobody can take over while the lease is held
+	leading, err = first.Campaign(ctx, m)
+	if err != nil || leading {
+		t.Fatal("expected first not to lead while second holds the lease", err)
+	}
+
+	// once second stops refreshing, its lease expires and first takes over
+	time.Sleep(100 * time.Millisecond)
+	leading, err = first.Campaign(ctx, m)
+	if err != nil || !leading {
+		t.Fatal("expected first to take over", err)
+	}
+
+	// and second finds out it's lost the lease when it next refreshes
+	leading, err = second.Campaign(ctx, m)
+	if err != nil || leading || second.IsLeader() {
+		t.Fatal("expected second to have lost leadership", err)
+	}
+}
@@ -1,12 +1,46 @@
 package cluster
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// etcd's v2 API can only change one key at a time. Transactions are made
+// while holding a lock on each namespace they touch, kept below etcdTxnLocks
+// with a ttl so etcd releases it if whoever holds it dies. Once the
+// comparisons pass, the writes are recorded in a journal before any are made,
+// so if we die part way through, whoever next locks the namespace finishes
+// them. Each write is only made if its key hasn't changed since the
+// transaction began. If somebody wrote it without taking the lock, their
+// write is kept, the rest are still made, and a ConflictError is returned.
+const (
+	etcdTxnLocks = "/kubernotes/transactions"
+	etcdTxnTTL   = 10 * time.Second
+	etcdTxnWait  = 10 * time.Millisecond
 )
 
+// A write a transaction makes, as recorded in its journal, along with the
+// index of the key when the transaction began, or 0 if it didn't exist.
+type etcdTxnStep struct {
+	Key       string
+	Value     string `json:",omitempty"`
+	Delete    bool   `json:",omitempty"`
+	Dir       bool   `json:",omitempty"`
+	PrevIndex uint64 `json:",omitempty"`
+}
+
 // Etcd backend for Kubernotes cluster
 type Etcd struct {
 	cfg    etcd.Config
@@ -26,7 +60,7 @@ func NewEtcd(servers []string) (*Etcd, error) {
 }
 
 // Block on an Etcd endpoint waiting to be notified of changes to it.
-func (e *Etcd) WatchForChanges(key string, lastSeen uint64) (uint64, error) {
+func (e *Etcd) WatchForChanges(ctx context.Context, key string, lastSeen uint64) (uint64, error) {
 
 	// watch for changes only since lastSeen, if nonzero
 	kapi := etcd.NewKeysAPI(e.client)
@@ -36,7 +70,7 @@ func (e *Etcd) WatchForChanges(key string, lastSeen uint64) (uint64, error) {
 	})
 
 	// block, waiting for change
-	resp, err := watcher.Next(context.Background())
+	resp, err := watcher.Next(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -46,34 +80,29 @@ func (e *Etcd) WatchForChanges(key string, lastSeen uint64) (uint64, error) {
 }
 
 // Store a value or directory in the backend. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
-func (e *Etcd) WriteKey(key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) (err error) {
-
-	// set the value of a key
-	kapi := etcd.NewKeysAPI(e.client)
-	_, err = kapi.Set(context.Background(), key, value, &etcd.SetOptions{
+func (e *Etcd) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	return e.set(ctx, key, value, &etcd.SetOptions{
 		Dir:       directory,
 		PrevExist: prevExist,
 		PrevIndex: prevIndex,
 	})
+}
 
-	if err != nil {
-		// C+S locking error
-		etcdErr, ok := err.(etcd.Error)
-		if ok && etcdErr.Code == etcd.ErrorCodeTestFailed {
-			return fmt.Errorf("optimistic lock of key failed %s %v", key, err)
-		}
-		return err
-	}
-
-	return err
+// Store a value in the backend that expires after ttl. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
+func (e *Etcd) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	return e.set(ctx, key, value, &etcd.SetOptions{
+		TTL:       ttl,
+		PrevExist: prevExist,
+		PrevIndex: prevIndex,
+	})
 }
 
 // Delete a key from the backend. Recursively delete children of directories if directory is true.
-func (e *Etcd) DeleteKey(key string, directory bool) (err error) {
+func (e *Etcd) DeleteKey(ctx context.Context, key string, directory bool) (err error) {
 
 	// delete the key
 	kapi := etcd.NewKeysAPI(e.client)
-	_, err = kapi.Delete(context.Background(), key, &etcd.DeleteOptions{
+	_, err = kapi.Delete(ctx, key, &etcd.DeleteOptions{
 		Dir:       directory,
 		Recursive: directory,
 	})
@@ -82,11 +111,11 @@ func (e *Etcd) DeleteKey(key string, directory bool) (err error) {
 }
 
 // Retrieve the value of a key from the backend. Also return the last modified index of the key.
-func (e *Etcd) ReadKey(key string) (string, uint64, error) {
+func (e *Etcd) ReadKey(ctx context.Context, key string) (string, uint64, error) {
 
 	// get the value
 	kapi := etcd.NewKeysAPI(e.client)
-	resp, err := kapi.Get(context.Background(), key, nil)
+	resp, err := kapi.Get(ctx, key, nil)
 	if err != nil {
 		return "", 0, err
 	}
@@ -100,12 +129,12 @@ func (e *Etcd) ReadKey(key string) (string, uint64, error) {
 }
 
 // Retrieve the values of all direct children of the specified key. Also return the last modified index of the specified key.
-func (e *Etcd) ReadKeyChildren(key string) ([]string, uint64, error) {
+func (e *Etcd) ReadKeyChildren(ctx context.Context, key string) ([]string, uint64, error) {
 
 	// get the value of the key
 	kapi := etcd.NewKeysAPI(e.client)
 	opts := &etcd.GetOptions{Recursive: true}
-	resp, err := kapi.Get(context.Background(), key, opts)
+	resp, err := kapi.Get(ctx, key, opts)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -123,11 +152,11 @@ func (e *Etcd) ReadKeyChildren(key string) ([]string, uint64, error) {
 }
 
 // Determine if a key exists in the backend.
-func (e *Etcd) CheckIfKeyExists(key string) (bool, error) {
+func (e *Etcd) CheckIfKeyExists(ctx context.Context, key string) (bool, error) {
 
 	// check if a key exists
 	kapi := etcd.NewKeysAPI(e.client)
-	_, err := kapi.Get(context.Background(), key, nil)
+	_, err := kapi.Get(ctx, key, nil)
 	if err != nil {
 
 		// specifically check for a key not found error
@@ -141,6 +170,345 @@ func (e *Etcd) CheckIfKeyExists(key string) (bool, error) {
 	return true, nil
 }
 
+// Check every comparison, then make every write. If any comparison fails, nothing is written and a ConflictError is returned. If we die part way through the writes, the rest are made by the next transaction in the namespace.
+func (e *Etcd) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	scopes := getTxnScopes(compares, writes)
+	unlock, err := e.lockTxn(ctx, scopes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// what each key was when it was compared, or nil if it didn't exist
+	seen := make(map[string]*etcd.Node, len(compares))
+	for _, compare := range compares {
+		node, err := e.compare(ctx, compare)
+		if err != nil {
+			return err
+		}
+		seen[cleanKey(compare.Key)] = node
+	}
+
+	steps, err := e.planTxn(ctx, writes, seen)
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	record, err := json.Marshal(steps)
+	if err != nil {
+		return fmt.Errorf("problem serializing transaction %v", err)
+	}
+	journal := getTxnJournalPath(scopes[0])
+	kapi := etcd.NewKeysAPI(e.client)
+	resp, err := kapi.Set(ctx, journal, string(record), &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if err != nil {
+		return fmt.Errorf("problem recording transaction %v", err)
+	}
+
+	// from here on, the writes are made whether or not we're around to
+	return e.finishTxn(ctx, journal, resp.Node.ModifiedIndex, steps)
+}
+
+// Lock every namespace a transaction touches, in order, so transactions
+// touching the same ones wait for each other rather than deadlocking. A
+// transaction left unfinished in a namespace is finished once it's locked.
+// Returns a function that unlocks them.
+func (e *Etcd) lockTxn(ctx context.Context, scopes []string) (func(), error) {
+	token, err := getTxnToken()
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make([]string, 0)
+	unlock := func() {
+		// whatever can't be unlocked is released when its ttl elapses
+		kapi := etcd.NewKeysAPI(e.client)
+		for _, key := range locked {
+			kapi.Delete(ctx, key, &etcd.DeleteOptions{PrevValue: token})
+		}
+	}
+
+	for _, scope := range scopes {
+		key := getTxnLockPath(scope)
+		for {
+			err = e.WriteKeyWithTTL(ctx, key, token, etcdTxnTTL, etcd.PrevNoExist, 0)
+			if err == nil {
+				break
+			}
+			if !IsConflict(err) {
+				unlock()
+				return nil, fmt.Errorf("problem locking %s for transaction %v", scope, err)
+			}
+
+			// somebody else is making one
+			select {
+			case <-time.After(etcdTxnWait):
+			case <-ctx.Done():
+				unlock()
+				return nil, ctx.Err()
+			}
+		}
+		locked = append(locked, key)
+
+		err = e.recoverTxn(ctx, scope)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// Check a condition a transaction is made on. Returns the key as it is, or
+// nil if it doesn't exist.
+func (e *Etcd) compare(ctx context.Context, compare txn.Compare) (*etcd.Node, error) {
+	node, err := e.get(ctx, compare.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case compare.PrevExist == etcd.PrevNoExist && node != nil:
+		return nil, &ConflictError{Key: compare.Key, Cause: fmt.Errorf("key exists")}
+	case (compare.PrevExist == etcd.PrevExist || compare.PrevIndex != 0) && node == nil:
+		return nil, &ConflictError{Key: compare.Key, Cause: fmt.Errorf("key not found")}
+	case compare.PrevIndex != 0 && node.ModifiedIndex != compare.PrevIndex:
+		return nil, &ConflictError{Key: compare.Key, Cause: fmt.Errorf("[%d != %d]", compare.PrevIndex, node.ModifiedIndex)}
+	}
+	return node, nil
+}
+
+// Work out the writes a transaction makes, and what each key is when it
+// begins. A key written more than once only needs its last write made.
+func (e *Etcd) planTxn(ctx context.Context, writes []txn.Write, seen map[string]*etcd.Node) ([]etcdTxnStep, error) {
+	steps := make([]etcdTxnStep, 0, len(writes))
+	planned := make(map[string]int)
+	for _, write := range writes {
+		key := cleanKey(write.Key)
+		if i, ok := planned[key]; ok {
+			steps[i].Value, steps[i].Delete = write.Value, write.Delete
+			continue
+		}
+
+		node, ok := seen[key]
+		if !ok {
+			var err error
+			node, err = e.get(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("problem reading %s %v", key, err)
+			}
+		}
+
+		step := etcdTxnStep{Key: key, Value: write.Value, Delete: write.Delete}
+		if node != nil {
+			step.Dir, step.PrevIndex = node.Dir, node.ModifiedIndex
+		}
+		planned[key] = len(steps)
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Make every write recorded in a transaction's journal that hasn't been
+// made yet, then remove the journal. Keys that somebody else has changed
+// since the transaction began are left alone, and a ConflictError is
+// returned once the rest are made. If any can't be made, the journal is
+// left for the next transaction to finish.
+func (e *Etcd) finishTxn(ctx context.Context, journal string, index uint64, steps []etcdTxnStep) error {
+	var conflict error
+	for _, step := range steps {
+		err := e.applyStep(ctx, step)
+		if IsConflict(err) {
+			if conflict == nil {
+				conflict = err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	kapi := etcd.NewKeysAPI(e.client)
+	_, err := kapi.Delete(ctx, journal, &etcd.DeleteOptions{PrevIndex: index})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("problem ending transaction %v", err)
+	}
+	return conflict
+}
+
+// Finish a transaction that was left unfinished in a namespace, if there is
+// one.
+func (e *Etcd) recoverTxn(ctx context.Context, scope string) error {
+	journal := getTxnJournalPath(scope)
+	node, err := e.get(ctx, journal)
+	if err != nil {
+		return fmt.Errorf("problem reading transaction journal %v", err)
+	}
+	if node == nil {
+		return nil
+	}
+
+	var steps []etcdTxnStep
+	err = json.Unmarshal([]byte(node.Value), &steps)
+	if err != nil {
+		return fmt.Errorf("problem decoding transaction journal %v", err)
+	}
+
+	log.Println("finishing interrupted transaction in", scope)
+	err = e.finishTxn(ctx, journal, node.ModifiedIndex, steps)
+	if IsConflict(err) {
+		log.Println("keys changed since the interrupted transaction began, keeping them", err)
+		return nil
+	}
+	return err
+}
+
+// Make one of the writes of a transaction, unless it's been made already.
+// Returns a ConflictError if the key has changed since the transaction began.
+func (e *Etcd) applyStep(ctx context.Context, step etcdTxnStep) error {
+	node, err := e.get(ctx, step.Key)
+	if err != nil {
+		return fmt.Errorf("problem reading %s %v", step.Key, err)
+	}
+
+	if !step.Delete {
+		if node != nil && !node.Dir && node.Value == step.Value {
+			return nil
+		}
+
+		opts := &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+		switch {
+		case node == nil && step.PrevIndex != 0:
+			return &ConflictError{Key: step.Key, Cause: fmt.Errorf("key not found")}
+		case node != nil && node.ModifiedIndex != step.PrevIndex:
+			return &ConflictError{Key: step.Key, Cause: fmt.Errorf("[%d != %d]", step.PrevIndex, node.ModifiedIndex)}
+		case node != nil:
+			opts = &etcd.SetOptions{PrevIndex: node.ModifiedIndex}
+		}
+
+		// it's been deleted since, if it's gone
+		err = e.set(ctx, step.Key, step.Value, opts)
+		if isNotFound(err) {
+			return &ConflictError{Key: step.Key, Cause: err}
+		}
+		return err
+	}
+
+	// deleting something that's already gone is fine
+	if node == nil {
+		return nil
+	}
+	if node.ModifiedIndex != step.PrevIndex {
+		return &ConflictError{Key: step.Key, Cause: fmt.Errorf("[%d != %d]", step.PrevIndex, node.ModifiedIndex)}
+	}
+
+	// etcd can't delete a directory on a condition
+	opts := &etcd.DeleteOptions{PrevIndex: node.ModifiedIndex}
+	if node.Dir {
+		opts = &etcd.DeleteOptions{Dir: true, Recursive: true}
+	}
+
+	kapi := etcd.NewKeysAPI(e.client)
+	_, err = kapi.Delete(ctx, step.Key, opts)
+	etcdErr, ok := err.(etcd.Error)
+	if ok && (etcdErr.Code == etcd.ErrorCodeTestFailed || etcdErr.Code == etcd.ErrorCodeKeyNotFound) {
+		return &ConflictError{Key: step.Key, Cause: err}
+	}
+	if err != nil {
+		return fmt.Errorf("problem applying transaction to %s %v", step.Key, err)
+	}
+	return nil
+}
+
+// Get a key as it is, or nil if it doesn't exist.
+func (e *Etcd) get(ctx context.Context, key string) (*etcd.Node, error) {
+	kapi := etcd.NewKeysAPI(e.client)
+	resp, err := kapi.Get(ctx, key, nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Node, nil
+}
+
+// Get the namespaces a transaction touches, as the paths they're kept at,
+// ordered by path. Keys outside of any namespace are locked together, as
+// "/".
+func getTxnScopes(compares []txn.Compare, writes []txn.Write) []string {
+	keys := make([]string, 0, len(compares)+len(writes))
+	for _, compare := range compares {
+		keys = append(keys, compare.Key)
+	}
+	for _, write := range writes {
+		keys = append(keys, write.Key)
+	}
+
+	prefix := getNamespacePath("")
+	seen := make(map[string]bool)
+	scopes := make([]string, 0)
+	for _, key := range keys {
+		key = cleanKey(key)
+		scope := "/"
+		if strings.HasPrefix(key, prefix) {
+			scope = getNamespacePath(strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)[0])
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func getTxnLockPath(scope string) string {
+	return path.Join(etcdTxnLocks, scope, "lock")
+}
+
+func getTxnJournalPath(scope string) string {
+	return path.Join(etcdTxnLocks, scope, "journal")
+}
+
+// Get a value to lock with that's ours alone, so we never unlock somebody
+// else's lock after ours has expired.
+func getTxnToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("problem generating transaction token %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isNotFound(err error) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound
+}
+
+func (e *Etcd) set(ctx context.Context, key string, value string, opts *etcd.SetOptions) (err error) {
+
+	// set the value of a key
+	kapi := etcd.NewKeysAPI(e.client)
+	_, err = kapi.Set(ctx, key, value, opts)
+
+	if err != nil {
+		// C+S locking error, or the key did or didn't exist when we said it
+		// shouldn't or should
+		etcdErr, ok := err.(etcd.Error)
+		if ok && (etcdErr.Code == etcd.ErrorCodeTestFailed ||
+			etcdErr.Code == etcd.ErrorCodeNodeExist ||
+			(etcdErr.Code == etcd.ErrorCodeKeyNotFound && opts.PrevExist == etcd.PrevExist)) {
+			return &ConflictError{Key: key, Cause: err}
+		}
+		return err
+	}
+
+	return err
+}
+
 func (e *Etcd) connect() (err error) {
 	e.client, err = etcd.New(e.cfg)
 	return err
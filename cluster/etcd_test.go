@@ -0,0 +1,34 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+func TestTxnLocksEachNamespaceOnce(t *testing.T) {
+	compares := []txn.Compare{
+		{Key: getJobStatusPath("prod", "web@1")},
+		{Key: getNodePath("dev", "n1")},
+	}
+	writes := []txn.Write{
+		{Key: getJobStatusPath("prod", "web@1")},
+		{Key: getNodePath("prod", "n2") + "/"},
+		{Key: getLeaderPath("dev", "scheduler")},
+	}
+
+	scopes := getTxnScopes(compares, writes)
+	if !reflect.DeepEqual(scopes, []string{getNamespacePath("dev"), getNamespacePath("prod")}) {
+		t.Fatal("expected to lock each namespace once, in order", scopes)
+	}
+	if getTxnLockPath(scopes[0]) == getTxnLockPath(scopes[1]) {
+		t.Fatal("expected namespaces to have locks of their own", getTxnLockPath(scopes[0]))
+	}
+
+	// keys outside of any namespace share a lock
+	scopes = getTxnScopes(nil, []txn.Write{{Key: "/a"}, {Key: "/b/c"}})
+	if !reflect.DeepEqual(scopes, []string{"/"}) {
+		t.Fatal("expected keys outside namespaces to be locked together", scopes)
+	}
+}
@@ -0,0 +1,316 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// How often watchers of a File backend check it for changes.
+const filePollInterval = 250 * time.Millisecond
+
+// Backend for Kubernotes clusters confined to a single host, kept in a local
+// file rather than in etcd. Every process on the host using the same file
+// sees the same cluster, with the same conditional writes and watches as
+// etcd. Access is serialized by locking a file alongside it, reads and
+// watches share the lock while writes hold it exclusively. Recent changes are
+// kept in a second file alongside it, so reads don't parse them.
+type File struct {
+	path string
+}
+
+// The keys, as kept in the file itself.
+type fileKeys struct {
+	Index uint64
+	Keys  map[string]*storeKey
+}
+
+// Recent changes, as kept alongside the keys for watchers. Expires is when
+// the next key's ttl elapses, so watchers can see to it without reading the
+// keys.
+type fileHistory struct {
+	Index   uint64
+	Events  []storeEvent
+	Cleared uint64
+	Expires time.Time `json:",omitempty"`
+}
+
+// Create a new File backend. The file is created by the first write, if it
+// doesn't exist yet.
+func NewFile(path string) (*File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("problem creating directory for %s %v", path, err)
+	}
+
+	f := &File{path: path}
+	return f, f.update(func(s *store) error { return nil })
+}
+
+// Block until the key, or anything below it, changes after the provided
+// index. If since is 0, wait for the next change. Changes made by other
+// processes are noticed within the poll interval. Gives up if the context is
+// done first.
+func (f *File) WatchForChanges(ctx context.Context, key string, since uint64) (uint64, error) {
+	key = cleanKey(key)
+
+	for watching := false; ; watching = true {
+		h, err := f.recent()
+		if err != nil {
+			return 0, err
+		}
+
+		// expire keys whose ttl has elapsed, so somebody notices even if
+		// nothing else is being written
+		if !h.Expires.IsZero() && !time.Now().Before(h.Expires) {
+			err = f.update(func(s *store) error { return nil })
+			if err != nil {
+				return 0, err
+			}
+			h, err = f.recent()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if since == 0 && !watching {
+			since = h.Index
+		}
+
+		s := &store{Index: h.Index, Events: h.Events, Cleared: h.Cleared}
+		index, changed, err := s.changedSince(key, since)
+		if err != nil || changed {
+			return index, err
+		}
+
+		select {
+		case <-time.After(filePollInterval):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Store a value or directory. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
+func (f *File) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	return f.update(func(s *store) error {
+		return s.set(cleanKey(key), value, directory, 0, prevExist, prevIndex)
+	})
+}
+
+// Store a value that expires after ttl. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
+func (f *File) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	return f.update(func(s *store) error {
+		return s.set(cleanKey(key), value, false, ttl, prevExist, prevIndex)
+	})
+}
+
+// Retrieve the value of a key. Also return the last modified index of the key.
+func (f *File) ReadKey(ctx context.Context, key string) (value string, index uint64, err error) {
+	err = f.view(func(s *store) error {
+		value, index, err = s.read(cleanKey(key))
+		return err
+	})
+	return value, index, err
+}
+
+// Retrieve the values of all direct children of the specified key, ordered by key. Also return the last modified index of the specified key.
+func (f *File) ReadKeyChildren(ctx context.Context, key string) (values []string, index uint64, err error) {
+	err = f.view(func(s *store) error {
+		values, index, err = s.readChildren(cleanKey(key))
+		return err
+	})
+	return values, index, err
+}
+
+// Determine if a key exists.
+func (f *File) CheckIfKeyExists(ctx context.Context, key string) (exists bool, err error) {
+	err = f.view(func(s *store) error {
+		exists = s.exists(cleanKey(key))
+		return nil
+	})
+	return exists, err
+}
+
+// Delete a key. Recursively delete children of directories if directory is true.
+func (f *File) DeleteKey(ctx context.Context, key string, directory bool) error {
+	return f.update(func(s *store) error {
+		return s.delete(cleanKey(key), directory)
+	})
+}
+
+// Check every comparison, then make every write, all at once. If any comparison fails, nothing is written and a ConflictError is returned.
+func (f *File) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	return f.update(func(s *store) error {
+		return s.txn(compares, writes)
+	})
+}
+
+// Load the keys while sharing the lock, and read them. If any are due to
+// expire, they're read through update instead, so the expiry is saved and
+// watchers hear about it.
+func (f *File) view(read func(s *store) error) error {
+	unlock, err := f.lock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+
+	s, err := f.keys()
+	if err != nil {
+		unlock()
+		return err
+	}
+
+	next := s.nextExpiry()
+	if !next.IsZero() && !time.Now().Before(next) {
+		unlock()
+		return f.update(read)
+	}
+
+	defer unlock()
+	return read(s)
+}
+
+// Load the store while holding the lock exclusively, expire anything that's
+// due, make a change to it, and save it if anything changed.
+func (f *File) update(change func(s *store) error) error {
+	unlock, err := f.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := f.keys()
+	if err != nil {
+		return err
+	}
+	h, err := f.history()
+	if err != nil {
+		return err
+	}
+
+	// the history is saved after the keys, so it's behind them if saving
+	// was interrupted, and the changes in between are forgotten
+	s.Events, s.Cleared = h.Events, h.Cleared
+	if h.Index != s.Index {
+		s.Events, s.Cleared = nil, s.Index
+	}
+
+	index := s.Index
+	s.expire(time.Now())
+	changeErr := change(s)
+	if s.Index != index {
+		err = f.save(s)
+		if err != nil {
+			return err
+		}
+	}
+	return changeErr
+}
+
+// Lock the file, shared or exclusively, returning a function to unlock it.
+func (f *File) lock(how int) (func(), error) {
+	lock, err := os.OpenFile(f.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening lock for %s %v", f.path, err)
+	}
+
+	err = syscall.Flock(int(lock.Fd()), how)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("problem locking %s %v", f.path, err)
+	}
+
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+// Load the keys, without the history.
+func (f *File) keys() (*store, error) {
+	s := newStore()
+
+	k := fileKeys{Keys: s.Keys}
+	err := f.read(f.path, &k)
+	if err != nil {
+		return nil, err
+	}
+	s.Index, s.Keys = k.Index, k.Keys
+	return s, nil
+}
+
+// Load the history of recent changes while sharing the lock.
+func (f *File) recent() (*fileHistory, error) {
+	unlock, err := f.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return f.history()
+}
+
+// Load the history of recent changes, without the keys.
+func (f *File) history() (*fileHistory, error) {
+	h := &fileHistory{}
+	return h, f.read(f.path+".events", h)
+}
+
+// Decode a file, leaving v as it is if the file is missing or empty.
+func (f *File) read(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("problem reading %s %v", path, err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("problem decoding %s %v", path, err)
+	}
+	return nil
+}
+
+// Save the keys, then the history.
+func (f *File) save(s *store) error {
+	err := f.write(f.path, fileKeys{Index: s.Index, Keys: s.Keys})
+	if err != nil {
+		return err
+	}
+
+	h := fileHistory{Index: s.Index, Events: s.Events, Cleared: s.Cleared, Expires: s.nextExpiry()}
+	return f.write(f.path+".events", h)
+}
+
+// Replace a file in one go, so a crash part way through a write doesn't
+// leave it half written.
+func (f *File) write(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("problem encoding %s %v", path, err)
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("problem writing %s %v", path, err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("problem writing %s %v", path, err)
+	}
+	return nil
+}
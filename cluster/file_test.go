@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Open two File backends on the same file, as two processes on a host would.
+func openFiles(t *testing.T) (*File, *File, func()) {
+	dir, err := ioutil.TempDir("", "kubernotes")
+	if err != nil {
+		t.Fatal("unable to create temporary directory", err)
+	}
+	path := filepath.Join(dir, "cluster", "kubernotes.db")
+
+	a, err := NewFile(path)
+	if err != nil {
+		t.Fatal("unable to open file backend", err)
+	}
+	b, err := NewBackend("file://" + path)
+	if err != nil {
+		t.Fatal("unable to open file backend", err)
+	}
+	return a, b.(*File), func() { os.RemoveAll(dir) }
+}
+
+func TestFileSharesConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+
+	a, b, cleanup := openFiles(t)
+	defer cleanup()
+
+	err := a.WriteKey(ctx, "/nodes/a", "one", false, etcd.PrevNoExist, 0)
+	if err != nil {
+		t.Fatal("unable to create key", err)
+	}
+
+	value, index, err := b.ReadKey(ctx, "/nodes/a")
+	if err != nil || value != "one" {
+		t.Fatal("expected the other backend to see the write", value, err)
+	}
+
+	err = b.WriteKey(ctx, "/nodes/a", "two", false, etcd.PrevExist, index)
+	if err != nil {
+		t.Fatal("unable to update key", err)
+	}
+
+	// a's index is stale now that b has written
+	err = a.WriteKey(ctx, "/nodes/a", "three", false, etcd.PrevExist, index)
+	if !IsConflict(err) {
+		t.Fatal("expected a stale index to conflict", err)
+	}
+
+	children, _, err := a.ReadKeyChildren(ctx, "/nodes")
+	if err != nil || len(children) != 1 || children[0] != "two" {
+		t.Fatal("expected to read b's write", children, err)
+	}
+}
+
+func TestFileWatchSeesOtherWriters(t *testing.T) {
+	ctx := context.Background()
+
+	a, b, cleanup := openFiles(t)
+	defer cleanup()
+
+	changes := make(chan uint64, 1)
+	go func() {
+		changed, _ := a.WatchForChanges(ctx, "/nodes", 0)
+		changes <- changed
+	}()
+
+	// give the watch a chance to start before writing
+	time.Sleep(50 * time.Millisecond)
+	_ = b.WriteKey(ctx, "/nodes/a", "a", false, etcd.PrevIgnore, 0)
+	_, index, _ := b.ReadKey(ctx, "/nodes/a")
+
+	select {
+	case changed := <-changes:
+		if changed != index {
+			t.Fatal("expected to see the change to a", changed, index)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the watch to see the other writer's change")
+	}
+}
+
+func TestFileKeysExpire(t *testing.T) {
+	ctx := context.Background()
+
+	a, b, cleanup := openFiles(t)
+	defer cleanup()
+
+	err := a.WriteKeyWithTTL(ctx, "/heartbeat", "a", 20*time.Millisecond, etcd.PrevIgnore, 0)
+	if err != nil {
+		t.Fatal("unable to write key", err)
+	}
+
+	exists, _ := b.CheckIfKeyExists(ctx, "/heartbeat")
+	if !exists {
+		t.Fatal("expected the key to exist until it expires")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	exists, _ = b.CheckIfKeyExists(ctx, "/heartbeat")
+	if exists {
+		t.Fatal("expected the key to have expired")
+	}
+}
+
+func TestFileReadsShareTheLock(t *testing.T) {
+	ctx := context.Background()
+
+	a, b, cleanup := openFiles(t)
+	defer cleanup()
+
+	err := a.WriteKey(ctx, "/nodes/a", "one", false, etcd.PrevNoExist, 0)
+	if err != nil {
+		t.Fatal("unable to create key", err)
+	}
+
+	// the keys file is read on every read, the history only by watches
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil || strings.Contains(string(data), "Events") {
+		t.Fatal("expected the history to be kept out of the keys", string(data), err)
+	}
+
+	unlock, err := a.lock(syscall.LOCK_SH)
+	if err != nil {
+		t.Fatal("unable to lock", err)
+	}
+	defer unlock()
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := b.ReadKey(ctx, "/nodes/a")
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal("unable to read key", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a read not to wait for another reader")
+	}
+}
+
+func TestFileWatchSeesExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	a, b, cleanup := openFiles(t)
+	defer cleanup()
+
+	err := a.WriteKeyWithTTL(ctx, "/heartbeat", "a", 20*time.Millisecond, etcd.PrevIgnore, 0)
+	if err != nil {
+		t.Fatal("unable to write key", err)
+	}
+
+	_, err = b.WatchForChanges(ctx, "/heartbeat", 0)
+	if err != nil {
+		t.Fatal("expected the watch to see the key expire", err)
+	}
+
+	exists, _ := a.CheckIfKeyExists(ctx, "/heartbeat")
+	if exists {
+		t.Fatal("expected the key to have expired")
+	}
+}
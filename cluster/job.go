@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -22,6 +23,25 @@ type Job struct {
 	BlockIOWeight        int
 	MemoryLimitMegabytes int
 	IsRunning            bool
+
+	// Scheduling strategy for this job, overriding the namespace's if set.
+	Strategy string
+
+	// Node labels the job must run on, and would rather run on.
+	Requires []Constraint
+	Prefers  []Constraint
+
+	// Number of instances to run, each on a different node. Unset means 1.
+	Replicas int
+
+	// IDs of jobs this job must run on the same node as, and must never run
+	// on the same node as.
+	Affinity     []string
+	AntiAffinity []string
+
+	// Jobs that can't otherwise be placed may evict jobs with a lower
+	// priority. Unset means 0.
+	Priority int
 }
 
 // Deserialize a Job from JSON string.
@@ -38,6 +58,11 @@ func (j *Job) Serialize() (string, error) {
 
 // Parse a Systemd unit file into a Job.
 func LoadJob(name string, unitFile string) (*Job, error) {
+	// instances of the job are named after it, so it can't look like one
+	if strings.Contains(name, InstanceSeparator) {
+		return nil, fmt.Errorf("job name %s may not contain %s", name, InstanceSeparator)
+	}
+
 	job := &Job{
 		ID:       name,
 		UnitFile: unitFile,
@@ -69,6 +94,44 @@ func LoadJob(name string, unitFile string) (*Job, error) {
 				continue
 			}
 		}
+
+		// scheduling options live in their own section, which systemd ignores
+		if opt.Section == "X-Kubernotes" {
+			switch opt.Name {
+			case "Strategy":
+				_, err = GetStrategy(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid X-Kubernotes Strategy %v", err)
+				}
+				job.Strategy = opt.Value
+			case "Replicas":
+				job.Replicas, err = strconv.Atoi(opt.Value)
+				if err != nil || job.Replicas < 1 {
+					return nil, fmt.Errorf("invalid X-Kubernotes Replicas %s, must be at least 1", opt.Value)
+				}
+			case "Priority":
+				job.Priority, err = strconv.Atoi(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid X-Kubernotes Priority %v", err)
+				}
+			case "Affinity":
+				job.Affinity = append(job.Affinity, opt.Value)
+			case "AntiAffinity":
+				job.AntiAffinity = append(job.AntiAffinity, opt.Value)
+			case "Require", "Prefer":
+				constraint, err := ParseConstraint(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid X-Kubernotes %s %v", opt.Name, err)
+				}
+				if opt.Name == "Require" {
+					job.Requires = append(job.Requires, *constraint)
+				} else {
+					job.Prefers = append(job.Prefers, *constraint)
+				}
+			default:
+				continue
+			}
+		}
 	}
 
 	// also for simplicity's sake, we'll give all jobs a default value for limits
@@ -99,3 +99,91 @@ func TestSerializeDeserializeJob(t *testing.T) {
 	}
 
 }
+
+func TestLoadJobStrategy(t *testing.T) {
+	job, err := LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nStrategy=spread\n")
+	if err != nil {
+		t.Fatal("error parsing unit file", err)
+	}
+
+	if job.Strategy != StrategySpread {
+		t.Fatal("strategy not parsed correctly", job.Strategy)
+	}
+
+	_, err = LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nStrategy=bogus\n")
+	if err == nil {
+		t.Fatal("expected error loading job with unknown strategy")
+	}
+}
+
+func TestLoadJobConstraints(t *testing.T) {
+	job, err := LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nRequire=arch==amd64\nRequire=disk!=spinning\nPrefer=zone==east\n")
+	if err != nil {
+		t.Fatal("error parsing unit file", err)
+	}
+
+	if len(job.Requires) != 2 || job.Requires[0].String() != "arch==amd64" || job.Requires[1].String() != "disk!=spinning" {
+		t.Fatal("required constraints not parsed correctly", job.Requires)
+	}
+
+	if len(job.Prefers) != 1 || job.Prefers[0].String() != "zone==east" {
+		t.Fatal("preferred constraints not parsed correctly", job.Prefers)
+	}
+
+	_, err = LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nRequire=arch\n")
+	if err == nil {
+		t.Fatal("expected error loading job with invalid constraint")
+	}
+}
+
+func TestLoadJobReplicas(t *testing.T) {
+	job, err := LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nReplicas=3\n")
+	if err != nil {
+		t.Fatal("error parsing unit file", err)
+	}
+
+	if job.GetReplicas() != 3 {
+		t.Fatal("replicas not parsed correctly", job.Replicas)
+	}
+
+	_, err = LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nReplicas=0\n")
+	if err == nil {
+		t.Fatal("expected error loading job with no replicas")
+	}
+
+	_, err = LoadJob("foo@bar", unitFile)
+	if err == nil {
+		t.Fatal("expected error loading job with instance separator in name")
+	}
+}
+
+func TestLoadJobAffinity(t *testing.T) {
+	job, err := LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nAffinity=app\nAntiAffinity=db\nAntiAffinity=backup\n")
+	if err != nil {
+		t.Fatal("error parsing unit file", err)
+	}
+
+	if len(job.Affinity) != 1 || job.Affinity[0] != "app" {
+		t.Fatal("affinity not parsed correctly", job.Affinity)
+	}
+
+	if len(job.AntiAffinity) != 2 || job.AntiAffinity[0] != "db" || job.AntiAffinity[1] != "backup" {
+		t.Fatal("anti-affinity not parsed correctly", job.AntiAffinity)
+	}
+}
+
+func TestLoadJobPriority(t *testing.T) {
+	job, err := LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nPriority=10\n")
+	if err != nil {
+		t.Fatal("error parsing unit file", err)
+	}
+
+	if job.Priority != 10 {
+		t.Fatal("priority not parsed correctly", job.Priority)
+	}
+
+	_, err = LoadJob("foobar", unitFile+"\n[X-Kubernotes]\nPriority=high\n")
+	if err == nil {
+		t.Fatal("expected error loading job with invalid priority")
+	}
+}
@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// States a job can be asked to be in.
+const (
+	JobStateRunning = "running"
+	JobStateStopped = "stopped"
+)
+
+// States the scheduler can observe a job to be in.
+const (
+	JobStateScheduled   = "scheduled"
+	JobStatePending     = "pending"
+	JobStateUnscheduled = "unscheduled"
+)
+
+// Represents the assigned state of a job to a node. This is the source of
+// truth for where a job runs, the JobIDs of each Node are kept consistent with
+// it.
+type JobStatus struct {
+	ID          string
+	Namespace   string
+	Node        string
+	IsScheduled bool
+
+	// What we've been asked to do with the job, running or stopped.
+	DesiredState string
+
+	// What the scheduler has actually managed to do with the job, scheduled,
+	// pending or unscheduled.
+	ObservedState string
+
+	// When the observed state or assigned node last changed, and why.
+	LastTransitionTime time.Time
+	Reason             string
+
+	LastModifiedIndex uint64 `json:"-"`
+
+	// what we last read or wrote, so unchanged statuses aren't written again
+	saved string
+}
+
+// Deserialize a JobStatus from JSON string.
+func (s *JobStatus) Deserialize(jsonBlob string) error {
+	err := json.Unmarshal([]byte(jsonBlob), s)
+	return err
+}
+
+// Serialize a JobStatus to JSON string.
+func (s *JobStatus) Serialize() (string, error) {
+	jsonBlob, err := json.Marshal(s)
+	return string(jsonBlob), err
+}
+
+// Determine if the job should be running, but isn't assigned anywhere.
+func (s *JobStatus) IsPending() bool {
+	return s.DesiredState == JobStateRunning && s.Node == ""
+}
+
+// Loads an existing JobStatus from the backend.
+func (s *JobStatus) Load(ctx context.Context, backend Backend) error {
+	var json string
+	var err error
+	json, s.LastModifiedIndex, err = backend.ReadKey(ctx, getJobStatusPath(s.Namespace, s.ID))
+	if err != nil {
+		return fmt.Errorf("could not get job status %v", err)
+	}
+	s.saved = json
+	return s.Deserialize(json)
+}
+
+// Save to the provided backend, if not modified externally since it was
+// loaded. A status that was never loaded is only saved if none exists yet.
+// Saving a status that hasn't changed does nothing, so that watchers aren't
+// woken for no reason. If it was modified, a ConflictError is returned.
+func (s *JobStatus) SaveIfNotModified(ctx context.Context, backend Backend) error {
+	json, err := s.Serialize()
+	if err != nil {
+		return fmt.Errorf("problem serializing job status %v", err)
+	}
+	if json == s.saved {
+		return nil
+	}
+
+	compare := s.compare()
+	err = backend.WriteKey(ctx, compare.Key, json, false, compare.PrevExist, compare.PrevIndex)
+	if IsConflict(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("problem saving job status %v", err)
+	}
+
+	return s.reloadIndex(ctx, backend, json)
+}
+
+// Save job statuses along with the nodes they're assigned to, in one
+// transaction, so a status never names a node that doesn't list its job, or
+// the other way round. Nothing is saved if any of them were modified since
+// they were loaded, and a ConflictError is returned. On etcd, a save that's
+// interrupted is finished by the next transaction, and one that loses a
+// race with a write made outside of one is put right by repairAssignments.
+func saveAssignments(ctx context.Context, backend Backend, statuses []*JobStatus, nodes []*Node) error {
+	compares := make([]txn.Compare, 0, len(statuses)+len(nodes))
+	writes := make([]txn.Write, 0, len(statuses)+len(nodes))
+
+	values := make([]string, len(statuses))
+	for i, status := range statuses {
+		json, err := status.Serialize()
+		if err != nil {
+			return fmt.Errorf("problem serializing job status %v", err)
+		}
+		values[i] = json
+
+		compare := status.compare()
+		compares = append(compares, compare)
+		if json != status.saved {
+			writes = append(writes, txn.Write{Key: compare.Key, Value: json})
+		}
+	}
+
+	for _, node := range nodes {
+		json, err := node.Serialize()
+		if err != nil {
+			return fmt.Errorf("problem serializing node %v", err)
+		}
+
+		compare := node.compare()
+		compares = append(compares, compare)
+		writes = append(writes, txn.Write{Key: compare.Key, Value: json})
+	}
+
+	err := backend.Txn(ctx, compares, writes)
+	if IsConflict(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("problem saving assignments %v", err)
+	}
+
+	for i, status := range statuses {
+		err = status.reloadIndex(ctx, backend, values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The condition saving the status is made on, that it hasn't been modified
+// since it was loaded, or doesn't exist yet if it never was.
+func (s *JobStatus) compare() txn.Compare {
+	prevExist := etcd.PrevExist
+	if s.LastModifiedIndex == 0 {
+		prevExist = etcd.PrevNoExist
+	}
+	return txn.Compare{
+		Key:       getJobStatusPath(s.Namespace, s.ID),
+		PrevExist: prevExist,
+		PrevIndex: s.LastModifiedIndex,
+	}
+}
+
+// Pick up the index of what we saved, so we can keep making conditional
+// writes. If somebody else has written since, keep the old index so that our
+// next write fails rather than clobbering theirs.
+func (s *JobStatus) reloadIndex(ctx context.Context, backend Backend, json string) error {
+	current, index, err := backend.ReadKey(ctx, getJobStatusPath(s.Namespace, s.ID))
+	if err != nil {
+		return fmt.Errorf("problem reloading job status %v", err)
+	}
+	if current == json {
+		s.LastModifiedIndex = index
+		s.saved = json
+	}
+	return nil
+}
+
+// Update the observed state and assigned node, noting when and why it changed.
+func (s *JobStatus) transition(state string, node string, reason string) {
+	if s.ObservedState != state || s.Node != node {
+		s.LastTransitionTime = time.Now().UTC()
+	}
+	s.ObservedState = state
+	s.Node = node
+	s.IsScheduled = node != ""
+	s.Reason = reason
+}
@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// In process backend for Kubernotes clusters, for tests and for running a
+// cluster without etcd. It behaves like etcd, every change bumps a cluster
+// wide index, writes can be made conditional on it, and watches see every
+// change made to a key or anything below it.
+type Memory struct {
+	mu    sync.Mutex
+	store *store
+
+	// closed and replaced whenever something changes, to wake watchers
+	changed chan struct{}
+}
+
+// Create a new, empty, Memory backend.
+func NewMemory() *Memory {
+	return &Memory{
+		store:   newStore(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Block until the key, or anything below it, changes after the provided
+// index. If since is 0, wait for the next change. Gives up if the context is
+// done first.
+func (m *Memory) WatchForChanges(ctx context.Context, key string, since uint64) (uint64, error) {
+	key = cleanKey(key)
+
+	m.mu.Lock()
+	if since == 0 {
+		since = m.store.Index
+	}
+
+	for {
+		index, changed, err := m.store.changedSince(key, since)
+		if err != nil || changed {
+			m.mu.Unlock()
+			return index, err
+		}
+
+		wait := m.changed
+		m.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+}
+
+// Store a value or directory. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
+func (m *Memory) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	return m.update(func(s *store) error {
+		return s.set(cleanKey(key), value, directory, 0, prevExist, prevIndex)
+	})
+}
+
+// Store a value that expires after ttl. Fail if specified prevExist condition is not met, or if the key has changed since prevIndex, if specified.
+func (m *Memory) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	err := m.update(func(s *store) error {
+		return s.set(cleanKey(key), value, false, ttl, prevExist, prevIndex)
+	})
+	if err == nil {
+		time.AfterFunc(ttl, m.expire)
+	}
+	return err
+}
+
+// Retrieve the value of a key. Also return the last modified index of the key.
+func (m *Memory) ReadKey(ctx context.Context, key string) (string, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.read(cleanKey(key))
+}
+
+// Retrieve the values of all direct children of the specified key, ordered by key. Also return the last modified index of the specified key.
+func (m *Memory) ReadKeyChildren(ctx context.Context, key string) ([]string, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.readChildren(cleanKey(key))
+}
+
+// Determine if a key exists.
+func (m *Memory) CheckIfKeyExists(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.exists(cleanKey(key)), nil
+}
+
+// Delete a key. Recursively delete children of directories if directory is true.
+func (m *Memory) DeleteKey(ctx context.Context, key string, directory bool) error {
+	return m.update(func(s *store) error {
+		return s.delete(cleanKey(key), directory)
+	})
+}
+
+// Check every comparison, then make every write, all at once. If any comparison fails, nothing is written and a ConflictError is returned.
+func (m *Memory) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	return m.update(func(s *store) error {
+		return s.txn(compares, writes)
+	})
+}
+
+// Make a change to the store, waking watchers if anything changed.
+func (m *Memory) update(change func(s *store) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := m.store.Index
+	err := change(m.store)
+	if m.store.Index != index {
+		m.notify()
+	}
+	return err
+}
+
+// Remove keys whose ttl has elapsed. Each key with a ttl has a timer that
+// calls this once it's due, which finds nothing to do if the key has been
+// refreshed since.
+func (m *Memory) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.store.expire(time.Now()) {
+		m.notify()
+	}
+}
+
+func (m *Memory) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+func TestMemoryCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	err := m.WriteKey(ctx, "/a/b", "one", false, etcd.PrevNoExist, 0)
+	if err != nil {
+		t.Fatal("unable to create key", err)
+	}
+
+	value, index, err := m.ReadKey(ctx, "/a/b")
+	if err != nil || value != "one" || index == 0 {
+		t.Fatal("expected to read back what was written", value, index, err)
+	}
+
+	// creating it again conflicts
+	err = m.WriteKey(ctx, "/a/b", "two", false, etcd.PrevNoExist, 0)
+	if !IsConflict(err) {
+		t.Fatal("expected creating an existing key to conflict", err)
+	}
+
+	// as does updating something that doesn't exist
+	err = m.WriteKey(ctx, "/a/c", "two", false, etcd.PrevExist, 0)
+	if !IsConflict(err) {
+		t.Fatal("expected updating a missing key to conflict", err)
+	}
+
+	// updating from the index we read succeeds once, then the index is stale
+	err = m.WriteKey(ctx, "/a/b", "two", false, etcd.PrevExist, index)
+	if err != nil {
+		t.Fatal("unable to update key", err)
+	}
+	err = m.WriteKey(ctx, "/a/b", "three", false, etcd.PrevExist, index)
+	if !IsConflict(err) {
+		t.Fatal("expected a stale index to conflict", err)
+	}
+
+	value, newIndex, _ := m.ReadKey(ctx, "/a/b")
+	if value != "two" || newIndex <= index {
+		t.Fatal("expected the index to move forward with the update", value, index, newIndex)
+	}
+}
+
+func TestMemoryDirectories(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	for _, key := range []string{"/nodes/b", "/nodes/ab", "/nodes/a", "/nodesextra"} {
+		err := m.WriteKey(ctx, key, path.Base(key), false, etcd.PrevIgnore, 0)
+		if err != nil {
+			t.Fatal("unable to write key", key, err)
+		}
+	}
+
+	// a can't be a directory as well as a value
+	err := m.WriteKey(ctx, "/nodes/a/x", "x", false, etcd.PrevIgnore, 0)
+	if err == nil {
+		t.Fatal("expected writing below a value to fail")
+	}
+
+	children, _, err := m.ReadKeyChildren(ctx, "/nodes/")
+	if err != nil {
+		t.Fatal("unable to read children", err)
+	}
+	if !reflect.DeepEqual(children, []string{"a", "ab", "b"}) {
+		t.Fatal("expected only the immediate children, in order", children)
+	}
+
+	_, _, err = m.ReadKeyChildren(ctx, "/missing")
+	if err == nil {
+		t.Fatal("expected reading a missing directory to fail")
+	}
+
+	// directories can only be deleted as such
+	err = m.DeleteKey(ctx, "/nodes", false)
+	if err == nil {
+		t.Fatal("expected deleting a directory as a value to fail")
+	}
+	err = m.DeleteKey(ctx, "/nodes", true)
+	if err != nil {
+		t.Fatal("unable to delete directory", err)
+	}
+
+	for key, exists := range map[string]bool{"/nodes": false, "/nodes/ab": false, "/nodesextra": true} {
+		found, _ := m.CheckIfKeyExists(ctx, key)
+		if found != exists {
+			t.Fatal("expected", key, "to exist", exists, "but it's", found)
+		}
+	}
+}
+
+func TestMemoryWatchForChanges(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	_ = m.WriteKey(ctx, "/nodes/a", "a", false, etcd.PrevIgnore, 0)
+	_, index, _ := m.ReadKey(ctx, "/nodes/a")
+
+	// changes already made are seen straight away
+	_ = m.WriteKey(ctx, "/nodes/a", "a", false, etcd.PrevIgnore, 0)
+	changed, err := m.WatchForChanges(ctx, "/nodes", index)
+	if err != nil || changed != index+1 {
+		t.Fatal("expected to see the change after", index, changed, err)
+	}
+
+	// otherwise, watches block until something below the key changes
+	changes := make(chan uint64, 1)
+	go func() {
+		changed, _ := m.WatchForChanges(ctx, "/nodes", changed)
+		changes <- changed
+	}()
+
+	_ = m.WriteKey(ctx, "/nodesextra", "extra", false, etcd.PrevIgnore, 0)
+	select {
+	case changed := <-changes:
+		t.Fatal("didn't expect a change to a sibling to be seen", changed)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = m.WriteKey(ctx, "/nodes/b", "b", false, etcd.PrevIgnore, 0)
+	select {
+	case changed := <-changes:
+		_, index, _ := m.ReadKey(ctx, "/nodes/b")
+		if changed != index {
+			t.Fatal("expected to see the change to b", changed, index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the watch to see the change to b")
+	}
+}
+
+func TestMemoryWatchHistoryIsLimited(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	// the first two changes are forgotten
+	for i := 0; i < storeHistory+2; i++ {
+		_ = m.WriteKey(ctx, "/key", "value", false, etcd.PrevIgnore, 0)
+	}
+
+	_, err := m.WatchForChanges(ctx, "/key", 1)
+	if err == nil {
+		t.Fatal("expected watching from a forgotten index to fail")
+	}
+}
+
+func TestMemoryKeysExpire(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	err := m.WriteKeyWithTTL(ctx, "/heartbeat", "a", 20*time.Millisecond, etcd.PrevIgnore, 0)
+	if err != nil {
+		t.Fatal("unable to write key", err)
+	}
+	_, index, _ := m.ReadKey(ctx, "/heartbeat")
+
+	// refreshing the key keeps it alive past the original ttl
+	time.Sleep(10 * time.Millisecond)
+	_ = m.WriteKeyWithTTL(ctx, "/heartbeat", "a", 40*time.Millisecond, etcd.PrevIgnore, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	exists, _ := m.CheckIfKeyExists(ctx, "/heartbeat")
+	if !exists {
+		t.Fatal("expected the refreshed key to still exist")
+	}
+
+	// expiring is a change like any other
+	changed, err := m.WatchForChanges(ctx, "/heartbeat", index+1)
+	if err != nil {
+		t.Fatal("unable to watch key", err)
+	}
+	exists, _ = m.CheckIfKeyExists(ctx, "/heartbeat")
+	if exists || changed <= index+1 {
+		t.Fatal("expected the key to have expired", changed)
+	}
+}
+
+func TestMemoryWatchIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMemory()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.WatchForChanges(ctx, "/nodes", 0)
+		errs <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatal("expected the watch to be cancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected cancelling to end the watch")
+	}
+}
+
+func TestMemoryTxn(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	_ = m.WriteKey(ctx, "/a", "a", false, etcd.PrevIgnore, 0)
+	_ = m.WriteKey(ctx, "/b", "b", false, etcd.PrevIgnore, 0)
+	_, index, _ := m.ReadKey(ctx, "/a")
+
+	unchanged := func() {
+		for key, value := range map[string]string{"/a": "a", "/b": "b"} {
+			current, _, _ := m.ReadKey(ctx, key)
+			if current != value {
+				t.Fatal("expected", key, "to be left alone, but it's", current)
+			}
+		}
+	}
+
+	// a failed comparison writes nothing
+	err := m.Txn(ctx, []txn.Compare{{Key: "/a", PrevIndex: index}, {Key: "/c", PrevExist: etcd.PrevExist}},
+		[]txn.Write{{Key: "/a", Value: "a2"}, {Key: "/b", Delete: true}})
+	if !IsConflict(err) {
+		t.Fatal("expected a missing key to conflict", err)
+	}
+	unchanged()
+
+	// as does a write that fails part way through
+	err = m.Txn(ctx, []txn.Compare{{Key: "/a", PrevIndex: index}},
+		[]txn.Write{{Key: "/b", Delete: true}, {Key: "/a/below", Value: "x"}})
+	if err == nil || IsConflict(err) {
+		t.Fatal("expected writing below a value to fail", err)
+	}
+	unchanged()
+
+	// otherwise every write is made
+	err = m.Txn(ctx, []txn.Compare{{Key: "/a", PrevIndex: index}, {Key: "/c", PrevExist: etcd.PrevNoExist}},
+		[]txn.Write{{Key: "/a", Value: "a2"}, {Key: "/b", Delete: true}, {Key: "/c", Value: "c"}, {Key: "/d", Delete: true}})
+	if err != nil {
+		t.Fatal("unable to make transaction", err)
+	}
+	value, _, _ := m.ReadKey(ctx, "/a")
+	exists, _ := m.CheckIfKeyExists(ctx, "/b")
+	created, _ := m.CheckIfKeyExists(ctx, "/c")
+	if value != "a2" || exists || !created {
+		t.Fatal("expected every write to be made", value, exists, created)
+	}
+}
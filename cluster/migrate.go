@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Copy the namespace's configuration, jobs, nodes and job statuses from one
+// backend to another, such as from etcd to a file for a single host. Anything
+// already in the destination is left alone, and stops the migration.
+// Heartbeats and leadership leases aren't copied, agents and schedulers
+// renew them once they're pointed at the destination.
+func (n *Namespace) Migrate(ctx context.Context, from Backend, to Backend) error {
+	configured, err := from.CheckIfKeyExists(ctx, getNamespaceConfigPath(n.namespace))
+	if err != nil {
+		return fmt.Errorf("problem accessing namespace config %v", err)
+	}
+	if configured {
+		config, err := n.GetConfig(ctx, from)
+		if err != nil {
+			return err
+		}
+		err = n.SetConfig(ctx, to, config)
+		if err != nil {
+			return err
+		}
+		log.Println("migrated namespace config")
+	}
+
+	jobs, err := n.GetJobs(ctx, from)
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		err = n.CreateJob(ctx, to, &jobs[i])
+		if err != nil {
+			return fmt.Errorf("problem migrating job %s %v", jobs[i].ID, err)
+		}
+		log.Println("migrated job", jobs[i].ID)
+	}
+
+	nodes, err := n.GetNodes(ctx, from)
+	if err != nil {
+		return err
+	}
+	for i := range nodes {
+		// indexes don't carry over between backends
+		nodes[i].LastModifiedIndex = 0
+		err = nodes[i].SaveIfNotModified(ctx, to, etcd.PrevNoExist)
+		if err != nil {
+			return fmt.Errorf("problem migrating node %s %v", nodes[i].Name, err)
+		}
+		log.Println("migrated node", nodes[i].Name)
+	}
+
+	statuses, err := n.GetJobStatuses(ctx, from)
+	if err != nil {
+		return err
+	}
+	for i := range statuses {
+		statuses[i].LastModifiedIndex = 0
+		err = statuses[i].SaveIfNotModified(ctx, to)
+		if err != nil {
+			return fmt.Errorf("problem migrating job status %s %v", statuses[i].ID, err)
+		}
+		log.Println("migrated job status", statuses[i].ID)
+	}
+
+	return nil
+}
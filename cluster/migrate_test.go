@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMigrateCopiesNamespace(t *testing.T) {
+	ctx := context.Background()
+
+	from := NewMemory()
+	to := NewMemory()
+	c := NewNamespace("test")
+
+	err := c.SetConfig(ctx, from, &NamespaceConfig{Strategy: StrategySpread})
+	if err != nil {
+		t.Fatal("unable to configure namespace", err)
+	}
+
+	node := &Node{Namespace: "test", Name: "a", CPUShares: 1000, Labels: map[string]string{"os": "linux"}}
+	err = node.JoinCluster(ctx, from)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	job := &Job{ID: "job", CPUShares: 100, Replicas: 2}
+	err = c.CreateJob(ctx, from, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+	_, err = c.ScheduleReplicas(ctx, from, job)
+	if err != nil {
+		t.Fatal("unable to schedule job", err)
+	}
+
+	err = c.Migrate(ctx, from, to)
+	if err != nil {
+		t.Fatal("unable to migrate namespace", err)
+	}
+
+	config, _ := c.GetConfig(ctx, to)
+	if config.Strategy != StrategySpread {
+		t.Fatal("expected the namespace config to be migrated", config)
+	}
+
+	migrated, err := c.GetNode(ctx, to, "a")
+	if err != nil {
+		t.Fatal("expected the node to be migrated", err)
+	}
+	original, _ := c.GetNode(ctx, from, "a")
+	if !reflect.DeepEqual(migrated.JobIDs, original.JobIDs) || migrated.Labels["os"] != "linux" {
+		t.Fatal("expected the node to be migrated as is", migrated)
+	}
+
+	statuses, err := c.GetInstanceStatuses(ctx, to, job)
+	if err != nil || len(statuses) != 2 {
+		t.Fatal("expected both instance statuses to be migrated", statuses, err)
+	}
+	if statuses[0].Node != "a" || !statuses[1].IsPending() {
+		t.Fatal("expected instance statuses to be migrated as is", statuses)
+	}
+
+	// heartbeats aren't migrated, the node is down until its agent is moved
+	live, _ := c.GetLiveNodeNames(ctx, to)
+	if live["a"] {
+		t.Fatal("didn't expect the node's heartbeat to be migrated")
+	}
+
+	// nothing already in the destination is overwritten
+	err = c.Migrate(ctx, from, to)
+	if err == nil {
+		t.Fatal("expected migrating over existing jobs to fail")
+	}
+}
@@ -1,9 +1,14 @@
 package cluster
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 
 	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
 )
 
 // Represents a Kubernotes namespace.
@@ -12,6 +17,12 @@ type Namespace struct {
 	lastSeenIndex uint64
 }
 
+// Settings that apply to every job in a namespace.
+type NamespaceConfig struct {
+	// Scheduling strategy for jobs that don't specify their own.
+	Strategy string
+}
+
 // Create a Namespace representing a Kubernotes scheduling namespace.
 func NewNamespace(namespace string) *Namespace {
 	return &Namespace{
@@ -24,21 +35,66 @@ func (n *Namespace) GetName() string {
 	return n.namespace
 }
 
-// Get the Node for the specified name if it already exists.
-func (n *Namespace) GetNode(backend Backend, nodeName string) (*Node, error) {
+// Get the settings for this namespace, or the defaults if none have been set.
+func (n *Namespace) GetConfig(ctx context.Context, backend Backend) (*NamespaceConfig, error) {
+
+	config := &NamespaceConfig{
+		Strategy: DefaultStrategy,
+	}
+
+	exists, err := backend.CheckIfKeyExists(ctx, getNamespaceConfigPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing namespace config %v", err)
+	}
+	if !exists {
+		return config, nil
+	}
+
+	jsonBlob, _, err := backend.ReadKey(ctx, getNamespaceConfigPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving namespace config %v", err)
+	}
+
+	err = json.Unmarshal([]byte(jsonBlob), config)
+	return config, err
+}
+
+// Store the settings for this namespace, overwriting any existing settings.
+func (n *Namespace) SetConfig(ctx context.Context, backend Backend, config *NamespaceConfig) error {
 
 	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	err := n.checkOrCreateNamespace(ctx, backend)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	_, err = GetStrategy(config.Strategy)
+	if err != nil {
+		return err
+	}
+
+	jsonBlob, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	err = backend.WriteKey(ctx, getNamespaceConfigPath(n.namespace), string(jsonBlob), false, etcd.PrevIgnore, 0)
+	if err != nil {
+		return fmt.Errorf("problem storing namespace config %v", err)
+	}
+
+	return nil
+}
+
+// Get the Node for the specified name if it already exists.
+func (n *Namespace) GetNode(ctx context.Context, backend Backend, nodeName string) (*Node, error) {
+
 	node := &Node{
 		Name:      nodeName,
 		Namespace: n.namespace,
 	}
 
-	err = node.Load(backend)
+	err := node.Load(ctx, backend)
 	if err != nil {
 		return nil, err
 	}
@@ -47,28 +103,31 @@ func (n *Namespace) GetNode(backend Backend, nodeName string) (*Node, error) {
 }
 
 // Join the provided name to this namespace if it does not already exist.
-func (n *Namespace) CreateNode(backend Backend, node *Node) error {
+func (n *Namespace) CreateNode(ctx context.Context, backend Backend, node *Node) error {
 
 	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	err := n.checkOrCreateNamespace(ctx, backend)
 	if err != nil {
 		return err
 	}
 
-	return node.JoinCluster(backend)
+	return node.JoinCluster(ctx, backend)
 }
 
 // Get all Nodes in the specified namespace.
-func (n *Namespace) GetNodes(backend Backend) ([]Node, error) {
+func (n *Namespace) GetNodes(ctx context.Context, backend Backend) ([]Node, error) {
 
-	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	// the nodes directory won't exist until the first node joins
+	nodesExist, err := backend.CheckIfKeyExists(ctx, getNodesPath(n.namespace))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("problem accessing nodes %v", err)
+	}
+	if !nodesExist {
+		return []Node{}, nil
 	}
 
 	// load all children of the namespaces node path
-	nodes, _, err := backend.ReadKeyChildren(getNodesPath(n.namespace))
+	nodes, _, err := backend.ReadKeyChildren(ctx, getNodesPath(n.namespace))
 	if err != nil {
 		return nil, err
 	}
@@ -84,14 +143,66 @@ func (n *Namespace) GetNodes(backend Backend) ([]Node, error) {
 		ret[i] = *n
 	}
 
+	// keep the order stable, regardless of backend
+	sort.Sort(byName(ret))
+
+	return ret, nil
+}
+
+// Get the names of all Nodes in the namespace that have heartbeated within
+// their ttl.
+func (n *Namespace) GetLiveNodeNames(ctx context.Context, backend Backend) (map[string]bool, error) {
+
+	live := make(map[string]bool)
+
+	// the heartbeats directory won't exist until the first node joins
+	heartbeatsExist, err := backend.CheckIfKeyExists(ctx, getHeartbeatsPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing heartbeats %v", err)
+	}
+	if !heartbeatsExist {
+		return live, nil
+	}
+
+	// each heartbeat's value is the name of the node sending it
+	names, _, err := backend.ReadKeyChildren(ctx, getHeartbeatsPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving heartbeats %v", err)
+	}
+	for _, name := range names {
+		live[name] = true
+	}
+
+	return live, nil
+}
+
+// Get all Nodes in the namespace that are alive, and able to be scheduled jobs.
+func (n *Namespace) GetLiveNodes(ctx context.Context, backend Backend) ([]Node, error) {
+	nodes, err := n.GetNodes(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := n.GetLiveNodeNames(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		if live[node.Name] {
+			ret = append(ret, node)
+		}
+	}
+
 	return ret, nil
 }
 
 // Store a job definition in the namespace, overwriting it if it exists.
-func (n *Namespace) CreateJob(backend Backend, job *Job) error {
+func (n *Namespace) CreateJob(ctx context.Context, backend Backend, job *Job) error {
 
 	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	err := n.checkOrCreateNamespace(ctx, backend)
 	if err != nil {
 		return err
 	}
@@ -103,7 +214,7 @@ func (n *Namespace) CreateJob(backend Backend, job *Job) error {
 	}
 
 	// create job, overwriting existing
-	err = backend.WriteKey(getJobPath(n.namespace, job.ID), string(json), false, etcd.PrevNoExist, 0)
+	err = backend.WriteKey(ctx, getJobPath(n.namespace, job.ID), string(json), false, etcd.PrevNoExist, 0)
 	if err != nil {
 		return fmt.Errorf("problem creating job %v", err)
 	}
@@ -111,17 +222,33 @@ func (n *Namespace) CreateJob(backend Backend, job *Job) error {
 	return nil
 }
 
-// Retrieve a job definition from the namespace.
-func (n *Namespace) GetJob(backend Backend, jobID string) (*Job, error) {
+// Store changes to an existing job definition.
+func (n *Namespace) UpdateJob(ctx context.Context, backend Backend, job *Job) error {
 
 	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	err := n.checkOrCreateNamespace(ctx, backend)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	json, err := job.Serialize()
+	if err != nil {
+		return err
 	}
 
+	err = backend.WriteKey(ctx, getJobPath(n.namespace, job.ID), json, false, etcd.PrevExist, 0)
+	if err != nil {
+		return fmt.Errorf("problem updating job %v", err)
+	}
+
+	return nil
+}
+
+// Retrieve a job definition from the namespace.
+func (n *Namespace) GetJob(ctx context.Context, backend Backend, jobID string) (*Job, error) {
+
 	// get the stored JSON
-	json, _, err := backend.ReadKey(getJobPath(n.namespace, jobID))
+	json, _, err := backend.ReadKey(ctx, getJobPath(n.namespace, jobID))
 	if err != nil {
 		return nil, fmt.Errorf("problem retrieving job %v", err)
 	}
@@ -132,42 +259,211 @@ func (n *Namespace) GetJob(backend Backend, jobID string) (*Job, error) {
 	return job, err
 }
 
-// Find Node that's running a job.
-func (n *Namespace) GetNodeRunningJob(backend Backend, jobID string) (*Node, error) {
+// Remove a job definition from the namespace, along with the statuses of its
+// instances, all in one transaction. Every instance of the job must already
+// be stopped and unscheduled, otherwise the scheduler could assign one to a
+// node that would be left referencing a job that no longer exists. If any of
+// them change while it's being destroyed, nothing is removed.
+func (n *Namespace) DestroyJob(ctx context.Context, backend Backend, jobID string) error {
 
-	// ensure the namespace exists
-	err := n.checkOrCreateNamespace(backend)
+	job, err := n.GetJob(ctx, backend, jobID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nodes, err := n.GetNodes(backend)
+	// make sure nobody is still assigned the job, or wants it to run
+	instances, err := n.GetInstanceStatuses(ctx, backend, job)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	statuses := make([]*JobStatus, len(instances))
+	for i := range instances {
+		// reload each, so we have an index to make removing it conditional on
+		status, err := n.GetJobStatus(ctx, backend, instances[i].ID)
+		if err != nil {
+			return err
+		}
+		statuses[i] = status
+
+		if status.Node != "" {
+			return fmt.Errorf("job %s is still scheduled on node %s", status.ID, status.Node)
+		}
+		if status.DesiredState == JobStateRunning {
+			return fmt.Errorf("job %s is still waiting to be scheduled", status.ID)
+		}
+	}
+
+	compares := []txn.Compare{{Key: getJobPath(n.namespace, jobID), PrevExist: etcd.PrevExist}}
+	writes := []txn.Write{{Key: getJobPath(n.namespace, jobID), Delete: true}}
+	for _, status := range statuses {
+		compare := status.compare()
+		compares = append(compares, compare)
+		writes = append(writes, txn.Write{Key: compare.Key, Delete: true})
+	}
+
+	err = backend.Txn(ctx, compares, writes)
+	if IsConflict(err) {
+		return fmt.Errorf("job %s was modified while destroying it %v", jobID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("problem destroying job %v", err)
+	}
+	return nil
+}
+
+// Retrieve all job definitions stored in the namespace.
+func (n *Namespace) GetJobs(ctx context.Context, backend Backend) ([]Job, error) {
+
+	// the jobs directory won't exist until the first job is created
+	jobsExist, err := backend.CheckIfKeyExists(ctx, getJobsPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing jobs %v", err)
+	}
+	if !jobsExist {
+		return []Job{}, nil
+	}
+
+	// load all children of the namespaces job path
+	jobs, _, err := backend.ReadKeyChildren(ctx, getJobsPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving jobs %v", err)
+	}
+
+	// load each of the children as a job
+	ret := make([]Job, len(jobs))
+	for i, json := range jobs {
+		job := &Job{}
+		err := job.Deserialize(json)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = *job
+	}
+
+	return ret, nil
+}
+
+// Retrieve the assignment status of a job, or one of its instances. Jobs that
+// predate status records have theirs built from the Node they're assigned to.
+// Nothing is saved, statuses are only written when jobs are scheduled,
+// unscheduled or rescheduled.
+func (n *Namespace) GetJobStatus(ctx context.Context, backend Backend, jobID string) (*JobStatus, error) {
+	status, _, err := n.findJobStatus(ctx, backend, jobID)
+	return status, err
+}
+
+// Retrieve the assignment status of a job, building it from the Node it's
+// assigned to if there's no status record, without saving anything. Also
+// returns whether the status came from a record.
+func (n *Namespace) findJobStatus(ctx context.Context, backend Backend, jobID string) (*JobStatus, bool, error) {
+
+	status := &JobStatus{
+		ID:        jobID,
+		Namespace: n.namespace,
 	}
 
+	exists, err := backend.CheckIfKeyExists(ctx, getJobStatusPath(n.namespace, jobID))
+	if err != nil {
+		return nil, false, fmt.Errorf("problem accessing job status %v", err)
+	}
+	if exists {
+		err = status.Load(ctx, backend)
+		if err != nil {
+			return nil, false, err
+		}
+		return status, true, nil
+	}
+
+	// no status yet, so look for a node that was assigned the job before we
+	// kept track of it. this is the only place we need to scan every node.
+	nodes, err := n.GetNodes(ctx, backend)
+	if err != nil {
+		return nil, false, err
+	}
+
+	status.DesiredState = JobStateStopped
+	status.transition(JobStateUnscheduled, "", "")
 	for _, node := range nodes {
 		for _, nodeJobID := range node.JobIDs {
 			if jobID == nodeJobID {
-				return &node, nil
+				status.DesiredState = JobStateRunning
+				status.transition(JobStateScheduled, node.Name, "")
 			}
 		}
 	}
 
-	return nil, nil
+	return status, false, nil
 }
 
-func (n *Namespace) checkOrCreateNamespace(backend Backend) error {
+// Retrieve the status of every job that has one.
+func (n *Namespace) GetJobStatuses(ctx context.Context, backend Backend) ([]JobStatus, error) {
+
+	// the status directory won't exist until the first job is scheduled
+	statusesExist, err := backend.CheckIfKeyExists(ctx, getJobStatusesPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing job statuses %v", err)
+	}
+	if !statusesExist {
+		return []JobStatus{}, nil
+	}
+
+	statuses, _, err := backend.ReadKeyChildren(ctx, getJobStatusesPath(n.namespace))
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving job statuses %v", err)
+	}
+
+	ret := make([]JobStatus, len(statuses))
+	for i, json := range statuses {
+		status := &JobStatus{}
+		err := status.Deserialize(json)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = *status
+	}
+
+	return ret, nil
+}
+
+// Find Node that's running a job.
+func (n *Namespace) GetNodeRunningJob(ctx context.Context, backend Backend, jobID string) (*Node, error) {
+
+	status, err := n.GetJobStatus(ctx, backend, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Node == "" {
+		return nil, nil
+	}
+
+	return n.GetNode(ctx, backend, status.Node)
+}
+
+// Block until a job status in the namespace changes, returning the index of
+// the change. Statuses change when jobs are started, stopped, placed, or left
+// pending.
+func (n *Namespace) WatchJobStatuses(ctx context.Context, backend Backend, since uint64) (uint64, error) {
+	return backend.WatchForChanges(ctx, getJobStatusesPath(n.namespace), since)
+}
+
+// Block until a Node in the namespace joins, leaves, or has its jobs changed,
+// returning the index of the change.
+func (n *Namespace) WatchNodes(ctx context.Context, backend Backend, since uint64) (uint64, error) {
+	return backend.WatchForChanges(ctx, getNodesPath(n.namespace), since)
+}
+
+func (n *Namespace) checkOrCreateNamespace(ctx context.Context, backend Backend) error {
 
 	// see if namespace exists
-	namespaceExists, err := backend.CheckIfKeyExists(getNamespacePath(n.namespace))
+	namespaceExists, err := backend.CheckIfKeyExists(ctx, getNamespacePath(n.namespace))
 	if err != nil {
 		return fmt.Errorf("problem accessing namespace %v", err)
 	}
 
 	// create it, if it doesn't
 	if !namespaceExists {
-		err = backend.WriteKey(getNamespacePath(n.namespace), "", true, etcd.PrevNoExist, 0)
+		err = backend.WriteKey(ctx, getNamespacePath(n.namespace), "", true, etcd.PrevNoExist, 0)
 		if err != nil {
 			return fmt.Errorf("problem creating namespace %v", err)
 		}
@@ -175,3 +471,10 @@ func (n *Namespace) checkOrCreateNamespace(backend Backend) error {
 
 	return nil
 }
+
+// Sorts Nodes by name.
+type byName []Node
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
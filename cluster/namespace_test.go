@@ -3,21 +3,25 @@ package cluster
 import (
 	"testing"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/testtools"
 )
 
 func TestNamespaceCreatesNamespaceAndNewNode(t *testing.T) {
+	ctx := context.Background()
+
 	// create a namespace and node
 	c := NewNamespace("test")
 	tb := testtools.TestBackend{}
 
-	err := c.CreateNode(tb, &Node{Name: "testnode", Namespace: "test"})
+	err := c.CreateNode(ctx, tb, &Node{Name: "testnode", Namespace: "test"})
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
 
 	// make sure we can get the node
-	_, err = c.GetNode(tb, "testnode")
+	_, err = c.GetNode(ctx, tb, "testnode")
 	if err != nil {
 		t.Fatal("error getting node", err)
 	}
@@ -32,39 +36,43 @@ func TestNamespaceCreatesNamespaceAndNewNode(t *testing.T) {
 }
 
 func TestNamespaceCreatesNamespaceAndMultipleNodes(t *testing.T) {
+	ctx := context.Background()
+
 	// create a namespace and multiple nodes
 	c := NewNamespace("test")
 	tb := testtools.TestBackend{}
 
-	err := c.CreateNode(tb, &Node{Name: "testnode", Namespace: "test"})
+	err := c.CreateNode(ctx, tb, &Node{Name: "testnode", Namespace: "test"})
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
 
-	err = c.CreateNode(tb, &Node{Name: "testnode1", Namespace: "test"})
+	err = c.CreateNode(ctx, tb, &Node{Name: "testnode1", Namespace: "test"})
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
 
-	err = c.CreateNode(tb, &Node{Name: "testnode2", Namespace: "test"})
+	err = c.CreateNode(ctx, tb, &Node{Name: "testnode2", Namespace: "test"})
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
 
 	// make sure we get all the nodes back
-	nodes, err := c.GetNodes(tb)
+	nodes, err := c.GetNodes(ctx, tb)
 	if err != nil || len(nodes) != 3 {
 		t.Fatal("error getting nodes", err)
 	}
 }
 
 func TestNamespaceCanFindRunningJob(t *testing.T) {
+	ctx := context.Background()
+
 	// create a node and namespace
 	c := NewNamespace("test")
 	tb := testtools.TestBackend{}
 
 	// assign a job to the node
-	err := c.CreateNode(tb, &Node{Name: "testnode", Namespace: "test", JobIDs: []string{"foo"}})
+	err := c.CreateNode(ctx, tb, &Node{Name: "testnode", Namespace: "test", JobIDs: []string{"foo"}})
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
@@ -78,19 +86,19 @@ func TestNamespaceCanFindRunningJob(t *testing.T) {
 		MemoryLimitMegabytes: 10,
 	}
 
-	err = c.CreateJob(tb, job)
+	err = c.CreateJob(ctx, tb, job)
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
 
 	// get the job from the node
-	node, err := c.GetNodeRunningJob(tb, "foo")
+	node, err := c.GetNodeRunningJob(ctx, tb, "foo")
 	if err != nil || node == nil {
 		t.Fatal("couldn't find node running job", err)
 	}
 
 	// try to get a job that doesnt exist
-	node, err = c.GetNodeRunningJob(tb, "notreal")
+	node, err = c.GetNodeRunningJob(ctx, tb, "notreal")
 	if err != nil {
 		t.Fatal("should not have gotten an error looking for job", err)
 	}
@@ -100,6 +108,8 @@ func TestNamespaceCanFindRunningJob(t *testing.T) {
 }
 
 func TestNamespaceCreatesJobs(t *testing.T) {
+	ctx := context.Background()
+
 	// create a namespace
 	c := NewNamespace("test")
 	tb := testtools.TestBackend{}
@@ -113,7 +123,7 @@ func TestNamespaceCreatesJobs(t *testing.T) {
 	}
 
 	// create a job
-	err := c.CreateJob(tb, job)
+	err := c.CreateJob(ctx, tb, job)
 	if err != nil {
 		t.Fatal("error creating node", err)
 	}
@@ -127,13 +137,13 @@ func TestNamespaceCreatesJobs(t *testing.T) {
 	}
 
 	// get nonexistent job
-	job1, err := c.GetJob(tb, "foo1")
+	job1, err := c.GetJob(ctx, tb, "foo1")
 	if err == nil {
 		t.Fatal("expected error getting nonexistent job")
 	}
 
 	// get existing job
-	job1, err = c.GetJob(tb, "foo")
+	job1, err = c.GetJob(ctx, tb, "foo")
 	if err != nil {
 		t.Fatal("failed to get job", err)
 	}
@@ -145,3 +155,160 @@ func TestNamespaceCreatesJobs(t *testing.T) {
 	}
 
 }
+
+func TestNamespaceListsJobsAndAssignments(t *testing.T) {
+	ctx := context.Background()
+
+	// create a namespace with no jobs
+	c := NewNamespace("test")
+	tb := testtools.TestBackend{}
+
+	jobs, err := c.GetJobs(ctx, tb)
+	if err != nil {
+		t.Fatal("error listing jobs in empty namespace", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatal("expected no jobs, got", len(jobs))
+	}
+
+	// create some jobs, and assign one of them to a node
+	for _, id := range []string{"foo", "bar"} {
+		err = c.CreateJob(ctx, tb, &Job{ID: id, UnitFile: "unit file"})
+		if err != nil {
+			t.Fatal("error creating job", err)
+		}
+	}
+
+	err = c.CreateNode(ctx, tb, &Node{Name: "testnode", Namespace: "test", JobIDs: []string{"foo"}})
+	if err != nil {
+		t.Fatal("error creating node", err)
+	}
+
+	jobs, err = c.GetJobs(ctx, tb)
+	if err != nil {
+		t.Fatal("error listing jobs", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatal("expected 2 jobs, got", len(jobs))
+	}
+
+	// assignments made before statuses existed are picked up
+	status, err := c.GetJobStatus(ctx, tb, "foo")
+	if err != nil {
+		t.Fatal("error getting job status", err)
+	}
+	if status.Node != "testnode" || !status.IsScheduled || status.DesiredState != JobStateRunning {
+		t.Fatal("expected foo to be running on testnode, got", status)
+	}
+
+	status, err = c.GetJobStatus(ctx, tb, "bar")
+	if err != nil {
+		t.Fatal("error getting job status", err)
+	}
+	if status.Node != "" || status.ObservedState != JobStateUnscheduled {
+		t.Fatal("bar should not be assigned to any node, got", status)
+	}
+
+	// reading them doesn't save them
+	statuses, err := c.GetJobStatuses(ctx, tb)
+	if err != nil || len(statuses) != 0 {
+		t.Fatal("expected reading job statuses not to save them", statuses, err)
+	}
+
+	// the rescheduler does, and once it has, we don't need the node to find
+	// the job
+	err = c.repairAssignments(ctx, tb, map[string]bool{"testnode": true})
+	if err != nil {
+		t.Fatal("error repairing assignments", err)
+	}
+	delete(tb, "/kubernotes/clusters/test/nodes/testnode")
+	statuses, err = c.GetJobStatuses(ctx, tb)
+	if err != nil || len(statuses) != 1 {
+		t.Fatal("expected foo's job status to be saved", statuses, err)
+	}
+
+	status, err = c.GetJobStatus(ctx, tb, "foo")
+	if err != nil || status.Node != "testnode" {
+		t.Fatal("expected saved status to still place foo on testnode", status, err)
+	}
+}
+
+func TestNamespaceDestroysUnscheduledJobs(t *testing.T) {
+	ctx := context.Background()
+
+	c := NewNamespace("test")
+	tb := testtools.TestBackend{}
+
+	job := &Job{ID: "foo", UnitFile: "unit file"}
+	err := c.CreateJob(ctx, tb, job)
+	if err != nil {
+		t.Fatal("error creating job", err)
+	}
+
+	err = c.CreateNode(ctx, tb, &Node{Name: "testnode", Namespace: "test", JobIDs: []string{"foo"}})
+	if err != nil {
+		t.Fatal("error creating node", err)
+	}
+
+	// destroying a scheduled job should fail
+	err = c.DestroyJob(ctx, tb, "foo")
+	if err == nil {
+		t.Fatal("allowed to destroy a scheduled job")
+	}
+
+	// once it's unscheduled it should go away
+	err = c.Unschedule(ctx, tb, job)
+	if err != nil {
+		t.Fatal("error unscheduling job", err)
+	}
+
+	err = c.DestroyJob(ctx, tb, "foo")
+	if err != nil {
+		t.Fatal("error destroying job", err)
+	}
+
+	if _, ok := tb["/kubernotes/clusters/test/jobs/foo"]; ok {
+		t.Fatal("job not destroyed")
+	}
+	if _, ok := tb["/kubernotes/clusters/test/status/foo"]; ok {
+		t.Fatal("job status not destroyed")
+	}
+}
+
+func TestNamespaceWontDestroyPendingJobs(t *testing.T) {
+	ctx := context.Background()
+
+	c := NewNamespace("test")
+	backend := NewMemory()
+
+	// nowhere to run it, so it's left pending
+	job := &Job{ID: "foo", UnitFile: "unit file"}
+	err := c.CreateJob(ctx, backend, job)
+	if err != nil {
+		t.Fatal("error creating job", err)
+	}
+	status, err := c.Schedule(ctx, backend, job)
+	if err != nil || !status.IsPending() {
+		t.Fatal("expected the job to be pending", status, err)
+	}
+
+	// it could be placed at any moment, so it has to be stopped first
+	err = c.DestroyJob(ctx, backend, "foo")
+	if err == nil {
+		t.Fatal("allowed to destroy a pending job")
+	}
+
+	err = c.Unschedule(ctx, backend, job)
+	if err != nil {
+		t.Fatal("error stopping job", err)
+	}
+	err = c.DestroyJob(ctx, backend, "foo")
+	if err != nil {
+		t.Fatal("error destroying job", err)
+	}
+
+	statuses, err := c.GetJobStatuses(ctx, backend)
+	if err != nil || len(statuses) != 0 {
+		t.Fatal("expected the job's status to be destroyed along with it", statuses, err)
+	}
+}
@@ -4,10 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
 )
 
+// How long a Node is considered alive after its last heartbeat, unless
+// otherwise specified.
+const DefaultHeartbeatTTL = 15 * time.Second
+
 // Represents a node available for running jobs in a Kubernotes cluster.
 type Node struct {
 	// Arbitrary unit to represent available IO shares for scheduling
@@ -19,6 +28,9 @@ type Node struct {
 	// Megabytes available for job scheduling
 	MemoryMegabytes int
 
+	// Arbitrary key/value facts about the node, for jobs to constrain on
+	Labels map[string]string
+
 	Endpoint          string
 	Name              string
 	Namespace         string
@@ -55,41 +67,78 @@ func (n *Node) Serialize() (string, error) {
 }
 
 // Join as a node of an existing cluster.
-func (n *Node) JoinCluster(backend Backend) error {
+func (n *Node) JoinCluster(ctx context.Context, backend Backend) error {
 	// see if node exists
-	exists, err := backend.CheckIfKeyExists(getNodePath(n.Namespace, n.Name))
+	exists, err := backend.CheckIfKeyExists(ctx, getNodePath(n.Namespace, n.Name))
 	if err != nil {
 		return fmt.Errorf("problem determining cluster membership %v", err)
 	}
 
 	// create it, if it doesn't
 	if !exists {
-		return n.SaveIfNotModified(backend, etcd.PrevNoExist)
+		err = n.SaveIfNotModified(ctx, backend, etcd.PrevNoExist)
 	} else {
-		return n.Load(backend)
+		err = n.Load(ctx, backend)
+	}
+	if err != nil {
+		return err
 	}
 
-	return err
+	// we're alive as of joining
+	return n.Heartbeat(ctx, backend, DefaultHeartbeatTTL)
+}
+
+// Mark this Node as alive for the next ttl. Nodes that stop heartbeating are
+// considered down, and are no longer eligible to be scheduled jobs.
+func (n *Node) Heartbeat(ctx context.Context, backend Backend, ttl time.Duration) error {
+	err := backend.WriteKeyWithTTL(ctx, getNodeHeartbeatPath(n.Namespace, n.Name), n.Name, ttl, etcd.PrevIgnore, 0)
+	if err != nil {
+		return fmt.Errorf("problem sending heartbeat %v", err)
+	}
+	return nil
+}
+
+// Determine if this Node has heartbeated within its ttl.
+func (n *Node) IsAlive(ctx context.Context, backend Backend) (bool, error) {
+	alive, err := backend.CheckIfKeyExists(ctx, getNodeHeartbeatPath(n.Namespace, n.Name))
+	if err != nil {
+		return false, fmt.Errorf("problem checking node heartbeat %v", err)
+	}
+	return alive, nil
 }
 
 // Save information to provided backend, if not modified externally, or to be newly created.
-func (n *Node) SaveIfNotModified(backend Backend, exists etcd.PrevExistType) error {
+// If it was modified, a ConflictError is returned.
+func (n *Node) SaveIfNotModified(ctx context.Context, backend Backend, exists etcd.PrevExistType) error {
 	json, err := n.Serialize()
 	if err != nil {
 		return fmt.Errorf("problem serializing node %v", err)
 	}
-	err = backend.WriteKey(getNodePath(n.Namespace, n.Name), json, false, exists, n.LastModifiedIndex)
+	err = backend.WriteKey(ctx, getNodePath(n.Namespace, n.Name), json, false, exists, n.LastModifiedIndex)
+	if IsConflict(err) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("problem joining cluster %v", err)
 	}
 	return nil
 }
 
+// The condition saving the node as part of a transaction is made on, that it
+// hasn't been modified since it was loaded.
+func (n *Node) compare() txn.Compare {
+	return txn.Compare{
+		Key:       getNodePath(n.Namespace, n.Name),
+		PrevExist: etcd.PrevExist,
+		PrevIndex: n.LastModifiedIndex,
+	}
+}
+
 // Loads an existing Node from it's information stored in the backend.
-func (n *Node) Load(backend Backend) error {
+func (n *Node) Load(ctx context.Context, backend Backend) error {
 	var json string
 	var err error
-	json, n.LastModifiedIndex, err = backend.ReadKey(getNodePath(n.Namespace, n.Name))
+	json, n.LastModifiedIndex, err = backend.ReadKey(ctx, getNodePath(n.Namespace, n.Name))
 	if err != nil {
 		return fmt.Errorf("could not get cluster node %v", err)
 	}
@@ -98,76 +147,158 @@ func (n *Node) Load(backend Backend) error {
 }
 
 // Remove this Node from the current cluster.
-func (n *Node) LeaveCluster(backend Backend) error {
+func (n *Node) LeaveCluster(ctx context.Context, backend Backend) error {
 	// delete cluster membership
-	err := backend.DeleteKey(getNodePath(n.Namespace, n.Name), true)
+	err := backend.DeleteKey(ctx, getNodePath(n.Namespace, n.Name), true)
 	if err != nil {
 		return fmt.Errorf("problem leaving cluster %v", err)
 	}
 
+	// stop reporting ourselves as alive, if our heartbeat hasn't already expired
+	alive, err := n.IsAlive(ctx, backend)
+	if err != nil {
+		return err
+	}
+	if alive {
+		err = backend.DeleteKey(ctx, getNodeHeartbeatPath(n.Namespace, n.Name), false)
+		if err != nil {
+			return fmt.Errorf("problem leaving cluster %v", err)
+		}
+	}
+
 	return nil
 }
 
-// Get list of jobs currently assigned to this node.
-func (n *Node) GetJobs(backend Backend) ([]Job, error) {
+// Replace this Node's labels, if not modified externally.
+func (n *Node) SetLabels(ctx context.Context, backend Backend, labels map[string]string) error {
+	n.Labels = labels
+	return n.SaveIfNotModified(ctx, backend, etcd.PrevExist)
+}
+
+// Determine if this Node's labels satisfy every constraint.
+func (n *Node) MatchesConstraints(constraints []Constraint) (bool, *Constraint) {
+	for i := range constraints {
+		if !constraints[i].Matches(n.Labels) {
+			return false, &constraints[i]
+		}
+	}
+	return true, nil
+}
+
+// Get list of jobs currently assigned to this node. Each Job has the ID of the
+// instance assigned, so replicas of a job can be told apart.
+func (n *Node) GetJobs(ctx context.Context, backend Backend) ([]Job, error) {
 	ret := make([]Job, len(n.JobIDs))
 	namespace := NewNamespace(n.Namespace)
-	for i, jobID := range n.JobIDs {
-		job, err := namespace.GetJob(backend, jobID)
+	for i, instanceID := range n.JobIDs {
+		jobID, instance := ParseInstanceID(instanceID)
+		job, err := namespace.GetJob(ctx, backend, jobID)
 		if err != nil {
 			return nil, err
 		}
-		ret[i] = *job
+		ret[i] = *job.Instance(instance)
 	}
 	return ret, nil
 }
 
-func (n *Node) GetFreeResources(backend Backend) (*Resources, error) {
-	resources := &Resources{
-		CPUShares:       n.CPUShares,
-		BlockIOShares:   n.BlockIOShares,
-		MemoryMegabytes: n.MemoryMegabytes,
+// Determine if this node is assigned any instance of the job an instance
+// belongs to.
+func (n *Node) HasReplicaOf(instanceID string) bool {
+	for _, v := range n.JobIDs {
+		if sameJob(v, instanceID) {
+			return true
+		}
 	}
+	return false
+}
 
+func (n *Node) GetFreeResources(ctx context.Context, backend Backend) (*Resources, error) {
 	// look at assigned jobs to determine current resource utilization
-	jobs, err := n.GetJobs(backend)
+	jobs, err := n.GetJobs(ctx, backend)
 	if err != nil {
 		return nil, err
 	}
+	return n.freeResources(jobs), nil
+}
+
+// Get the resources left over after running the provided jobs.
+func (n *Node) freeResources(jobs []Job) *Resources {
+	resources := &Resources{
+		CPUShares:       n.CPUShares,
+		BlockIOShares:   n.BlockIOShares,
+		MemoryMegabytes: n.MemoryMegabytes,
+	}
+
 	for _, job := range jobs {
 		resources.CPUShares -= job.CPUShares
 		resources.BlockIOShares -= job.BlockIOWeight
 		resources.MemoryMegabytes -= job.MemoryLimitMegabytes
 	}
 
-	return resources, nil
+	return resources
 }
 
-// Assign a job for a node to run.
-func (n *Node) AssignJob(backend Backend, jobID string) error {
-	for _, v := range n.JobIDs {
-		if v == jobID {
-			return fmt.Errorf("cannot run duplicate job %s on node %s", jobID, n.Name)
-		}
+// Determine if there are enough resources to run a job.
+func (r *Resources) fits(job *Job) bool {
+	return r.shortfall(job) == ""
+}
+
+// Describe which resources there aren't enough of to run a job, if any.
+func (r *Resources) shortfall(job *Job) string {
+	short := make([]string, 0)
+	if r.CPUShares < job.CPUShares {
+		short = append(short, fmt.Sprintf("insufficient CPU, needs %d shares but %d are free",
+			job.CPUShares, r.CPUShares))
 	}
-	n.JobIDs = append(n.JobIDs, jobID)
-	return n.SaveIfNotModified(backend, etcd.PrevExist)
+	if r.BlockIOShares < job.BlockIOWeight {
+		short = append(short, fmt.Sprintf("insufficient IO, needs %d shares but %d are free",
+			job.BlockIOWeight, r.BlockIOShares))
+	}
+	if r.MemoryMegabytes < job.MemoryLimitMegabytes {
+		short = append(short, fmt.Sprintf("insufficient memory, needs %dM but %dM is free",
+			job.MemoryLimitMegabytes, r.MemoryMegabytes))
+	}
+	return strings.Join(short, ", ")
+}
+
+// Assign a job for a node to run. A node only runs one instance of any job.
+func (n *Node) AssignJob(ctx context.Context, backend Backend, jobID string) error {
+	err := n.addJob(jobID)
+	if err != nil {
+		return err
+	}
+	return n.SaveIfNotModified(ctx, backend, etcd.PrevExist)
 }
 
 // Unassign a job from a node.
-func (n *Node) UnassignJob(backend Backend, jobID string) error {
+func (n *Node) UnassignJob(ctx context.Context, backend Backend, jobID string) error {
+	n.removeJob(jobID)
+	return n.SaveIfNotModified(ctx, backend, etcd.PrevExist)
+}
+
+// Add a job to the node's job list, without saving it.
+func (n *Node) addJob(jobID string) error {
+	if n.HasReplicaOf(jobID) {
+		return fmt.Errorf("cannot run duplicate job %s on node %s", jobID, n.Name)
+	}
+	n.JobIDs = append(n.JobIDs, jobID)
+	return nil
+}
+
+// Remove a job from the node's job list, without saving it.
+func (n *Node) removeJob(jobID string) {
 	for i, v := range n.JobIDs {
 		if v == jobID {
 			// remove the specified job id
 			n.JobIDs = append(n.JobIDs[:i], n.JobIDs[i+1:]...)
+			return
 		}
 	}
-	return n.SaveIfNotModified(backend, etcd.PrevExist)
 }
 
 // Block on an endpoint waiting to be notified of scheduling changes.
-func (n *Node) WatchForChanges(backend Backend, since uint64) (uint64, error) {
+func (n *Node) WatchForChanges(ctx context.Context, backend Backend, since uint64) (uint64, error) {
 	path := getNodeChangesPath(n.Namespace, n.Name)
 	log.Println("watching for changes to", path)
-	return backend.WatchForChanges(path, since)
+	return backend.WatchForChanges(ctx, path, since)
 }
@@ -3,15 +3,19 @@ package cluster
 import (
 	"testing"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/testtools"
 )
 
 func TestNodeJoinCluster(t *testing.T) {
+	ctx := context.Background()
+
 	// create a node and join a cluster
 	node := &Node{Namespace: "test", Name: "testnode"}
 	tb := testtools.TestBackend{}
 
-	err := node.JoinCluster(tb)
+	err := node.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
@@ -21,7 +25,7 @@ func TestNodeJoinCluster(t *testing.T) {
 	}
 
 	// make sure we can leave clusters
-	err = node.LeaveCluster(tb)
+	err = node.LeaveCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to leave cluster", err)
 	}
@@ -33,6 +37,8 @@ func TestNodeJoinCluster(t *testing.T) {
 }
 
 func TestNodeStoreResources(t *testing.T) {
+	ctx := context.Background()
+
 	// create a node with allocated resources
 	node := &Node{
 		Namespace:       "test",
@@ -43,7 +49,7 @@ func TestNodeStoreResources(t *testing.T) {
 	}
 	tb := testtools.TestBackend{}
 
-	err := node.JoinCluster(tb)
+	err := node.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
@@ -53,7 +59,7 @@ func TestNodeStoreResources(t *testing.T) {
 	}
 
 	c := NewNamespace("test")
-	node1, err := c.GetNode(tb, "testnode")
+	node1, err := c.GetNode(ctx, tb, "testnode")
 	if err != nil {
 		t.Fatal("failed to get node", err)
 	}
@@ -68,27 +74,29 @@ func TestNodeStoreResources(t *testing.T) {
 }
 
 func TestNodeAssignJobs(t *testing.T) {
+	ctx := context.Background()
+
 	tb := testtools.TestBackend{}
 
 	// create some nodes
 	node := &Node{Namespace: "test", Name: "testnode", CPUShares: 1000}
 	node1 := &Node{Namespace: "test", Name: "testnode1"}
 
-	err := node.JoinCluster(tb)
+	err := node.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
-	err = node1.JoinCluster(tb)
+	err = node1.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
 
 	// and a namespace
 	c := NewNamespace("test")
-	c.CreateJob(tb, &Job{ID: "testjob", CPUShares: 200})
+	c.CreateJob(ctx, tb, &Job{ID: "testjob", CPUShares: 200})
 
 	// check node resources
-	resources, err := node.GetFreeResources(tb)
+	resources, err := node.GetFreeResources(ctx, tb)
 	if err != nil {
 		t.Fatal("unable to get resources for node", err)
 	}
@@ -98,13 +106,13 @@ func TestNodeAssignJobs(t *testing.T) {
 	}
 
 	// initial assignment
-	err = node.AssignJob(tb, "testjob")
+	err = node.AssignJob(ctx, tb, "testjob")
 	if err != nil {
 		t.Fatal("failed to assign job to node", err)
 	}
 
 	// check resource use
-	resources, err = node.GetFreeResources(tb)
+	resources, err = node.GetFreeResources(ctx, tb)
 	if err != nil {
 		t.Fatal("unable to get resources for node", err)
 	}
@@ -114,7 +122,7 @@ func TestNodeAssignJobs(t *testing.T) {
 	}
 
 	// get all jobs for node
-	jobs, err := node.GetJobs(tb)
+	jobs, err := node.GetJobs(ctx, tb)
 	if err != nil {
 		t.Fatal("error getting node jobs")
 	}
@@ -128,14 +136,57 @@ func TestNodeAssignJobs(t *testing.T) {
 	}
 
 	// another assignment of the same job should fail
-	err = node.AssignJob(tb, "testjob")
+	err = node.AssignJob(ctx, tb, "testjob")
 	if err == nil {
 		t.Fatal("allowed to assign duplicate job to node")
 	}
 
 	// unassignment should work
-	err = node.UnassignJob(tb, "testjob")
+	err = node.UnassignJob(ctx, tb, "testjob")
 	if err != nil {
 		t.Fatal("failed to unassign job from node")
 	}
 }
+
+func TestNodeHeartbeat(t *testing.T) {
+	ctx := context.Background()
+
+	node := &Node{Namespace: "test", Name: "testnode"}
+	tb := testtools.TestBackend{}
+
+	// joining the cluster should mark us alive
+	err := node.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	alive, err := node.IsAlive(ctx, tb)
+	if err != nil || !alive {
+		t.Fatal("node should be alive after joining cluster", err)
+	}
+
+	// simulate the heartbeat expiring
+	delete(tb, "/kubernotes/clusters/test/heartbeats/testnode")
+
+	alive, err = node.IsAlive(ctx, tb)
+	if err != nil || alive {
+		t.Fatal("node should be down once heartbeat expires", err)
+	}
+
+	c := NewNamespace("test")
+	nodes, err := c.GetLiveNodes(ctx, tb)
+	if err != nil || len(nodes) != 0 {
+		t.Fatal("expected no live nodes", nodes, err)
+	}
+
+	// heartbeating again brings us back
+	err = node.Heartbeat(ctx, tb, DefaultHeartbeatTTL)
+	if err != nil {
+		t.Fatal("failed to heartbeat", err)
+	}
+
+	nodes, err = c.GetLiveNodes(ctx, tb)
+	if err != nil || len(nodes) != 1 {
+		t.Fatal("expected node to be alive after heartbeat", nodes, err)
+	}
+}
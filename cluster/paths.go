@@ -8,8 +8,12 @@ func getNamespacePath(clusterName string) string {
 	return fmt.Sprintf("/kubernotes/clusters/%s", clusterName)
 }
 
+func getJobsPath(clusterName string) string {
+	return fmt.Sprintf("%s/jobs", getNamespacePath(clusterName))
+}
+
 func getJobPath(clusterName string, jobID string) string {
-	return fmt.Sprintf("%s/jobs/%s", getNamespacePath(clusterName), jobID)
+	return fmt.Sprintf("%s/%s", getJobsPath(clusterName), jobID)
 }
 
 func getNodesPath(clusterName string) string {
@@ -23,3 +27,39 @@ func getNodePath(clusterName string, nodeName string) string {
 func getNodeChangesPath(clusterName string, nodeName string) string {
 	return getNodePath(clusterName, nodeName)
 }
+
+func getHeartbeatsPath(clusterName string) string {
+	return fmt.Sprintf("%s/heartbeats", getNamespacePath(clusterName))
+}
+
+func getNodeHeartbeatPath(clusterName string, nodeName string) string {
+	return fmt.Sprintf("%s/%s", getHeartbeatsPath(clusterName), nodeName)
+}
+
+func getJobStatusesPath(clusterName string) string {
+	return fmt.Sprintf("%s/status", getNamespacePath(clusterName))
+}
+
+func getJobStatusPath(clusterName string, jobID string) string {
+	return fmt.Sprintf("%s/%s", getJobStatusesPath(clusterName), jobID)
+}
+
+func getNamespaceConfigPath(clusterName string) string {
+	return fmt.Sprintf("%s/config", getNamespacePath(clusterName))
+}
+
+func getLeadersPath(clusterName string) string {
+	return fmt.Sprintf("%s/leaders", getNamespacePath(clusterName))
+}
+
+func getLeaderPath(clusterName string, role string) string {
+	return fmt.Sprintf("%s/%s", getLeadersPath(clusterName), role)
+}
+
+func getRunStatesPath(clusterName string, nodeName string) string {
+	return fmt.Sprintf("%s/runstates/%s", getNamespacePath(clusterName), nodeName)
+}
+
+func getRunStatePath(clusterName string, nodeName string, jobID string) string {
+	return fmt.Sprintf("%s/%s", getRunStatesPath(clusterName, nodeName), jobID)
+}
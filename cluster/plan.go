@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Represents what the scheduler made of running a job on a Node.
+type NodeDecision struct {
+	Node string
+
+	// Where the node ranks among those able to run the job, from 1, or 0 if
+	// it can't run it.
+	Rank int
+
+	// Why the node ranks where it does, or can't run the job.
+	Reason string
+}
+
+// Represents where the scheduler would place a job, without placing it.
+type Placement struct {
+	JobID string
+
+	// The node the job would run on, or already runs on, if any.
+	Node             string
+	AlreadyScheduled bool
+
+	// Jobs that would be evicted to make room for it.
+	Preempted []string
+
+	// Why the job would be left pending, if it would be.
+	Reason string
+
+	// What was made of every node in the namespace.
+	Decisions []NodeDecision
+}
+
+// Work out where a job would be scheduled right now, including which jobs
+// would be preempted to make room for it. This runs the same placement logic
+// as Schedule, but only reads from the backend, so nothing is created or
+// saved, not even the namespace or a missing status record.
+func (n *Namespace) PlanSchedule(ctx context.Context, backend Backend, job *Job) (*Placement, error) {
+	placement := &Placement{JobID: job.ID}
+
+	status, _, err := n.findJobStatus(ctx, backend, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	if status.Node != "" {
+		placement.Node = status.Node
+		placement.AlreadyScheduled = true
+		return placement, nil
+	}
+
+	candidates, decisions, err := n.findCandidates(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
+	placement.Decisions = decisions
+
+	if len(candidates) > 0 {
+		placement.Node = candidates[0].Node.Name
+		return placement, nil
+	}
+
+	preemption, err := n.planPreemption(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
+	if preemption != nil {
+		placement.Node = preemption.Node.Name
+		placement.Preempted = preemption.VictimIDs()
+		for i := range placement.Decisions {
+			if placement.Decisions[i].Node == placement.Node {
+				placement.Decisions[i].Rank = 1
+				placement.Decisions[i].Reason = fmt.Sprintf("%s, room can be made by preempting lower priority jobs",
+					placement.Decisions[i].Reason)
+			}
+		}
+		return placement, nil
+	}
+
+	placement.Reason = pendingReason(decisions)
+	return placement, nil
+}
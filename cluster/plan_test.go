@@ -0,0 +1,179 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+	"github.com/sofuture/kubernotes/txn"
+)
+
+func TestPlanScheduleExplainsEveryNode(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	nodes := []*Node{
+		{Namespace: "test", Name: "a-down", CPUShares: 1000, MemoryMegabytes: 1000},
+		{Namespace: "test", Name: "b-small", CPUShares: 100, MemoryMegabytes: 10},
+		{Namespace: "test", Name: "c-arm", CPUShares: 1000, MemoryMegabytes: 1000, Labels: map[string]string{"arch": "arm"}},
+		{Namespace: "test", Name: "d-busy", CPUShares: 1000, MemoryMegabytes: 1000},
+		{Namespace: "test", Name: "e-roomy", CPUShares: 2000, MemoryMegabytes: 2000},
+		{Namespace: "test", Name: "f-snug", CPUShares: 1000, MemoryMegabytes: 1000},
+	}
+	for _, node := range nodes {
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+	delete(tb, getNodeHeartbeatPath("test", "a-down"))
+
+	c := NewNamespace("test")
+	err := c.SetConfig(ctx, tb, &NamespaceConfig{Strategy: StrategySpread})
+	if err != nil {
+		t.Fatal("unable to configure namespace", err)
+	}
+
+	job := &Job{ID: "web", CPUShares: 500, MemoryLimitMegabytes: 100, Replicas: 2, Requires: []Constraint{{"arch", ConstraintNotEqual, "arm"}}}
+	err = c.CreateJob(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	node, _ := c.GetNode(ctx, tb, "d-busy")
+	err = node.AssignJob(ctx, tb, "web@1")
+	if err != nil {
+		t.Fatal("unable to assign job", err)
+	}
+
+	// planning writes nothing
+	before := make(map[string]string)
+	for k, v := range tb {
+		before[k] = v
+	}
+
+	placement, err := c.PlanSchedule(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+
+	if len(tb) != len(before) {
+		t.Fatal("planning should not have written anything")
+	}
+	for k, v := range before {
+		if tb[k] != v {
+			t.Fatal("planning should not have changed", k)
+		}
+	}
+
+	if placement.Node != "e-roomy" {
+		t.Fatal("expected web on e-roomy, but it's on", placement.Node)
+	}
+
+	expected := map[string]string{
+		"a-down":  "node is down",
+		"b-small": "insufficient CPU, needs 500 shares but 100 are free, insufficient memory, needs 100M but 10M is free",
+		"c-arm":   "does not satisfy constraint arch!=arm",
+		"d-busy":  "already running replica web@1 of job",
+		"e-roomy": "ranked 1 of 2 by spread strategy",
+		"f-snug":  "ranked 2 of 2 by spread strategy",
+	}
+	if len(placement.Decisions) != len(expected) {
+		t.Fatal("expected a decision for every node", placement.Decisions)
+	}
+	for _, decision := range placement.Decisions {
+		if decision.Reason != expected[decision.Node] {
+			t.Fatal("unexpected decision for", decision.Node, decision.Reason)
+		}
+	}
+
+	// an instance that's already placed is reported as such
+	placement, err = c.PlanSchedule(ctx, tb, job.Instance(1))
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+	if !placement.AlreadyScheduled || placement.Node != "d-busy" {
+		t.Fatal("expected web@1 to already be on d-busy", placement)
+	}
+
+	// and a job that fits nowhere explains itself
+	huge := &Job{ID: "huge", CPUShares: 5000}
+	placement, err = c.PlanSchedule(ctx, tb, huge)
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+	if placement.Node != "" || !strings.Contains(placement.Reason, "e-roomy: insufficient CPU, needs 5000 shares but 2000 are free") {
+		t.Fatal("expected huge to be left pending with an explanation", placement.Reason)
+	}
+}
+
+// Backend that fails the test on any write.
+type readOnlyBackend struct {
+	Backend
+	t *testing.T
+}
+
+func (r readOnlyBackend) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	r.t.Fatal("unexpected write to", key)
+	return nil
+}
+
+func (r readOnlyBackend) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	r.t.Fatal("unexpected write to", key)
+	return nil
+}
+
+func (r readOnlyBackend) DeleteKey(ctx context.Context, key string, directory bool) error {
+	r.t.Fatal("unexpected delete of", key)
+	return nil
+}
+
+func (r readOnlyBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	r.t.Fatal("unexpected transaction", writes)
+	return nil
+}
+
+func TestPlanScheduleDoesNotWrite(t *testing.T) {
+	ctx := context.Background()
+
+	// not even the namespace exists yet
+	backend := NewMemory()
+	placement, err := NewNamespace("test").PlanSchedule(ctx, readOnlyBackend{backend, t}, &Job{ID: "job", CPUShares: 100})
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+	if placement.Node != "" {
+		t.Fatal("expected nowhere to place the job", placement)
+	}
+
+	// nor with nodes to consider, and lower priority jobs to preempt
+	node := &Node{Namespace: "test", Name: "node", CPUShares: 100}
+	err = node.JoinCluster(ctx, backend)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+	c := NewNamespace("test")
+	low := &Job{ID: "low", CPUShares: 100}
+	err = c.CreateJob(ctx, backend, low)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+	_, err = c.Schedule(ctx, backend, low)
+	if err != nil {
+		t.Fatal("unable to schedule job", err)
+	}
+
+	high := &Job{ID: "high", CPUShares: 100, Priority: 1}
+	placement, err = c.PlanSchedule(ctx, readOnlyBackend{backend, t}, high)
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+	if placement.Node != "node" || len(placement.Preempted) != 1 {
+		t.Fatal("expected to preempt low", placement)
+	}
+}
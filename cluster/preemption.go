@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Represents lower priority jobs that could be evicted from a Node to make
+// room for a job.
+type Preemption struct {
+	Node    Node
+	Victims []Job
+}
+
+// Get the IDs of the jobs that would be evicted.
+func (p *Preemption) VictimIDs() []string {
+	ids := make([]string, len(p.Victims))
+	for i, victim := range p.Victims {
+		ids[i] = victim.ID
+	}
+	return ids
+}
+
+// Find the smallest set of lower priority jobs on a single node that could
+// be evicted to make room for a job. Ties go to evicting the lowest priority
+// jobs, then to nodes in name order. Returns nil if there's no such set.
+func (n *Namespace) planPreemption(ctx context.Context, backend Backend, job *Job) (*Preemption, error) {
+	nodes, err := n.GetLiveNodes(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Preemption
+	for _, node := range nodes {
+		// reload the node so evicting is conditional on it not changing
+		err = node.Load(ctx, backend)
+		if err != nil {
+			return nil, err
+		}
+
+		// evicting jobs doesn't change the node's labels, or the fact it's
+		// already running another replica of the job
+		if node.HasReplicaOf(job.ID) {
+			continue
+		}
+		matches, _ := node.MatchesConstraints(job.Requires)
+		if !matches {
+			continue
+		}
+
+		jobs, err := node.GetJobs(ctx, backend)
+		if err != nil {
+			return nil, err
+		}
+
+		lower := make([]Job, 0, len(jobs))
+		for _, running := range jobs {
+			if running.Priority < job.Priority {
+				lower = append(lower, running)
+			}
+		}
+
+		// there's no point looking for sets bigger than the best so far
+		limit := len(lower)
+		if best != nil && len(best.Victims) < limit {
+			limit = len(best.Victims)
+		}
+
+		victims := smallestEviction(job, &node, jobs, lower, limit)
+		if victims == nil {
+			continue
+		}
+
+		if best == nil || len(victims) < len(best.Victims) ||
+			(len(victims) == len(best.Victims) && totalPriority(victims) < totalPriority(best.Victims)) {
+			best = &Preemption{Node: node, Victims: victims}
+		}
+	}
+
+	return best, nil
+}
+
+// How many sets of victims are tried on each node before settling for a
+// greedy choice, so a node running many jobs can't stall the scheduler.
+const maxEvictionChecks = 1000
+
+// Find the smallest set, of at most limit of the lower priority jobs, that
+// once evicted from a node leaves room for the job, with the lowest total
+// priority. The search is exhaustive, stopping at the smallest size that
+// works, unless it takes more than maxEvictionChecks tries, when a greedy
+// choice is made instead.
+func smallestEviction(job *Job, node *Node, running []Job, lower []Job, limit int) []Job {
+	// try the lowest priority jobs first, so the first set found of each
+	// size is the cheapest
+	sort.Stable(byPriority(lower))
+
+	checks := 0
+	for size := 1; size <= limit; size++ {
+		var best []Job
+		chosen := make([]Job, 0, size)
+
+		var search func(start int) bool
+		search = func(start int) bool {
+			if len(chosen) == size {
+				if best != nil && totalPriority(chosen) >= totalPriority(best) {
+					return true
+				}
+				checks++
+				if checks > maxEvictionChecks {
+					return false
+				}
+				if canRunWithout(job, node, running, chosen) {
+					best = append([]Job{}, chosen...)
+				}
+				return true
+			}
+			for i := start; i < len(lower); i++ {
+				chosen = append(chosen, lower[i])
+				more := search(i + 1)
+				chosen = chosen[:len(chosen)-1]
+				if !more {
+					return false
+				}
+			}
+			return true
+		}
+		if !search(0) {
+			victims := greedyEviction(job, node, running, lower)
+			if len(victims) > limit {
+				return nil
+			}
+			return victims
+		}
+
+		if best != nil {
+			return best
+		}
+	}
+
+	return nil
+}
+
+// Evict the lowest priority jobs, biggest first, until there's room for the
+// job, then spare any whose eviction turned out not to be needed. Not always
+// the smallest set, but quick to find however many jobs a node runs.
+func greedyEviction(job *Job, node *Node, running []Job, lower []Job) []Job {
+	candidates := append([]Job{}, lower...)
+	sort.Stable(byPriorityThenSize(candidates))
+
+	var victims []Job
+	for _, candidate := range candidates {
+		victims = append(victims, candidate)
+		if canRunWithout(job, node, running, victims) {
+			break
+		}
+	}
+	if !canRunWithout(job, node, running, victims) {
+		return nil
+	}
+
+	// spare the highest priority victims first
+	for i := len(victims) - 1; i >= 0; i-- {
+		spared := append(append([]Job{}, victims[:i]...), victims[i+1:]...)
+		if canRunWithout(job, node, running, spared) {
+			victims = spared
+		}
+	}
+	return victims
+}
+
+// Determine if a node could run a job once the victims are evicted.
+func canRunWithout(job *Job, node *Node, running []Job, victims []Job) bool {
+	evicted := make(map[string]bool)
+	for _, victim := range victims {
+		evicted[victim.ID] = true
+	}
+
+	remaining := make([]Job, 0, len(running))
+	for _, other := range running {
+		if !evicted[other.ID] {
+			remaining = append(remaining, other)
+		}
+	}
+
+	return checkAffinity(job, remaining) == nil && node.freeResources(remaining).fits(job)
+}
+
+// Evict the victims of a preemption, sending them back to pending so the
+// rescheduler finds them a new home, and place the job in their stead.
+func (n *Namespace) preempt(ctx context.Context, backend Backend, job *Job, status *JobStatus, preemption *Preemption) error {
+	node := preemption.Node
+
+	statuses := make([]*JobStatus, 0, len(preemption.Victims)+1)
+	for _, victim := range preemption.Victims {
+		victimStatus, err := n.GetJobStatus(ctx, backend, victim.ID)
+		if err != nil {
+			return err
+		}
+		if victimStatus.Node != node.Name {
+			return fmt.Errorf("job %s moved off of node %s", victim.ID, node.Name)
+		}
+
+		log.Println("preempting job", victim.ID, "on node", node.Name, "for job", job.ID)
+		victimStatus.transition(JobStatePending, "", fmt.Sprintf("preempted by job %s", job.ID))
+		statuses = append(statuses, victimStatus)
+		node.removeJob(victim.ID)
+	}
+
+	err := node.addJob(job.ID)
+	if err != nil {
+		return err
+	}
+	status.transition(JobStateScheduled, node.Name, fmt.Sprintf("preempted %s", strings.Join(preemption.VictimIDs(), ", ")))
+	statuses = append(statuses, status)
+
+	// swap the victims out for the job in one go, so nobody else can take the
+	// room we've made, and nothing is lost if we die part way through
+	err = saveAssignments(ctx, backend, statuses, []*Node{&node})
+	if err != nil {
+		return fmt.Errorf("jobs on node %s were modified while preempting them %v", node.Name, err)
+	}
+
+	return nil
+}
+
+func totalPriority(jobs []Job) int {
+	total := 0
+	for _, job := range jobs {
+		total += job.Priority
+	}
+	return total
+}
+
+// Sorts jobs from lowest to highest priority.
+type byPriority []Job
+
+func (b byPriority) Len() int           { return len(b) }
+func (b byPriority) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPriority) Less(i, j int) bool { return b[i].Priority < b[j].Priority }
+
+// Sorts jobs from lowest to highest priority, and the biggest first among
+// jobs of the same priority.
+type byPriorityThenSize []Job
+
+func (b byPriorityThenSize) Len() int      { return len(b) }
+func (b byPriorityThenSize) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPriorityThenSize) Less(i, j int) bool {
+	if b[i].Priority != b[j].Priority {
+		return b[i].Priority < b[j].Priority
+	}
+	if b[i].MemoryLimitMegabytes != b[j].MemoryLimitMegabytes {
+		return b[i].MemoryLimitMegabytes > b[j].MemoryLimitMegabytes
+	}
+	if b[i].CPUShares != b[j].CPUShares {
+		return b[i].CPUShares > b[j].CPUShares
+	}
+	return b[i].BlockIOWeight > b[j].BlockIOWeight
+}
@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+	"github.com/sofuture/kubernotes/txn"
+)
+
+func TestSchedulerPreemptsLowerPriorityJobs(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	for _, name := range []string{"a", "b"} {
+		node := &Node{Namespace: "test", Name: name, CPUShares: 1000}
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+
+	schedule := func(job *Job) *JobStatus {
+		err := c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+		status, err := c.Schedule(ctx, tb, job)
+		if err != nil {
+			t.Fatal("got an error scheduling job", job.ID, err)
+		}
+		return status
+	}
+
+	// fill a with three small jobs, and b with one big one
+	for _, job := range []*Job{
+		{ID: "small1", CPUShares: 400, Priority: 1},
+		{ID: "small2", CPUShares: 300},
+		{ID: "small3", CPUShares: 300, Priority: 1},
+	} {
+		if schedule(job).Node != "a" {
+			t.Fatal("expected", job.ID, "on a")
+		}
+	}
+	if schedule(&Job{ID: "big", CPUShares: 900, Priority: 1}).Node != "b" {
+		t.Fatal("expected big on b")
+	}
+
+	// a job can't preempt anything of the same priority
+	status := schedule(&Job{ID: "peer", CPUShares: 200})
+	if !status.IsPending() {
+		t.Fatal("expected peer to be left pending, but it's on", status.Node)
+	}
+
+	// evicting big from b is the smallest set that makes room
+	urgent := &Job{ID: "urgent", CPUShares: 600, Priority: 10}
+	err := c.CreateJob(ctx, tb, urgent)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	placement, err := c.PlanSchedule(ctx, tb, urgent)
+	if err != nil {
+		t.Fatal("unable to plan scheduling", err)
+	}
+	if placement.Node != "b" || len(placement.Preempted) != 1 || placement.Preempted[0] != "big" {
+		t.Fatal("expected plan to preempt big on b", placement)
+	}
+
+	// planning doesn't change anything
+	bigStatus, _ := c.GetJobStatus(ctx, tb, "big")
+	if bigStatus.Node != "b" {
+		t.Fatal("planning should not have preempted big")
+	}
+
+	status, err = c.Schedule(ctx, tb, urgent)
+	if err != nil {
+		t.Fatal("got an error scheduling urgent", err)
+	}
+	if status.Node != "b" {
+		t.Fatal("expected urgent on b, but it's on", status.Node)
+	}
+
+	bigStatus, _ = c.GetJobStatus(ctx, tb, "big")
+	if !bigStatus.IsPending() || bigStatus.Reason != "preempted by job urgent" {
+		t.Fatal("expected big to be pending after being preempted", bigStatus)
+	}
+
+	node, _ := c.GetNode(ctx, tb, "b")
+	if len(node.JobIDs) != 1 || node.JobIDs[0] != "urgent" {
+		t.Fatal("expected b to only run urgent", node.JobIDs)
+	}
+
+	// with b taken, the next one has to evict two jobs from a, preferring the
+	// lowest priority ones
+	status = schedule(&Job{ID: "urgent2", CPUShares: 600, Priority: 10})
+	if status.Node != "a" {
+		t.Fatal("expected urgent2 on a, but it's on", status.Node)
+	}
+
+	node, _ = c.GetNode(ctx, tb, "a")
+	if len(node.JobIDs) != 2 || node.JobIDs[0] != "small3" || node.JobIDs[1] != "urgent2" {
+		t.Fatal("expected small1 and small2 to be preempted from a", node.JobIDs)
+	}
+}
+
+// Runs a function just before the next transaction.
+type beforeTxnBackend struct {
+	*Memory
+	before func()
+}
+
+func (b *beforeTxnBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	if b.before != nil {
+		before := b.before
+		b.before = nil
+		before()
+	}
+	return b.Memory.Txn(ctx, compares, writes)
+}
+
+func TestPreemptionIsAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+
+	backend := &beforeTxnBackend{Memory: NewMemory()}
+
+	node := &Node{Namespace: "test", Name: "a", CPUShares: 1000}
+	err := node.JoinCluster(ctx, backend)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	c := NewNamespace("test")
+	low := &Job{ID: "low", CPUShares: 800}
+	high := &Job{ID: "high", CPUShares: 800, Priority: 10}
+	for _, job := range []*Job{low, high} {
+		err = c.CreateJob(ctx, backend, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+	}
+	_, err = c.Schedule(ctx, backend, low)
+	if err != nil {
+		t.Fatal("unable to schedule job", err)
+	}
+
+	// somebody else touches low just as we're about to preempt it
+	backend.before = func() {
+		status, _ := c.GetJobStatus(ctx, backend, "low")
+		status.Reason = "touched"
+		err := status.SaveIfNotModified(ctx, backend)
+		if err != nil {
+			t.Fatal("unable to save status", err)
+		}
+	}
+
+	status, err := c.Schedule(ctx, backend, high)
+	if err != nil {
+		t.Fatal("got an error scheduling job", err)
+	}
+	if !status.IsPending() {
+		t.Fatal("expected high to be left pending, but it's on", status.Node)
+	}
+
+	// neither the node nor low were changed
+	node, _ = c.GetNode(ctx, backend, "a")
+	if len(node.JobIDs) != 1 || node.JobIDs[0] != "low" {
+		t.Fatal("expected only low on a, but it has", node.JobIDs)
+	}
+	lowStatus, _ := c.GetJobStatus(ctx, backend, "low")
+	if lowStatus.Node != "a" {
+		t.Fatal("expected low to still be on a, but it's", lowStatus.Node, lowStatus.Reason)
+	}
+}
+
+func TestEvictionSearchIsCapped(t *testing.T) {
+	node := &Node{Name: "a", CPUShares: 4000}
+
+	// every job has to go for urgent to fit, far too many sets to try them all
+	running := make([]Job, 40)
+	for i := range running {
+		running[i] = Job{ID: InstanceID("small", i), CPUShares: 100}
+	}
+	urgent := &Job{ID: "urgent", CPUShares: 2000, Priority: 10}
+
+	done := make(chan []Job)
+	go func() {
+		done <- smallestEviction(urgent, node, running, append([]Job{}, running...), len(running))
+	}()
+
+	select {
+	case victims := <-done:
+		if len(victims) != 20 {
+			t.Fatal("expected 20 jobs to be evicted, but got", len(victims))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the search to give up on trying every set")
+	}
+
+	// small searches still find the cheapest set
+	running = []Job{
+		{ID: "a", CPUShares: 1000, Priority: 2},
+		{ID: "b", CPUShares: 1000, Priority: 1},
+		{ID: "c", CPUShares: 1000, Priority: 3},
+		{ID: "d", CPUShares: 1000, Priority: 4},
+	}
+	victims := smallestEviction(urgent, node, running, append([]Job{}, running...), len(running))
+	if len(victims) != 2 || victims[0].ID != "b" || victims[1].ID != "a" {
+		t.Fatal("expected a and b to be evicted", victims)
+	}
+}
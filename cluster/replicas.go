@@ -0,0 +1,207 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Separates a job's ID from the number of one of its instances, the same way
+// systemd names instances of a template unit.
+const InstanceSeparator = "@"
+
+// Get the ID of one instance of a job. The first instance keeps the job's
+// ID, so jobs scheduled before they could be replicated, and jobs scaled up
+// from a single instance, stay where they are.
+func InstanceID(jobID string, instance int) string {
+	if instance == 0 {
+		return jobID
+	}
+	return fmt.Sprintf("%s%s%d", jobID, InstanceSeparator, instance)
+}
+
+// Split an instance ID into the ID of its job and the instance number.
+func ParseInstanceID(instanceID string) (string, int) {
+	i := strings.LastIndex(instanceID, InstanceSeparator)
+	if i < 0 {
+		return instanceID, 0
+	}
+
+	instance, err := strconv.Atoi(instanceID[i+1:])
+	if err != nil || instance <= 0 {
+		return instanceID, 0
+	}
+	return instanceID[:i], instance
+}
+
+// Determine if two instance IDs belong to the same job.
+func sameJob(a string, b string) bool {
+	jobA, _ := ParseInstanceID(a)
+	jobB, _ := ParseInstanceID(b)
+	return jobA == jobB
+}
+
+// Get the number of instances of the job that should be running.
+func (j *Job) GetReplicas() int {
+	if j.Replicas < 1 {
+		return 1
+	}
+	return j.Replicas
+}
+
+// Get a copy of the job representing one of its instances, which is scheduled
+// and run on its own.
+func (j *Job) Instance(instance int) *Job {
+	job := *j
+	job.ID = InstanceID(j.ID, instance)
+	return &job
+}
+
+// Retrieve the status of every instance of a job, ordered by instance. This
+// includes instances beyond the job's replicas that haven't been cleaned up.
+func (n *Namespace) GetInstanceStatuses(ctx context.Context, backend Backend, job *Job) ([]JobStatus, error) {
+	statuses, err := n.GetJobStatuses(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	byInstance := make(map[int]JobStatus)
+	for _, status := range statuses {
+		jobID, instance := ParseInstanceID(status.ID)
+		if jobID == job.ID {
+			byInstance[instance] = status
+		}
+	}
+
+	// instances that have never been scheduled may not have a status yet
+	for i := 0; i < job.GetReplicas(); i++ {
+		if _, ok := byInstance[i]; !ok {
+			status, err := n.GetJobStatus(ctx, backend, InstanceID(job.ID, i))
+			if err != nil {
+				return nil, err
+			}
+			byInstance[i] = *status
+		}
+	}
+
+	instances := make([]int, 0, len(byInstance))
+	for instance := range byInstance {
+		instances = append(instances, instance)
+	}
+	sort.Ints(instances)
+
+	ret := make([]JobStatus, len(instances))
+	for i, instance := range instances {
+		ret[i] = byInstance[instance]
+	}
+	return ret, nil
+}
+
+// Schedule every instance of a job that isn't already placed, spreading them
+// across distinct nodes. Instances that don't fit anywhere are left pending.
+func (n *Namespace) ScheduleReplicas(ctx context.Context, backend Backend, job *Job) ([]JobStatus, error) {
+	statuses := make([]JobStatus, 0, job.GetReplicas())
+	for i := 0; i < job.GetReplicas(); i++ {
+		instance := job.Instance(i)
+
+		status, err := n.GetJobStatus(ctx, backend, instance.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if status.Node == "" {
+			status, err = n.Schedule(ctx, backend, instance)
+			if err != nil {
+				return nil, err
+			}
+		}
+		statuses = append(statuses, *status)
+	}
+	return statuses, nil
+}
+
+// Stop every instance of a job.
+func (n *Namespace) UnscheduleReplicas(ctx context.Context, backend Backend, job *Job) error {
+	statuses, err := n.GetInstanceStatuses(ctx, backend, job)
+	if err != nil {
+		return err
+	}
+
+	unscheduled := 0
+	for _, status := range statuses {
+		if status.Node == "" && status.DesiredState != JobStateRunning {
+			continue
+		}
+
+		_, instance := ParseInstanceID(status.ID)
+		err = n.Unschedule(ctx, backend, job.Instance(instance))
+		if err != nil {
+			return err
+		}
+		unscheduled++
+	}
+
+	if unscheduled == 0 {
+		return fmt.Errorf("unable to unschedule job, %s is not scheduled", job.ID)
+	}
+	return nil
+}
+
+// Change the number of instances of a job. If the job is running, instances
+// are scheduled or unscheduled to match, otherwise the new count applies the
+// next time it's started.
+func (n *Namespace) Scale(ctx context.Context, backend Backend, job *Job, replicas int) ([]JobStatus, error) {
+	if replicas < 1 {
+		return nil, fmt.Errorf("job %s must have at least 1 replica", job.ID)
+	}
+
+	statuses, err := n.GetInstanceStatuses(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
+
+	running := false
+	for _, status := range statuses {
+		if status.DesiredState == JobStateRunning {
+			running = true
+		}
+	}
+
+	// record the new count first, so if we fail part way through, starting
+	// the job again brings it up to the new count
+	job.Replicas = replicas
+	err = n.UpdateJob(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove instances we no longer want
+	for _, status := range statuses {
+		_, instance := ParseInstanceID(status.ID)
+		if instance < replicas {
+			continue
+		}
+
+		if status.Node != "" || status.DesiredState == JobStateRunning {
+			log.Println("unscheduling instance", status.ID)
+			err = n.Unschedule(ctx, backend, job.Instance(instance))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = backend.DeleteKey(ctx, getJobStatusPath(n.namespace, status.ID), false)
+		if err != nil {
+			return nil, fmt.Errorf("problem removing instance status %v", err)
+		}
+	}
+
+	if !running {
+		return n.GetInstanceStatuses(ctx, backend, job)
+	}
+	return n.ScheduleReplicas(ctx, backend, job)
+}
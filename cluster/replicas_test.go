@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func TestInstanceIDs(t *testing.T) {
+	tests := []struct {
+		instanceID string
+		jobID      string
+		instance   int
+	}{
+		{"web", "web", 0},
+		{"web@2", "web", 2},
+		{"web@foo", "web@foo", 0},
+		{"web@0", "web@0", 0},
+	}
+
+	for _, test := range tests {
+		jobID, instance := ParseInstanceID(test.instanceID)
+		if jobID != test.jobID || instance != test.instance {
+			t.Fatal("parsed", test.instanceID, "as", jobID, instance)
+		}
+	}
+
+	if InstanceID("web", 0) != "web" || InstanceID("web", 2) != "web@2" {
+		t.Fatal("instance IDs not generated correctly")
+	}
+}
+
+func getScheduledNodes(t *testing.T, statuses []JobStatus) map[string]bool {
+	nodes := make(map[string]bool)
+	for _, status := range statuses {
+		if status.Node == "" {
+			continue
+		}
+		if nodes[status.Node] {
+			t.Fatal("more than one instance scheduled on node", status.Node)
+		}
+		nodes[status.Node] = true
+	}
+	return nodes
+}
+
+func TestSchedulerSpreadsReplicasAcrossNodes(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	for _, name := range []string{"a", "b", "c"} {
+		node := &Node{Namespace: "test", Name: name, CPUShares: 1000}
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+
+	job := &Job{ID: "web", CPUShares: 100, Replicas: 2}
+	err := c.CreateJob(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	// every node has room for all of them, but each goes somewhere different
+	statuses, err := c.ScheduleReplicas(ctx, tb, job)
+	if err != nil {
+		t.Fatal("got an error scheduling replicas", err)
+	}
+	if len(statuses) != 2 || len(getScheduledNodes(t, statuses)) != 2 {
+		t.Fatal("expected 2 instances on different nodes", statuses)
+	}
+	if statuses[0].ID != "web" || statuses[1].ID != "web@1" {
+		t.Fatal("unexpected instance IDs", statuses[0].ID, statuses[1].ID)
+	}
+
+	// the node knows which instance it runs
+	node, err := c.GetNode(ctx, tb, statuses[1].Node)
+	if err != nil {
+		t.Fatal("unable to get node", err)
+	}
+	jobs, err := node.GetJobs(ctx, tb)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "web@1" {
+		t.Fatal("node should be running web@1", jobs, err)
+	}
+
+	// and won't take a second instance
+	err = node.AssignJob(ctx, tb, "web@2")
+	if err == nil {
+		t.Fatal("expected error assigning a second instance to a node")
+	}
+
+	// scaling up uses the remaining node, and beyond that leaves instances pending
+	statuses, err = c.Scale(ctx, tb, job, 4)
+	if err != nil {
+		t.Fatal("got an error scaling up", err)
+	}
+	if len(statuses) != 4 || len(getScheduledNodes(t, statuses)) != 3 {
+		t.Fatal("expected 3 of 4 instances on different nodes", statuses)
+	}
+	if !statuses[3].IsPending() {
+		t.Fatal("expected the fourth instance to be pending")
+	}
+
+	stored, err := c.GetJob(ctx, tb, job.ID)
+	if err != nil || stored.Replicas != 4 {
+		t.Fatal("scaled replicas not stored", stored, err)
+	}
+
+	// scaling down removes the extra instances entirely
+	statuses, err = c.Scale(ctx, tb, job, 1)
+	if err != nil {
+		t.Fatal("got an error scaling down", err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != "web" || !statuses[0].IsScheduled {
+		t.Fatal("expected only the first instance to remain", statuses)
+	}
+
+	nodes, err := c.GetNodes(ctx, tb)
+	if err != nil {
+		t.Fatal("unable to get nodes", err)
+	}
+	assigned := 0
+	for _, node := range nodes {
+		assigned += len(node.JobIDs)
+	}
+	if assigned != 1 {
+		t.Fatal("expected a single assignment after scaling down, found", assigned)
+	}
+
+	// stopping and destroying handles every instance
+	err = c.UnscheduleReplicas(ctx, tb, job)
+	if err != nil {
+		t.Fatal("got an error unscheduling replicas", err)
+	}
+	err = c.DestroyJob(ctx, tb, job.ID)
+	if err != nil {
+		t.Fatal("unable to destroy job", err)
+	}
+}
+
+func TestReadingInstanceStatusesDoesNotWrite(t *testing.T) {
+	ctx := context.Background()
+
+	c := NewNamespace("test")
+	backend := NewMemory()
+	job := &Job{ID: "web", UnitFile: "unit file", Replicas: 2}
+	err := c.CreateJob(ctx, backend, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	// neither instance has ever been scheduled, so neither has a status
+	statuses, err := c.GetInstanceStatuses(ctx, readOnlyBackend{backend, t}, job)
+	if err != nil || len(statuses) != 2 {
+		t.Fatal("expected a status for each instance", statuses, err)
+	}
+
+	node, err := c.GetNodeRunningJob(ctx, readOnlyBackend{backend, t}, InstanceID(job.ID, 1))
+	if err != nil || node != nil {
+		t.Fatal("expected the instance not to be running anywhere", node, err)
+	}
+}
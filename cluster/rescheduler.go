@@ -0,0 +1,302 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// How long a job status has to go unchanged before we assume whoever last
+// changed it isn't coming back to finish the job.
+const repairGracePeriod = 30 * time.Second
+
+// Move jobs off of Nodes that have stopped heartbeating, and try to place them,
+// along with any other pending jobs, on healthy Nodes. Jobs that don't fit
+// anywhere are left pending, and will be retried on the next call.
+//
+// All of the state needed to pick up where we left off is kept in the
+// backend, so this is safe to call repeatedly, from a freshly restarted
+// process, or from several processes at once.
+func (n *Namespace) Reschedule(ctx context.Context, backend Backend) ([]JobStatus, error) {
+	nodes, err := n.GetNodes(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := n.GetLiveNodeNames(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// unassign everything held by dead nodes
+	for _, node := range nodes {
+		if live[node.Name] || len(node.JobIDs) == 0 {
+			continue
+		}
+
+		log.Println("node", node.Name, "is down, evicting its jobs")
+		err = n.evictNode(ctx, backend, &node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// finish anything that was interrupted part way through
+	err = n.repairAssignments(ctx, backend, live)
+	if err != nil {
+		return nil, err
+	}
+
+	// then try to find a home for everything that's pending
+	pending, err := n.GetPendingJobIDs(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(pending))
+	for _, instanceID := range pending {
+		jobID, instance := ParseInstanceID(instanceID)
+		job, err := n.GetJob(ctx, backend, jobID)
+		if err != nil {
+			log.Println("unable to load pending job", jobID, err)
+			continue
+		}
+		jobs = append(jobs, *job.Instance(instance))
+	}
+
+	// the most important jobs get first pick of the room available, and
+	// otherwise jobs are placed first come, first served
+	sort.Stable(sort.Reverse(byPriority(jobs)))
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for i := range jobs {
+		job := &jobs[i]
+
+		log.Println("rescheduling pending job", job.ID)
+		status, err := n.Schedule(ctx, backend, job)
+		if err != nil {
+			log.Println("unable to reschedule job", job.ID, err)
+			continue
+		}
+
+		if !status.IsScheduled {
+			log.Println("leaving job", job.ID, "pending,", status.Reason)
+		}
+		statuses = append(statuses, *status)
+	}
+
+	return statuses, nil
+}
+
+// Get the IDs of all jobs, or instances of them, that should be running but
+// aren't assigned anywhere, in the order they became pending.
+func (n *Namespace) GetPendingJobIDs(ctx context.Context, backend Backend) ([]string, error) {
+	statuses, err := n.GetJobStatuses(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]JobStatus, 0)
+	for _, status := range statuses {
+		if status.IsPending() {
+			pending = append(pending, status)
+		}
+	}
+
+	sort.Sort(byPendingSince(pending))
+
+	jobIDs := make([]string, len(pending))
+	for i, status := range pending {
+		jobIDs[i] = status.ID
+	}
+	return jobIDs, nil
+}
+
+// Mark all jobs assigned to a Node as pending, and unassign them, in one go.
+// If the node or any of the jobs are modified while we're doing this, leave it
+// for the next pass.
+func (n *Namespace) evictNode(ctx context.Context, backend Backend, node *Node) error {
+	statuses := make([]*JobStatus, 0, len(node.JobIDs))
+	for _, jobID := range node.JobIDs {
+		status, err := n.GetJobStatus(ctx, backend, jobID)
+		if err != nil {
+			return err
+		}
+
+		// the status says it lives elsewhere, so this is a stale assignment
+		if status.Node != node.Name {
+			continue
+		}
+
+		status.transition(JobStatePending, "", fmt.Sprintf("node %s is down", node.Name))
+		statuses = append(statuses, status)
+	}
+
+	node.JobIDs = make([]string, 0)
+	err := saveAssignments(ctx, backend, statuses, []*Node{node})
+	if err != nil {
+		log.Println("node", node.Name, "changed while evicting jobs, will retry", err)
+	}
+
+	return nil
+}
+
+// Bring the job lists of every Node in line with job statuses. Statuses are
+// saved along with their nodes, so they should only disagree if something
+// else has changed one of them. Even so, we only touch statuses that have
+// been left alone for a while.
+func (n *Namespace) repairAssignments(ctx context.Context, backend Backend, live map[string]bool) error {
+	nodes, err := n.GetNodes(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := n.GetJobStatuses(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]JobStatus)
+	for _, status := range statuses {
+		byID[status.ID] = status
+	}
+
+	// find every node each job is listed on
+	listedOn := make(map[string][]string)
+	for _, node := range nodes {
+		for _, jobID := range node.JobIDs {
+			listedOn[jobID] = append(listedOn[jobID], node.Name)
+
+			// assignments from before statuses existed get adopted
+			if _, ok := byID[jobID]; !ok {
+				status, err := n.adoptJobStatus(ctx, backend, jobID)
+				if err != nil {
+					return err
+				}
+				byID[jobID] = *status
+			}
+		}
+	}
+
+	for jobID, status := range byID {
+		if time.Since(status.LastTransitionTime) < repairGracePeriod {
+			continue
+		}
+
+		// reload so we have an index to make our writes conditional on
+		current, err := n.GetJobStatus(ctx, backend, jobID)
+		if err != nil {
+			return err
+		}
+		status = *current
+		if time.Since(status.LastTransitionTime) < repairGracePeriod {
+			continue
+		}
+
+		// drop the job from nodes that shouldn't have it
+		listed := false
+		for _, nodeName := range listedOn[jobID] {
+			if nodeName == status.Node && status.DesiredState == JobStateRunning {
+				listed = true
+				continue
+			}
+
+			log.Println("removing stale assignment of job", jobID, "from node", nodeName)
+			err = n.unassign(ctx, backend, nodeName, jobID)
+			if err != nil {
+				return err
+			}
+		}
+
+		if status.Node == "" {
+			continue
+		}
+
+		switch {
+		case status.DesiredState != JobStateRunning:
+			// we were stopping it
+			status.transition(JobStateUnscheduled, "", "stopped")
+		case !live[status.Node]:
+			// it was claimed by a node that's gone
+			status.transition(JobStatePending, "", fmt.Sprintf("node %s is down", status.Node))
+		case !listed:
+			// it was claimed, but the node was never assigned it
+			log.Println("finishing assignment of job", jobID, "to node", status.Node)
+			node, err := n.GetNode(ctx, backend, status.Node)
+			if err != nil {
+				return err
+			}
+			err = node.AssignJob(ctx, backend, jobID)
+			if err != nil {
+				log.Println("unable to finish assignment of job", jobID, err)
+			}
+			continue
+		default:
+			continue
+		}
+
+		err = status.SaveIfNotModified(ctx, backend)
+		if err != nil {
+			log.Println("job", jobID, "changed while repairing it, will retry", err)
+		}
+	}
+
+	return nil
+}
+
+// Save the status of a job that was assigned to a Node before statuses
+// existed, so the Node isn't needed to find it again. Statuses aren't saved
+// for jobs that no longer exist, and if somebody else saved one in the
+// meantime, theirs wins.
+func (n *Namespace) adoptJobStatus(ctx context.Context, backend Backend, jobID string) (*JobStatus, error) {
+	status, stored, err := n.findJobStatus(ctx, backend, jobID)
+	if err != nil || stored {
+		return status, err
+	}
+
+	parentID, _ := ParseInstanceID(jobID)
+	jobExists, err := backend.CheckIfKeyExists(ctx, getJobPath(n.namespace, parentID))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing job %v", err)
+	}
+	if !jobExists {
+		return status, nil
+	}
+
+	err = status.SaveIfNotModified(ctx, backend)
+	if IsConflict(err) {
+		return n.GetJobStatus(ctx, backend, jobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (n *Namespace) unassign(ctx context.Context, backend Backend, nodeName string, jobID string) error {
+	node, err := n.GetNode(ctx, backend, nodeName)
+	if err != nil {
+		return err
+	}
+
+	err = node.UnassignJob(ctx, backend, jobID)
+	if err != nil {
+		log.Println("unable to unassign job", jobID, "from node", nodeName, err)
+	}
+	return nil
+}
+
+// Sorts statuses by when they last transitioned, then by ID.
+type byPendingSince []JobStatus
+
+func (b byPendingSince) Len() int      { return len(b) }
+func (b byPendingSince) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPendingSince) Less(i, j int) bool {
+	if !b[i].LastTransitionTime.Equal(b[j].LastTransitionTime) {
+		return b[i].LastTransitionTime.Before(b[j].LastTransitionTime)
+	}
+	return b[i].ID < b[j].ID
+}
@@ -0,0 +1,260 @@
+package cluster
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func TestReschedulerMovesJobsOffDeadNodes(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	// create a node that will die, and one that will stay healthy
+	dying := &Node{Namespace: "test", Name: "dying", CPUShares: 1000}
+	healthy := &Node{Namespace: "test", Name: "healthy", CPUShares: 300}
+
+	err := dying.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+	err = healthy.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	c := NewNamespace("test")
+
+	// one job that will fit elsewhere, and one that won't
+	small := &Job{ID: "small", CPUShares: 100}
+	big := &Job{ID: "big", CPUShares: 800}
+	for _, job := range []*Job{small, big} {
+		err = c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+		err = dying.AssignJob(ctx, tb, job.ID)
+		if err != nil {
+			t.Fatal("unable to assign job", err)
+		}
+	}
+
+	// nothing happens while everything is alive
+	statuses, err := c.Reschedule(ctx, tb)
+	if err != nil {
+		t.Fatal("error rescheduling", err)
+	}
+	if len(statuses) != 0 {
+		t.Fatal("rescheduled jobs from a healthy node", statuses)
+	}
+
+	// kill the node
+	delete(tb, "/kubernotes/clusters/test/heartbeats/dying")
+
+	statuses, err = c.Reschedule(ctx, tb)
+	if err != nil {
+		t.Fatal("error rescheduling", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatal("expected to try rescheduling 2 jobs, got", statuses)
+	}
+
+	_ = dying.Load(ctx, tb)
+	if len(dying.JobIDs) != 0 {
+		t.Fatal("dead node should have no jobs left", dying.JobIDs)
+	}
+
+	node, err := c.GetNodeRunningJob(ctx, tb, small.ID)
+	if err != nil || node == nil || node.Name != healthy.Name {
+		t.Fatal("small job should have moved to the healthy node", node, err)
+	}
+
+	// the big job doesn't fit anywhere, so it's left pending
+	pending, err := c.GetPendingJobIDs(ctx, tb)
+	if err != nil {
+		t.Fatal("error getting pending jobs", err)
+	}
+	if len(pending) != 1 || pending[0] != big.ID {
+		t.Fatal("expected big job to be pending, got", pending)
+	}
+
+	// bring up a node with room, and it gets picked up
+	roomy := &Node{Namespace: "test", Name: "roomy", CPUShares: 1000}
+	err = roomy.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	_, err = c.Reschedule(ctx, tb)
+	if err != nil {
+		t.Fatal("error rescheduling", err)
+	}
+
+	node, err = c.GetNodeRunningJob(ctx, tb, big.ID)
+	if err != nil || node == nil || node.Name != roomy.Name {
+		t.Fatal("big job should have been scheduled on the new node", node, err)
+	}
+
+	pending, err = c.GetPendingJobIDs(ctx, tb)
+	if err != nil || len(pending) != 0 {
+		t.Fatal("expected no pending jobs", pending, err)
+	}
+}
+
+func TestStoppingPendingJobClearsIt(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+	c := NewNamespace("test")
+
+	job := &Job{ID: "foo"}
+	err := c.CreateJob(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	// there are no nodes, so starting the job leaves it pending
+	status, err := c.Schedule(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to schedule job", err)
+	}
+	if !status.IsPending() || status.ObservedState != JobStatePending {
+		t.Fatal("expected job to be pending", status)
+	}
+
+	err = c.Unschedule(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to stop pending job", err)
+	}
+
+	pending, err := c.GetPendingJobIDs(ctx, tb)
+	if err != nil || len(pending) != 0 {
+		t.Fatal("expected no pending jobs", pending, err)
+	}
+
+	// stopping it again is an error
+	err = c.Unschedule(ctx, tb, job)
+	if err == nil {
+		t.Fatal("allowed to stop a job that isn't running")
+	}
+}
+
+func TestReschedulerRepairsInterruptedAssignments(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+	c := NewNamespace("test")
+
+	node := &Node{Namespace: "test", Name: "testnode", CPUShares: 1000}
+	err := node.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	for _, id := range []string{"claimed", "stopping"} {
+		err = c.CreateJob(ctx, tb, &Job{ID: id})
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+	}
+
+	// a job claimed for the node, but never assigned to it
+	claimed := &JobStatus{
+		ID:           "claimed",
+		Namespace:    "test",
+		DesiredState: JobStateRunning,
+	}
+	claimed.transition(JobStateScheduled, node.Name, "")
+	claimed.LastTransitionTime = claimed.LastTransitionTime.Add(-repairGracePeriod)
+	err = claimed.SaveIfNotModified(ctx, tb)
+	if err != nil {
+		t.Fatal("unable to save job status", err)
+	}
+
+	// and a job that was being stopped, but is still assigned
+	stopping := &JobStatus{
+		ID:           "stopping",
+		Namespace:    "test",
+		DesiredState: JobStateStopped,
+	}
+	stopping.transition(JobStateScheduled, node.Name, "")
+	stopping.LastTransitionTime = stopping.LastTransitionTime.Add(-repairGracePeriod)
+	err = stopping.SaveIfNotModified(ctx, tb)
+	if err != nil {
+		t.Fatal("unable to save job status", err)
+	}
+	err = node.AssignJob(ctx, tb, "stopping")
+	if err != nil {
+		t.Fatal("unable to assign job", err)
+	}
+
+	_, err = c.Reschedule(ctx, tb)
+	if err != nil {
+		t.Fatal("error rescheduling", err)
+	}
+
+	_ = node.Load(ctx, tb)
+	if len(node.JobIDs) != 1 || node.JobIDs[0] != "claimed" {
+		t.Fatal("expected node to only be running the claimed job", node.JobIDs)
+	}
+
+	status, err := c.GetJobStatus(ctx, tb, "stopping")
+	if err != nil || status.Node != "" || status.ObservedState != JobStateUnscheduled {
+		t.Fatal("expected stopping job to be unscheduled", status, err)
+	}
+}
+
+func TestReschedulerPlacesPendingJobsByPriorityThenAge(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+	c := NewNamespace("test")
+
+	// with nowhere to run, everything is left pending in the order started
+	jobs := []*Job{
+		{ID: "b-first", CPUShares: 100},
+		{ID: "a-second", CPUShares: 100},
+		{ID: "c-urgent", CPUShares: 100, Priority: 1},
+	}
+	for _, job := range jobs {
+		err := c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+		_, err = c.Schedule(ctx, tb, job)
+		if err != nil {
+			t.Fatal("got an error scheduling job", job.ID, err)
+		}
+	}
+
+	pending, err := c.GetPendingJobIDs(ctx, tb)
+	if err != nil {
+		t.Fatal("unable to get pending jobs", err)
+	}
+	if len(pending) != 3 || pending[0] != "b-first" || pending[1] != "a-second" || pending[2] != "c-urgent" {
+		t.Fatal("expected pending jobs in the order they were started", pending)
+	}
+
+	// room for two, which go to the urgent job, then the oldest
+	node := &Node{Namespace: "test", Name: "node", CPUShares: 200}
+	err = node.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	_, err = c.Reschedule(ctx, tb)
+	if err != nil {
+		t.Fatal("got an error rescheduling", err)
+	}
+
+	pending, err = c.GetPendingJobIDs(ctx, tb)
+	if err != nil {
+		t.Fatal("unable to get pending jobs", err)
+	}
+	if len(pending) != 1 || pending[0] != "a-second" {
+		t.Fatal("expected only the newest, least urgent job to be left pending", pending)
+	}
+}
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// What the agent running a job last saw it doing, as opposed to what the
+// scheduler asked for. Each node reports the jobs it runs, so a job that has
+// just moved may briefly have a state on both its old node and its new one.
+type RunState struct {
+	ID   string
+	Node string
+
+	// As systemd has them, such as active and running, or failed and failed.
+	ActiveState string
+	SubState    string
+
+	// The job's main process, if it's running.
+	MainPID int
+
+	// How many times the job has been restarted since it was started, and
+	// how its main process last exited.
+	Restarts int
+	ExitCode int
+
+	// When the job's main process last started, and last exited.
+	StartedAt time.Time
+	ExitedAt  time.Time
+}
+
+// Deserialize a RunState from JSON string.
+func (s *RunState) Deserialize(jsonBlob string) error {
+	err := json.Unmarshal([]byte(jsonBlob), s)
+	return err
+}
+
+// Serialize a RunState to JSON string.
+func (s *RunState) Serialize() (string, error) {
+	jsonBlob, err := json.Marshal(s)
+	return string(jsonBlob), err
+}
+
+// Determine if the job was seen up and running.
+func (s *RunState) IsRunning() bool {
+	return s.ActiveState == "active"
+}
+
+// Determine if the job has failed, and won't start again unless it's asked
+// to. A job that exited cleanly hasn't.
+func (s *RunState) IsFailed() bool {
+	return s.ActiveState == "failed"
+}
+
+// Describe the state the way systemctl does, such as "active (running)".
+func (s *RunState) String() string {
+	return fmt.Sprintf("%s (%s)", s.ActiveState, s.SubState)
+}
+
+// Retrieve the run states a node has reported, ordered by job ID.
+func (n *Namespace) GetRunStates(ctx context.Context, backend Backend, nodeName string) ([]RunState, error) {
+
+	// nothing has been reported until the node runs its first job
+	exists, err := backend.CheckIfKeyExists(ctx, getRunStatesPath(n.namespace, nodeName))
+	if err != nil {
+		return nil, fmt.Errorf("problem accessing run states %v", err)
+	}
+	if !exists {
+		return []RunState{}, nil
+	}
+
+	states, _, err := backend.ReadKeyChildren(ctx, getRunStatesPath(n.namespace, nodeName))
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving run states %v", err)
+	}
+
+	ret := make([]RunState, len(states))
+	for i, json := range states {
+		err := ret[i].Deserialize(json)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Report what a node has seen of a job it runs, replacing what it last
+// reported.
+func (n *Namespace) SaveRunState(ctx context.Context, backend Backend, state *RunState) error {
+	json, err := state.Serialize()
+	if err != nil {
+		return fmt.Errorf("problem serializing run state %v", err)
+	}
+
+	err = backend.WriteKey(ctx, getRunStatePath(n.namespace, state.Node, state.ID), json, false, etcd.PrevIgnore, 0)
+	if err != nil {
+		return fmt.Errorf("problem saving run state %v", err)
+	}
+	return nil
+}
+
+// Remove what a node reported about a job, once it no longer runs it.
+func (n *Namespace) DeleteRunState(ctx context.Context, backend Backend, nodeName string, jobID string) error {
+	err := backend.DeleteKey(ctx, getRunStatePath(n.namespace, nodeName, jobID), false)
+	if err != nil {
+		return fmt.Errorf("problem deleting run state %v", err)
+	}
+	return nil
+}
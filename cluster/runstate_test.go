@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestRunStates(t *testing.T) {
+	ctx := context.Background()
+	c := NewNamespace("test")
+	backend := NewMemory()
+
+	states, err := c.GetRunStates(ctx, backend, "testnode")
+	if err != nil || len(states) != 0 {
+		t.Fatal("expected no run states before any are reported", states, err)
+	}
+
+	for _, state := range []*RunState{
+		{ID: "b", Node: "testnode", ActiveState: "failed", SubState: "failed", ExitCode: 1},
+		{ID: "a", Node: "testnode", ActiveState: "active", SubState: "running", MainPID: 42},
+		{ID: "a", Node: "othernode", ActiveState: "inactive", SubState: "dead"},
+	} {
+		err = c.SaveRunState(ctx, backend, state)
+		if err != nil {
+			t.Fatal("unable to save run state", err)
+		}
+	}
+
+	// each node's reports are kept apart
+	states, err = c.GetRunStates(ctx, backend, "testnode")
+	if err != nil {
+		t.Fatal("unable to get run states", err)
+	}
+	if len(states) != 2 || states[0].ID != "a" || states[1].ID != "b" {
+		t.Fatal("expected the node's run states, ordered by job", states)
+	}
+	if !states[0].IsRunning() || states[0].MainPID != 42 || states[0].String() != "active (running)" {
+		t.Fatal("unexpected run state", states[0])
+	}
+	if states[1].IsRunning() || states[1].ExitCode != 1 {
+		t.Fatal("unexpected run state", states[1])
+	}
+
+	err = c.DeleteRunState(ctx, backend, "testnode", "a")
+	if err != nil {
+		t.Fatal("unable to delete run state", err)
+	}
+	states, _ = c.GetRunStates(ctx, backend, "testnode")
+	if len(states) != 1 || states[0].ID != "b" {
+		t.Fatal("expected only b to be left", states)
+	}
+}
@@ -3,127 +3,335 @@ package cluster
 import (
 	"fmt"
 	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
-// Represents the assigned state of a job to a node.
-type JobStatus struct {
-	ID          string
-	Node        string
-	IsScheduled bool
-}
+// How many times to retry assigning a job to a node that was modified by
+// somebody else, and how long to wait before the first retry. The wait
+// doubles with each retry.
+const (
+	assignRetries = 5
+	assignBackoff = 50 * time.Millisecond
+)
 
-// Stop a job from running on the node that it's scheduled on. This method is
-// really naive, and we assume that any given job is only running in a single
-// place, if at all.
-func (n *Namespace) Unschedule(backend Backend, job *Job) error {
-	// loop through all nodes in the namespace
-	log.Println("getting nodes in namespace that might be running this job")
-	nodes, err := n.GetNodes(backend)
+// Stop a job from running on the node that it's scheduled on. Replicated jobs
+// are unscheduled one instance at a time, see UnscheduleReplicas.
+func (n *Namespace) Unschedule(ctx context.Context, backend Backend, job *Job) error {
+	status, err := n.GetJobStatus(ctx, backend, job.ID)
 	if err != nil {
 		return err
 	}
 
-	found := false
+	if status.Node == "" && status.DesiredState != JobStateRunning {
+		return fmt.Errorf("unable to unschedule job, %s is not scheduled", job.ID)
+	}
+
+	// stop the job and take it off of its node in one go
+	nodes := make([]*Node, 0, 1)
+	if status.Node != "" {
+		log.Println("unassigning job", job.ID, "from node", status.Node)
+		node, err := n.GetNode(ctx, backend, status.Node)
+		if err != nil {
+			return err
+		}
+		node.removeJob(job.ID)
+		nodes = append(nodes, node)
+	}
+
+	status.DesiredState = JobStateStopped
+	status.transition(JobStateUnscheduled, "", "stopped")
+	err = saveAssignments(ctx, backend, []*JobStatus{status}, nodes)
+	if IsConflict(err) {
+		return fmt.Errorf("job %s was modified while unscheduling %v", job.ID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to unschedule job %v", err)
+	}
+	return nil
+}
+
+// Schedule a job on the cluster. Find a node with available resources, and assign
+// it the job, saving the node in the process. If nowhere has room, the job is
+// left pending. Replicated jobs are scheduled one instance at a time, see
+// ScheduleReplicas.
+func (n *Namespace) Schedule(ctx context.Context, backend Backend, job *Job) (*JobStatus, error) {
+	status, err := n.GetJobStatus(ctx, backend, job.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, node := range nodes {
-		log.Println("checking if", node.Name, "is running this job")
+	// if the job is already scheduled, bail with an error
+	if status.Node != "" {
+		return status, fmt.Errorf("%s already scheduled", job.ID)
+	}
+
+	status.DesiredState = JobStateRunning
 
-		// see if any of them are assigned the provided job
-		for i, id := range node.JobIDs {
+	candidates, decisions, err := n.findCandidates(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
 
-			// if they are assigned this job, remove it, and save the node
-			if id == job.ID {
-				node.JobIDs = append(node.JobIDs[:i], node.JobIDs[i+1:]...)
-				err = node.UnassignJob(backend, job.ID)
-				if err != nil {
-					return fmt.Errorf("unable to unschedule job %v", err)
-				}
+	for _, candidate := range candidates {
+		node := candidate.Node
 
-				// we're being a little naive about jobs only running in a single place
-				// but that's how it is, so bounce out of here
-				found = true
-				break
+		rejection, err := n.assign(ctx, backend, job, status, &node)
+		if IsConflict(err) {
+			return nil, fmt.Errorf("job %s was modified while scheduling %v", job.ID, err)
+		}
+		if err != nil || rejection != "" {
+			// if we have trouble scheduling on a node we can look for others
+			if err != nil {
+				log.Println("unable to assign job", job.ID, "to node", node.Name, err)
+				rejection = fmt.Sprintf("unable to assign to %s", node.Name)
+			} else {
+				log.Println("node", node.Name, "NOT able to run job", job.ID, "any longer", rejection)
 			}
+			rejectDecision(decisions, node.Name, rejection)
+			continue
 		}
 
-		// again, we're only assuming the job exists in a single place, so bounce out
-		if found {
-			break
+		log.Println("placed job", job.ID, "on node", node.Name)
+		return status, nil
+	}
+
+	// nowhere has room, so see if we can make some by evicting lower priority
+	// jobs
+	preemption, err := n.planPreemption(ctx, backend, job)
+	if err != nil {
+		return nil, err
+	}
+	if preemption != nil {
+		err = n.preempt(ctx, backend, job, status, preemption)
+		if err == nil {
+			log.Println("placed job", job.ID, "on node", preemption.Node.Name, "by preempting", preemption.VictimIDs())
+			return status, nil
 		}
+		log.Println("unable to preempt jobs for job", job.ID, err)
 	}
 
-	// successfully unscheduled
-	if found {
-		return nil
+	// nowhere to put it right now, so leave it for the rescheduler, noting why
+	// each node turned it down
+	status.transition(JobStatePending, "", pendingReason(decisions))
+	err = status.SaveIfNotModified(ctx, backend)
+	if err != nil {
+		return nil, fmt.Errorf("job %s was modified while scheduling %v", job.ID, err)
 	}
 
-	return fmt.Errorf("unable to unschedule job")
+	return status, nil
 }
 
-// Schedule a job on the cluster. Find a node with available resources, and assign
-// it the job, saving the node in the process.
-func (n *Namespace) Schedule(backend Backend, job *Job) (*JobStatus, error) {
-	status := &JobStatus{
-		ID:          job.ID,
-		IsScheduled: false,
+// Assign a job to a node, saving its status and the node together. If
+// somebody else modifies the node first, such as another scheduler placing a
+// job there, reload it and check it can still run the job before trying
+// again. If it can't, the reason why is returned. If somebody else modifies
+// the status, they're scheduling the job too, so a ConflictError is returned
+// and we leave it to them.
+func (n *Namespace) assign(ctx context.Context, backend Backend, job *Job, status *JobStatus, node *Node) (string, error) {
+	backoff := assignBackoff
+	for retry := 0; ; retry++ {
+		err := node.addJob(job.ID)
+		if err != nil {
+			return "", err
+		}
+
+		status.transition(JobStateScheduled, node.Name, "")
+		err = saveAssignments(ctx, backend, []*JobStatus{status}, []*Node{node})
+		if !IsConflict(err) {
+			return "", err
+		}
+
+		current, loadErr := n.GetJobStatus(ctx, backend, job.ID)
+		if loadErr != nil {
+			return "", loadErr
+		}
+		if current.LastModifiedIndex != status.LastModifiedIndex {
+			return "", err
+		}
+		if retry == assignRetries {
+			return "", fmt.Errorf("node %s kept being modified %v", node.Name, err)
+		}
+
+		// wait a little, and a little longer each time, so we don't keep
+		// colliding with whoever else is writing to the node
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		log.Println("node", node.Name, "was modified while assigning job", job.ID, "retrying in", wait)
+		time.Sleep(wait)
+		backoff *= 2
+
+		// start from a clean slate, so nothing we had in memory survives
+		*node = Node{Namespace: node.Namespace, Name: node.Name}
+		err = node.Load(ctx, backend)
+		if err != nil {
+			return "", err
+		}
+
+		_, rejection, err := n.checkNode(ctx, backend, job, node)
+		if err != nil || rejection != "" {
+			return rejection, err
+		}
 	}
+}
 
-	// loop through all the nodes in the namespace
-	log.Println("getting nodes in namespace available for scheduling")
-	nodes, err := n.GetNodes(backend)
+// Record that a node turned a job down, after it was ranked as a candidate.
+func rejectDecision(decisions []NodeDecision, nodeName string, reason string) {
+	for i := range decisions {
+		if decisions[i].Node == nodeName {
+			decisions[i].Rank = 0
+			decisions[i].Reason = reason
+		}
+	}
+}
+
+// Decide which nodes are able to run a job, returning those that are ordered
+// from most to least preferred, along with the decision made about every
+// node.
+func (n *Namespace) findCandidates(ctx context.Context, backend Backend, job *Job) ([]Candidate, []NodeDecision, error) {
+	strategyName, err := n.getStrategyName(ctx, backend, job)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	strategy, err := GetStrategy(strategyName)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// this is a really not great way to do this, but it's the simplest way
-	// to ensure we only run each job once. a better approach would be to store
-	// the assignment state of the job.
-	alreadyRunning := false
-	for _, node := range nodes {
-		for _, jobID := range node.JobIDs {
-			if jobID == job.ID {
-				alreadyRunning = true
-				break
-			}
-		}
+	log.Println("getting nodes in namespace available for scheduling")
+	nodes, err := n.GetNodes(ctx, backend)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// if the job is already scheduled, bail with an error
-	if alreadyRunning {
-		status.IsScheduled = true
-		return status, fmt.Errorf("%s already scheduled", job.ID)
+	live, err := n.GetLiveNodeNames(ctx, backend)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	for _, node := range nodes {
-		// grab the free resources (available minus used by jobs)
-		log.Println("determining free resources for", node.Name)
-		resources, err := node.GetFreeResources(backend)
+	candidates := make([]Candidate, 0, len(nodes))
+	decisions := make([]NodeDecision, len(nodes))
+	for i, node := range nodes {
+		decisions[i].Node = node.Name
+
+		// nodes that have stopped heartbeating can't be given new work
+		if !live[node.Name] {
+			decisions[i].Reason = "node is down"
+			continue
+		}
+
+		// reload the node so our assignment is conditional on it not changing
+		err = node.Load(ctx, backend)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		// A more interesting/advanced scheduler could do something like look
-		// for resource availability across all nodes, and see if moving jobs
-		// elsewhere would enable an otherwise overloaded node to handle a job.
-		//
-		// For now, we'll only consider intra-node resouce availability.
-		if resources.CPUShares >= job.CPUShares &&
-			resources.BlockIOShares >= job.BlockIOWeight &&
-			resources.MemoryMegabytes >= job.MemoryLimitMegabytes {
+		resources, rejection, err := n.checkNode(ctx, backend, job, &node)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rejection != "" {
+			log.Println("node", node.Name, "NOT able to run job", job.ID, rejection)
+			decisions[i].Reason = rejection
+			continue
+		}
 
-			log.Println("node", node.Name, "able to run job", job.ID)
-			err = node.AssignJob(backend, job.ID)
-			if err != nil {
-				// if we have trouble scheduling on a node we can look for others
+		log.Println("node", node.Name, "able to run job", job.ID)
+		candidates = append(candidates, Candidate{Node: node, Free: *resources})
+	}
+
+	// let the strategy decide which of the nodes with room is best, then
+	// prefer the nodes that satisfy more of the job's preferences
+	strategy.Rank(job, candidates)
+	sort.Stable(byPreference{job: job, candidates: candidates})
+
+	for rank, candidate := range candidates {
+		for i := range decisions {
+			if decisions[i].Node != candidate.Node.Name {
 				continue
 			}
-			status.Node = node.Name
-			status.IsScheduled = true
-			break
-		} else {
-			log.Println("node", node.Name, "NOT able to run job", job.ID)
+			decisions[i].Rank = rank + 1
+			decisions[i].Reason = fmt.Sprintf("ranked %d of %d by %s strategy", rank+1, len(candidates), strategyName)
+			if len(job.Prefers) > 0 {
+				decisions[i].Reason += fmt.Sprintf(", satisfying %d of %d preferences",
+					preferred(job, &candidate), len(job.Prefers))
+			}
 		}
 	}
 
-	return status, nil
+	return candidates, decisions, nil
+}
+
+// Explain why a job couldn't be placed anywhere.
+func pendingReason(decisions []NodeDecision) string {
+	if len(decisions) == 0 {
+		return "unable to find a node to run job, no nodes have joined"
+	}
+
+	rejections := make([]string, len(decisions))
+	for i, decision := range decisions {
+		rejections[i] = fmt.Sprintf("%s: %s", decision.Node, decision.Reason)
+	}
+	return fmt.Sprintf("unable to find a node to run job, %s", strings.Join(rejections, "; "))
+}
+
+// Determine if a node can run a job. If it can, its free resources are
+// returned, otherwise the rule that rules it out is.
+func (n *Namespace) checkNode(ctx context.Context, backend Backend, job *Job, node *Node) (*Resources, string, error) {
+	// replicas of a job have to run on different nodes
+	for _, running := range node.JobIDs {
+		if running == job.ID {
+			return nil, fmt.Sprintf("already running job %s", job.ID), nil
+		}
+		if sameJob(running, job.ID) {
+			return nil, fmt.Sprintf("already running replica %s of job", running), nil
+		}
+	}
+
+	// only consider nodes the job is allowed to run on
+	matches, failed := node.MatchesConstraints(job.Requires)
+	if !matches {
+		return nil, fmt.Sprintf("does not satisfy constraint %s", failed), nil
+	}
+
+	jobs, err := node.GetJobs(ctx, backend)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// keep jobs together or apart, as they've asked
+	err = checkAffinity(job, jobs)
+	if err != nil {
+		return nil, err.Error(), nil
+	}
+
+	// A more interesting/advanced scheduler could do something like look
+	// for resource availability across all nodes, and see if moving jobs
+	// elsewhere would enable an otherwise overloaded node to handle a job.
+	//
+	// For now, we'll only consider intra-node resouce availability.
+	resources := node.freeResources(jobs)
+	shortfall := resources.shortfall(job)
+	if shortfall != "" {
+		return nil, shortfall, nil
+	}
+
+	return resources, "", nil
+}
+
+// Get the name of the strategy for scheduling a job, falling back to the
+// namespace's.
+func (n *Namespace) getStrategyName(ctx context.Context, backend Backend, job *Job) (string, error) {
+	if job.Strategy != "" {
+		return job.Strategy, nil
+	}
+
+	config, err := n.GetConfig(ctx, backend)
+	if err != nil {
+		return "", err
+	}
+	return config.Strategy, nil
 }
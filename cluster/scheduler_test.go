@@ -1,23 +1,30 @@
 package cluster
 
 import (
+	"fmt"
 	"testing"
 
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/testtools"
+	"github.com/sofuture/kubernotes/txn"
 )
 
 func TestSchedulerAssignJobs(t *testing.T) {
+	ctx := context.Background()
+
 	tb := testtools.TestBackend{}
 
 	// create some nodes
 	node := &Node{Namespace: "test", Name: "testnode", CPUShares: 1000}
 	node1 := &Node{Namespace: "test", Name: "testnode1", CPUShares: 200}
 
-	err := node.JoinCluster(tb)
+	err := node.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
-	err = node1.JoinCluster(tb)
+	err = node1.JoinCluster(ctx, tb)
 	if err != nil {
 		t.Fatal("failed to join cluster", err)
 	}
@@ -27,25 +34,25 @@ func TestSchedulerAssignJobs(t *testing.T) {
 
 	// create  jobs
 	job1 := &Job{ID: "job1", CPUShares: 500}
-	err = c.CreateJob(tb, job1)
+	err = c.CreateJob(ctx, tb, job1)
 	if err != nil {
 		t.Fatal("unable to create job", err)
 	}
 
 	job2 := &Job{ID: "job2", CPUShares: 100}
-	err = c.CreateJob(tb, job2)
+	err = c.CreateJob(ctx, tb, job2)
 	if err != nil {
 		t.Fatal("unable to create job", err)
 	}
 
 	job3 := &Job{ID: "job3", CPUShares: 5000}
-	err = c.CreateJob(tb, job3)
+	err = c.CreateJob(ctx, tb, job3)
 	if err != nil {
 		t.Fatal("unable to create job", err)
 	}
 
 	// schedule job that only fits on one node
-	status, err := c.Schedule(tb, job1)
+	status, err := c.Schedule(ctx, tb, job1)
 	if err != nil {
 		t.Fatal("got an error scheduling job1", err)
 	}
@@ -58,19 +65,19 @@ func TestSchedulerAssignJobs(t *testing.T) {
 		t.Fatal("should have scheduled job on", node.Name, "but instead it's on", status.Node)
 	}
 
-	_ = node.Load(tb)
-	jobs, _ := node.GetJobs(tb)
+	_ = node.Load(ctx, tb)
+	jobs, _ := node.GetJobs(ctx, tb)
 	if len(jobs) != 1 {
 		t.Fatal("node assigned doesn't have scheduled job")
 	}
 
-	jobs, _ = node1.GetJobs(tb)
+	jobs, _ = node1.GetJobs(ctx, tb)
 	if len(jobs) > 0 {
 		t.Fatal("node should be empty, but has a scheduled job")
 	}
 
 	// schedule job that fits on either node
-	status, err = c.Schedule(tb, job2)
+	status, err = c.Schedule(ctx, tb, job2)
 	if err != nil {
 		t.Fatal("got an error scheduling job2", err)
 	}
@@ -79,18 +86,18 @@ func TestSchedulerAssignJobs(t *testing.T) {
 		t.Fatal("unable to schedule job2")
 	}
 
-	_ = node.Load(tb)
-	_ = node1.Load(tb)
+	_ = node.Load(ctx, tb)
+	_ = node1.Load(ctx, tb)
 
 	found := false
-	jobs, _ = node.GetJobs(tb)
+	jobs, _ = node.GetJobs(ctx, tb)
 	for _, job := range jobs {
 		if job.ID == job2.ID {
 			found = true
 		}
 	}
 
-	jobs, _ = node1.GetJobs(tb)
+	jobs, _ = node1.GetJobs(ctx, tb)
 	for _, job := range jobs {
 		if job.ID == job2.ID {
 			found = true
@@ -102,7 +109,7 @@ func TestSchedulerAssignJobs(t *testing.T) {
 	}
 
 	// schedule job that fits nowhere
-	status, err = c.Schedule(tb, job3)
+	status, err = c.Schedule(ctx, tb, job3)
 	if err != nil {
 		t.Fatal("got an error scheduling job3", err)
 	}
@@ -116,21 +123,287 @@ func TestSchedulerAssignJobs(t *testing.T) {
 	}
 
 	// unschedule job2 from wherever it is
-	err = c.Unschedule(tb, job2)
+	err = c.Unschedule(ctx, tb, job2)
 	if err != nil {
 		t.Fatal("got an error unscheduling job2", err)
 	}
 
-	_ = node.Load(tb)
-	_ = node1.Load(tb)
+	_ = node.Load(ctx, tb)
+	_ = node1.Load(ctx, tb)
 
-	jobs, _ = node.GetJobs(tb)
+	jobs, _ = node.GetJobs(ctx, tb)
 	if len(jobs) != 1 {
 		t.Fatal("expected node to still have job1, and no other jobs")
 	}
 
-	jobs, _ = node1.GetJobs(tb)
+	jobs, _ = node1.GetJobs(ctx, tb)
 	if len(jobs) != 0 {
 		t.Fatal("expected node to have no assigned jobs")
 	}
 }
+
+func TestSchedulerSkipsDeadNodes(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	// create a big node that's dead, and a small one that's alive
+	dead := &Node{Namespace: "test", Name: "dead", CPUShares: 1000}
+	alive := &Node{Namespace: "test", Name: "alive", CPUShares: 200}
+
+	err := dead.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+	err = alive.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	delete(tb, "/kubernotes/clusters/test/heartbeats/dead")
+
+	c := NewNamespace("test")
+
+	// a job that only fits on the dead node can't be scheduled
+	big := &Job{ID: "big", CPUShares: 500}
+	err = c.CreateJob(ctx, tb, big)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err := c.Schedule(ctx, tb, big)
+	if err != nil {
+		t.Fatal("got an error scheduling big", err)
+	}
+	if status.IsScheduled {
+		t.Fatal("should not have scheduled job on dead node")
+	}
+
+	// a job that fits on either goes to the live one
+	small := &Job{ID: "small", CPUShares: 100}
+	err = c.CreateJob(ctx, tb, small)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err = c.Schedule(ctx, tb, small)
+	if err != nil {
+		t.Fatal("got an error scheduling small", err)
+	}
+	if status.Node != alive.Name {
+		t.Fatal("should have scheduled job on", alive.Name, "but instead it's on", status.Node)
+	}
+}
+
+func TestSchedulerHonorsConstraints(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	nodes := []*Node{
+		{Namespace: "test", Name: "a", CPUShares: 1000, Labels: map[string]string{"arch": "arm", "zone": "east"}},
+		{Namespace: "test", Name: "b", CPUShares: 1000, Labels: map[string]string{"arch": "amd64", "zone": "west"}},
+		{Namespace: "test", Name: "c", CPUShares: 1000, Labels: map[string]string{"arch": "amd64", "zone": "east"}},
+	}
+	for _, node := range nodes {
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+
+	// only amd64 nodes qualify, and of those the one in the east is preferred
+	job := &Job{
+		ID:        "job",
+		CPUShares: 100,
+		Requires:  []Constraint{{"arch", ConstraintEqual, "amd64"}},
+		Prefers:   []Constraint{{"zone", ConstraintEqual, "east"}},
+	}
+	err := c.CreateJob(ctx, tb, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err := c.Schedule(ctx, tb, job)
+	if err != nil {
+		t.Fatal("got an error scheduling job", err)
+	}
+	if status.Node != "c" {
+		t.Fatal("should have scheduled job on c but instead it's on", status.Node)
+	}
+
+	// a job nobody satisfies is left pending
+	gpu := &Job{ID: "gpu", CPUShares: 100, Requires: []Constraint{{"gpu", ConstraintEqual, "yes"}}}
+	err = c.CreateJob(ctx, tb, gpu)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err = c.Schedule(ctx, tb, gpu)
+	if err != nil {
+		t.Fatal("got an error scheduling gpu", err)
+	}
+	if !status.IsPending() {
+		t.Fatal("job without a matching node should be pending")
+	}
+}
+
+// Fails the first write to a key with a conflict, after letting somebody else
+// modify it, as if they'd raced us to it.
+type racingBackend struct {
+	testtools.TestBackend
+	races map[string]func()
+}
+
+func (r racingBackend) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	race, ok := r.races[key]
+	if ok {
+		delete(r.races, key)
+		race()
+		return &ConflictError{Key: key, Cause: fmt.Errorf("index %d is stale", prevIndex)}
+	}
+	return r.TestBackend.WriteKey(ctx, key, value, directory, prevExist, prevIndex)
+}
+
+func (r racingBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	for _, write := range writes {
+		race, ok := r.races[write.Key]
+		if ok {
+			delete(r.races, write.Key)
+			race()
+			return &ConflictError{Key: write.Key, Cause: fmt.Errorf("%s changed", write.Key)}
+		}
+	}
+	return r.TestBackend.Txn(ctx, compares, writes)
+}
+
+func TestSchedulerRetriesConflictingAssignment(t *testing.T) {
+	ctx := context.Background()
+
+	tb := racingBackend{TestBackend: testtools.TestBackend{}, races: make(map[string]func())}
+
+	for _, name := range []string{"a", "b"} {
+		node := &Node{Namespace: "test", Name: name, CPUShares: 1000}
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+	for _, job := range []*Job{
+		{ID: "first", CPUShares: 300},
+		{ID: "second", CPUShares: 300},
+		{ID: "third", CPUShares: 800},
+	} {
+		err := c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+	}
+
+	// somebody else places a job on a just before us
+	raceTo := func(nodeName string, jobID string) {
+		tb.races[getNodePath("test", nodeName)] = func() {
+			node, err := c.GetNode(ctx, tb, nodeName)
+			if err != nil {
+				t.Fatal("unable to get node", err)
+			}
+			node.JobIDs = append(node.JobIDs, jobID)
+			err = node.SaveIfNotModified(ctx, tb, etcd.PrevExist)
+			if err != nil {
+				t.Fatal("unable to save node", err)
+			}
+		}
+	}
+
+	// there's still room on a once the other job is there, so we retry on a
+	raceTo("a", "first")
+	status, err := c.Schedule(ctx, tb, &Job{ID: "second", CPUShares: 300})
+	if err != nil {
+		t.Fatal("got an error scheduling job", err)
+	}
+	if status.Node != "a" {
+		t.Fatal("expected second to be retried on a, but it's on", status.Node)
+	}
+
+	node, _ := c.GetNode(ctx, tb, "a")
+	if len(node.JobIDs) != 2 {
+		t.Fatal("expected both jobs on a, but it has", node.JobIDs)
+	}
+
+	// there's no room on a once the other job is there, so we move on to b
+	tb.TestBackend[getNodePath("test", "a")] = `{"Namespace":"test","Name":"a","CPUShares":1000}`
+	raceTo("a", "first")
+	status, err = c.Schedule(ctx, tb, &Job{ID: "third", CPUShares: 800})
+	if err != nil {
+		t.Fatal("got an error scheduling job", err)
+	}
+	if status.Node != "b" {
+		t.Fatal("expected third to move on to b, but it's on", status.Node)
+	}
+}
+
+func TestConflictErrorIsTyped(t *testing.T) {
+	err := error(&ConflictError{Key: "/key", Cause: fmt.Errorf("stale")})
+	if !IsConflict(err) {
+		t.Fatal("expected a conflict")
+	}
+	if IsConflict(fmt.Errorf("optimistic lock of key failed /key stale")) {
+		t.Fatal("didn't expect a formatted error to be a conflict")
+	}
+	if err.Error() != "optimistic lock of key failed /key stale" {
+		t.Fatal("unexpected message", err)
+	}
+}
+
+func TestSchedulerConcurrentlyFillsNode(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemory()
+
+	node := &Node{Namespace: "test", Name: "a", CPUShares: 1000}
+	err := node.JoinCluster(ctx, m)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	c := NewNamespace("test")
+	jobs := make([]*Job, 10)
+	for i := range jobs {
+		jobs[i] = &Job{ID: fmt.Sprintf("job%d", i), CPUShares: 100}
+		err = c.CreateJob(ctx, m, jobs[i])
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+	}
+
+	// every job fits, so however the writes interleave they should all land
+	errs := make(chan error, len(jobs))
+	for _, job := range jobs {
+		go func(job *Job) {
+			status, err := c.Schedule(ctx, m, job)
+			if err == nil && status.Node != "a" {
+				err = fmt.Errorf("job %s left pending, %s", job.ID, status.Reason)
+			}
+			errs <- err
+		}(job)
+	}
+	for range jobs {
+		err = <-errs
+		if err != nil {
+			t.Fatal("unable to schedule job concurrently", err)
+		}
+	}
+
+	node, _ = c.GetNode(ctx, m, "a")
+	if len(node.JobIDs) != len(jobs) {
+		t.Fatal("expected every job on a, but it has", node.JobIDs)
+	}
+	free, _ := node.GetFreeResources(ctx, m)
+	if free.CPUShares != 0 {
+		t.Fatal("expected a to be full, but it has", free.CPUShares, "free")
+	}
+}
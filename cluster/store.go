@@ -0,0 +1,305 @@
+package cluster
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// How many changes are remembered for watchers that fall behind, the same as
+// etcd.
+const storeHistory = 1000
+
+// The keys, and recent changes to them, of the backends that keep everything
+// themselves rather than in etcd. It behaves like etcd, every change bumps a
+// store wide index, writes can be made conditional on it, and every change
+// made to a key or anything below it can be watched for. It isn't safe for
+// concurrent use, the backends see to that.
+type store struct {
+	Index uint64
+	Keys  map[string]*storeKey
+
+	// recent changes, and the newest change that's been forgotten
+	Events  []storeEvent
+	Cleared uint64
+}
+
+type storeKey struct {
+	Value         string
+	Dir           bool
+	ModifiedIndex uint64
+	Expires       time.Time `json:",omitempty"`
+}
+
+type storeEvent struct {
+	Key   string
+	Index uint64
+
+	// deleting a directory changes everything below it
+	Dir bool `json:",omitempty"`
+}
+
+// Create a new, empty, store.
+func newStore() *store {
+	return &store{
+		Keys: map[string]*storeKey{"/": {Dir: true}},
+	}
+}
+
+// Get the index of the first change to the key, or anything below it, after
+// the provided index. Returns false if there hasn't been one yet.
+func (s *store) changedSince(key string, since uint64) (uint64, bool, error) {
+	// changes we've forgotten may have been to this key
+	if since < s.Cleared {
+		return 0, false, s.error(etcd.ErrorCodeEventIndexCleared, "The event in requested index is outdated and cleared",
+			fmt.Sprintf("the requested history has been cleared [%d/%d]", s.Cleared+1, since+1))
+	}
+
+	for _, event := range s.Events {
+		if event.Index > since && event.affects(key) {
+			return event.Index, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (s *store) read(key string) (string, uint64, error) {
+	k, ok := s.Keys[key]
+	if !ok {
+		return "", 0, s.notFound(key)
+	}
+	return k.Value, k.ModifiedIndex, nil
+}
+
+// Read the values of the immediate children of a key, ordered by key.
+func (s *store) readChildren(key string) ([]string, uint64, error) {
+	k, ok := s.Keys[key]
+	if !ok {
+		return nil, 0, s.notFound(key)
+	}
+
+	children := make([]string, 0)
+	for child := range s.Keys {
+		if child != "/" && path.Dir(child) == key {
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+
+	ret := make([]string, len(children))
+	for i, child := range children {
+		ret[i] = s.Keys[child].Value
+	}
+	return ret, k.ModifiedIndex, nil
+}
+
+func (s *store) exists(key string) bool {
+	_, ok := s.Keys[key]
+	return ok
+}
+
+// Write a key, if the conditions are met, expiring it after ttl if nonzero.
+func (s *store) set(key string, value string, directory bool, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	if key == "/" {
+		return s.error(etcd.ErrorCodeRootROnly, "Root is read only", key)
+	}
+
+	err := s.check(key, prevExist, prevIndex)
+	if err != nil {
+		return err
+	}
+	existing, exists := s.Keys[key]
+	if exists && existing.Dir {
+		return s.error(etcd.ErrorCodeNotFile, "Not a file", key)
+	}
+
+	// directories above the key are created as needed, but can't be values
+	missing := make([]string, 0)
+	for parent := path.Dir(key); parent != "/"; parent = path.Dir(parent) {
+		p, ok := s.Keys[parent]
+		if !ok {
+			missing = append(missing, parent)
+			continue
+		}
+		if !p.Dir {
+			return s.error(etcd.ErrorCodeNotDir, "Not a directory", parent)
+		}
+	}
+
+	s.Index++
+	for _, parent := range missing {
+		s.Keys[parent] = &storeKey{Dir: true, ModifiedIndex: s.Index}
+	}
+
+	k := &storeKey{Value: value, Dir: directory, ModifiedIndex: s.Index}
+	if directory {
+		k.Value = ""
+	}
+	if ttl > 0 {
+		k.Expires = time.Now().Add(ttl)
+	}
+	s.Keys[key] = k
+
+	s.record(storeEvent{Key: key, Index: s.Index})
+	return nil
+}
+
+// Check the conditions a write is made on.
+func (s *store) check(key string, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	existing, exists := s.Keys[key]
+	if prevExist == etcd.PrevNoExist && exists {
+		return &ConflictError{Key: key, Cause: s.error(etcd.ErrorCodeNodeExist, "Key already exists", key)}
+	}
+	if prevExist == etcd.PrevExist && !exists {
+		return &ConflictError{Key: key, Cause: s.notFound(key)}
+	}
+	if prevIndex != 0 {
+		if !exists {
+			return s.notFound(key)
+		}
+		if existing.ModifiedIndex != prevIndex {
+			return &ConflictError{Key: key, Cause: s.error(etcd.ErrorCodeTestFailed, "Compare failed",
+				fmt.Sprintf("[%d != %d]", prevIndex, existing.ModifiedIndex))}
+		}
+	}
+	return nil
+}
+
+// Check every comparison, then make every write. A write can still fail,
+// such as one below a value, so they're made on a copy that's only kept if
+// they all succeed.
+func (s *store) txn(compares []txn.Compare, writes []txn.Write) error {
+	for _, compare := range compares {
+		err := s.check(cleanKey(compare.Key), compare.PrevExist, compare.PrevIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	next := s.copy()
+	for _, write := range writes {
+		key := cleanKey(write.Key)
+		if !write.Delete {
+			err := next.set(key, write.Value, false, 0, etcd.PrevIgnore, 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// deleting something that's already gone is fine
+		if key == "/" {
+			return s.error(etcd.ErrorCodeRootROnly, "Root is read only", key)
+		}
+		if next.exists(key) {
+			next.remove(key)
+		}
+	}
+
+	*s = *next
+	return nil
+}
+
+// Copy the store, so it can be changed without changing this one. Keys are
+// replaced rather than modified, so they can be shared.
+func (s *store) copy() *store {
+	c := *s
+	c.Keys = make(map[string]*storeKey, len(s.Keys))
+	for key, k := range s.Keys {
+		c.Keys[key] = k
+	}
+	c.Events = append([]storeEvent(nil), s.Events...)
+	return &c
+}
+
+// Delete a key, and everything below it if it's a directory.
+func (s *store) delete(key string, directory bool) error {
+	if key == "/" {
+		return s.error(etcd.ErrorCodeRootROnly, "Root is read only", key)
+	}
+
+	k, ok := s.Keys[key]
+	if !ok {
+		return s.notFound(key)
+	}
+	if k.Dir && !directory {
+		return s.error(etcd.ErrorCodeNotFile, "Not a file", key)
+	}
+
+	s.remove(key)
+	return nil
+}
+
+// Remove keys whose ttl has elapsed. Returns whether anything was removed.
+func (s *store) expire(now time.Time) bool {
+	expired := make([]string, 0)
+	for key, k := range s.Keys {
+		if !k.Expires.IsZero() && !now.Before(k.Expires) {
+			expired = append(expired, key)
+		}
+	}
+	sort.Strings(expired)
+
+	for _, key := range expired {
+		s.remove(key)
+	}
+	return len(expired) > 0
+}
+
+// Get when the next key's ttl elapses, or zero if none have one.
+func (s *store) nextExpiry() time.Time {
+	var next time.Time
+	for _, k := range s.Keys {
+		if !k.Expires.IsZero() && (next.IsZero() || k.Expires.Before(next)) {
+			next = k.Expires
+		}
+	}
+	return next
+}
+
+// Remove a key and everything below it, recording the change.
+func (s *store) remove(key string) {
+	s.Index++
+
+	dir := s.Keys[key].Dir
+	for other := range s.Keys {
+		if isBelow(other, key) {
+			delete(s.Keys, other)
+		}
+	}
+
+	s.record(storeEvent{Key: key, Index: s.Index, Dir: dir})
+}
+
+// Remember a change, forgetting the oldest if there are too many.
+func (s *store) record(event storeEvent) {
+	s.Events = append(s.Events, event)
+	if len(s.Events) > storeHistory {
+		s.Cleared = s.Events[0].Index
+		s.Events = s.Events[1:]
+	}
+}
+
+func (s *store) notFound(key string) error {
+	return s.error(etcd.ErrorCodeKeyNotFound, "Key not found", key)
+}
+
+// Errors are the ones etcd would return, so callers can't tell us apart.
+func (s *store) error(code int, message string, cause string) error {
+	return etcd.Error{Code: code, Message: message, Cause: cause, Index: s.Index}
+}
+
+// Determine if a change shows up to watchers of the key.
+func (e storeEvent) affects(key string) bool {
+	return isBelow(e.Key, key) || (e.Dir && isBelow(key, e.Key))
+}
+
+// Keys are absolute paths without a trailing slash, as they are in etcd.
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Names of the available scheduling strategies.
+const (
+	StrategyFirstFit = "firstfit"
+	StrategyBinPack  = "binpack"
+	StrategySpread   = "spread"
+)
+
+// The strategy used when neither the namespace nor the job specify one.
+const DefaultStrategy = StrategyFirstFit
+
+// Represents a Node with room to run a job, along with its free resources.
+type Candidate struct {
+	Node Node
+	Free Resources
+}
+
+// Decides which of the Nodes able to run a job it should be placed on.
+type Strategy interface {
+
+	// Order candidates from most to least preferred for running the job.
+	Rank(job *Job, candidates []Candidate)
+}
+
+// Get the Strategy with the provided name.
+func GetStrategy(name string) (Strategy, error) {
+	switch name {
+	case StrategyFirstFit:
+		return FirstFit{}, nil
+	case StrategyBinPack:
+		return BinPack{}, nil
+	case StrategySpread:
+		return Spread{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling strategy %s", name)
+	}
+}
+
+// Place jobs on the first Node, by name, with room for them.
+type FirstFit struct{}
+
+func (f FirstFit) Rank(job *Job, candidates []Candidate) {}
+
+// Place jobs on the Node that will have the least capacity left over, keeping
+// as many Nodes as possible free for large jobs.
+type BinPack struct{}
+
+func (b BinPack) Rank(job *Job, candidates []Candidate) {
+	sort.Stable(byRemaining{job: job, candidates: candidates})
+}
+
+// Place jobs on the Node that will have the most capacity left over, or the
+// fewest jobs if that's a tie, spreading load across as many Nodes as
+// possible.
+type Spread struct{}
+
+func (s Spread) Rank(job *Job, candidates []Candidate) {
+	sort.Stable(sort.Reverse(byRemaining{job: job, candidates: candidates, fewerJobsFirst: true}))
+}
+
+// Sorts candidates by the fraction of their capacity left after placing a job.
+type byRemaining struct {
+	job            *Job
+	candidates     []Candidate
+	fewerJobsFirst bool
+}
+
+func (b byRemaining) Len() int {
+	return len(b.candidates)
+}
+
+func (b byRemaining) Swap(i, j int) {
+	b.candidates[i], b.candidates[j] = b.candidates[j], b.candidates[i]
+}
+
+func (b byRemaining) Less(i, j int) bool {
+	ri := remaining(b.job, &b.candidates[i])
+	rj := remaining(b.job, &b.candidates[j])
+	if ri != rj {
+		return ri < rj
+	}
+
+	// when sorted in reverse, the node with fewer jobs comes out ahead
+	if b.fewerJobsFirst {
+		return len(b.candidates[i].Node.JobIDs) > len(b.candidates[j].Node.JobIDs)
+	}
+	return false
+}
+
+// Sorts candidates by how many of a job's preferred constraints they satisfy.
+type byPreference struct {
+	job        *Job
+	candidates []Candidate
+}
+
+func (b byPreference) Len() int {
+	return len(b.candidates)
+}
+
+func (b byPreference) Swap(i, j int) {
+	b.candidates[i], b.candidates[j] = b.candidates[j], b.candidates[i]
+}
+
+func (b byPreference) Less(i, j int) bool {
+	return preferred(b.job, &b.candidates[i]) > preferred(b.job, &b.candidates[j])
+}
+
+// The number of a job's preferred constraints a candidate satisfies.
+func preferred(job *Job, candidate *Candidate) int {
+	count := 0
+	for _, constraint := range job.Prefers {
+		if constraint.Matches(candidate.Node.Labels) {
+			count++
+		}
+	}
+	return count
+}
+
+// The average fraction of each resource a candidate will have left over after
+// running a job.
+func remaining(job *Job, candidate *Candidate) float64 {
+	total := 0.0
+	dimensions := 0
+
+	add := func(free int, used int, capacity int) {
+		if capacity <= 0 {
+			return
+		}
+		total += float64(free-used) / float64(capacity)
+		dimensions++
+	}
+
+	add(candidate.Free.CPUShares, job.CPUShares, candidate.Node.CPUShares)
+	add(candidate.Free.BlockIOShares, job.BlockIOWeight, candidate.Node.BlockIOShares)
+	add(candidate.Free.MemoryMegabytes, job.MemoryLimitMegabytes, candidate.Node.MemoryMegabytes)
+
+	if dimensions == 0 {
+		return 0
+	}
+	return total / float64(dimensions)
+}
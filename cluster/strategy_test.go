@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func getTestCandidates() []Candidate {
+	return []Candidate{
+		{
+			Node: Node{Name: "half", CPUShares: 1000, JobIDs: []string{"a"}},
+			Free: Resources{CPUShares: 500},
+		},
+		{
+			Node: Node{Name: "full", CPUShares: 1000, JobIDs: []string{"a", "b"}},
+			Free: Resources{CPUShares: 200},
+		},
+		{
+			Node: Node{Name: "empty", CPUShares: 1000},
+			Free: Resources{CPUShares: 1000},
+		},
+	}
+}
+
+func rankedNames(candidates []Candidate) []string {
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.Node.Name
+	}
+	return names
+}
+
+func TestStrategiesRankCandidates(t *testing.T) {
+	job := &Job{ID: "job", CPUShares: 100}
+
+	tests := []struct {
+		strategy string
+		expected []string
+	}{
+		{StrategyFirstFit, []string{"half", "full", "empty"}},
+		{StrategyBinPack, []string{"full", "half", "empty"}},
+		{StrategySpread, []string{"empty", "half", "full"}},
+	}
+
+	for _, test := range tests {
+		strategy, err := GetStrategy(test.strategy)
+		if err != nil {
+			t.Fatal("unable to get strategy", test.strategy, err)
+		}
+
+		candidates := getTestCandidates()
+		strategy.Rank(job, candidates)
+
+		names := rankedNames(candidates)
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Fatal(test.strategy, "ranked nodes", names, "expected", test.expected)
+			}
+		}
+	}
+
+	_, err := GetStrategy("bogus")
+	if err == nil {
+		t.Fatal("expected error getting unknown strategy")
+	}
+}
+
+func TestSpreadPrefersFewerJobsOnTie(t *testing.T) {
+	job := &Job{ID: "job", CPUShares: 100}
+	candidates := []Candidate{
+		{Node: Node{Name: "busy", CPUShares: 1000, JobIDs: []string{"a", "b"}}, Free: Resources{CPUShares: 500}},
+		{Node: Node{Name: "quiet", CPUShares: 1000, JobIDs: []string{"c"}}, Free: Resources{CPUShares: 500}},
+	}
+
+	Spread{}.Rank(job, candidates)
+	if candidates[0].Node.Name != "quiet" {
+		t.Fatal("spread should prefer the node with fewer jobs", rankedNames(candidates))
+	}
+}
+
+func TestSchedulerUsesNamespaceAndJobStrategy(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+
+	big := &Node{Namespace: "test", Name: "big", CPUShares: 1000}
+	small := &Node{Namespace: "test", Name: "small", CPUShares: 200}
+	for _, node := range []*Node{big, small} {
+		err := node.JoinCluster(ctx, tb)
+		if err != nil {
+			t.Fatal("failed to join cluster", err)
+		}
+	}
+
+	c := NewNamespace("test")
+
+	// the namespace bin packs
+	err := c.SetConfig(ctx, tb, &NamespaceConfig{Strategy: StrategyBinPack})
+	if err != nil {
+		t.Fatal("unable to set namespace config", err)
+	}
+
+	err = c.SetConfig(ctx, tb, &NamespaceConfig{Strategy: "bogus"})
+	if err == nil {
+		t.Fatal("allowed to set unknown strategy")
+	}
+
+	packed := &Job{ID: "packed", CPUShares: 100}
+	err = c.CreateJob(ctx, tb, packed)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err := c.Schedule(ctx, tb, packed)
+	if err != nil || status.Node != small.Name {
+		t.Fatal("expected bin packed job on", small.Name, status, err)
+	}
+
+	// but this job wants to be spread out
+	spread := &Job{ID: "spread", CPUShares: 100, Strategy: StrategySpread}
+	err = c.CreateJob(ctx, tb, spread)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	status, err = c.Schedule(ctx, tb, spread)
+	if err != nil || status.Node != big.Name {
+		t.Fatal("expected spread job on", big.Name, status, err)
+	}
+}
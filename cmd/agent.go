@@ -1,14 +1,25 @@
 package cmd
 
 import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/agent"
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Agent(etcdServers []string, namespace string, bind string, name string,
-	cpuShares int, blockIOShares int, memoryMegabytes int) error {
+func Agent(ctx context.Context, backend cluster.Backend, namespace string, bind string, name string,
+	cpuShares int, blockIOShares int, memoryMegabytes int, heartbeatTTL time.Duration, rawLabels []string,
+	localKind string, localDir string) error {
 
-	etcd, err := cluster.NewEtcd(etcdServers)
+	labels, err := agent.ParseLabels(rawLabels)
+	if err != nil {
+		return err
+	}
+
+	local, err := newLocal(localKind, namespace, name, localDir)
 	if err != nil {
 		return err
 	}
@@ -19,9 +30,24 @@ func Agent(etcdServers []string, namespace string, bind string, name string,
 		CPUShares:       cpuShares,
 		BlockIOShares:   blockIOShares,
 		MemoryMegabytes: memoryMegabytes,
+		HeartbeatTTL:    heartbeatTTL,
+		Labels:          labels,
 		NodeName:        name,
-		ClusterBackend:  etcd,
-		Local:           agent.NewSystemd(namespace, name),
+		ClusterBackend:  backend,
+		Local:           local,
+	}
+	return agent.Run(ctx)
+}
+
+// Create what runs an agent's jobs, either systemd, or the agent itself running
+// them as processes, keeping their unit files and logs in dir.
+func newLocal(kind string, namespace string, name string, dir string) (agent.Local, error) {
+	switch kind {
+	case "systemd":
+		return agent.NewSystemd(namespace, name), nil
+	case "process":
+		return agent.NewProcess(namespace, name, dir), nil
+	default:
+		return nil, fmt.Errorf("unknown local %s, must be systemd or process", kind)
 	}
-	return agent.Run()
 }
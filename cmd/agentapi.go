@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+// how long to wait on an agent before deciding it isn't responding
+const agentTimeout = 5 * time.Second
+
+// Retrieve the jobs an agent is managing locally.
+func getAgentJobs(node *cluster.Node) ([]cluster.Job, error) {
+	client := &http.Client{Timeout: agentTimeout}
+	url := fmt.Sprintf("http://%s/jobs", node.Endpoint)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("node %s is not responding %v", node.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node %s returned status %d", node.Name, resp.StatusCode)
+	}
+
+	jobs := make([]cluster.Job, 0)
+	err = json.NewDecoder(resp.Body).Decode(&jobs)
+	if err != nil {
+		return nil, fmt.Errorf("problem decoding jobs from node %s %v", node.Name, err)
+	}
+
+	return jobs, nil
+}
+
+// Poll an agent until it no longer manages the specified job, or until
+// timeout elapses.
+func waitForAgentJobRemoval(node *cluster.Node, jobID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		jobs, err := getAgentJobs(node)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, job := range jobs {
+			if job.ID == jobID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for node %s to remove job %s", node.Name, jobID)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+func Config(ctx context.Context, backend cluster.Backend, namespace string, strategy string) error {
+	c := cluster.NewNamespace(namespace)
+	config, err := c.GetConfig(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	// with nothing to change, just show the current settings
+	if strategy == "" {
+		fmt.Println("Strategy:", config.Strategy)
+		return nil
+	}
+
+	config.Strategy = strategy
+	err = c.SetConfig(ctx, backend, config)
+	if err != nil {
+		return err
+	}
+
+	log.Println("set scheduling strategy for namespace", namespace, "to", strategy)
+	return nil
+}
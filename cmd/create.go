@@ -6,15 +6,13 @@ import (
 	"log"
 	"os"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Create(etcdServers []string, namespace string, jobName string, unitFile *os.File) error {
+func Create(ctx context.Context, backend cluster.Backend, namespace string, jobName string, unitFile *os.File) error {
 	log.Println("storing job", jobName, "in cluster")
-	etcd, err := cluster.NewEtcd(etcdServers)
-	if err != nil {
-		return err
-	}
 
 	unitBytes, err := ioutil.ReadAll(unitFile)
 	if err != nil {
@@ -27,7 +25,7 @@ func Create(etcdServers []string, namespace string, jobName string, unitFile *os
 	}
 
 	c := cluster.NewNamespace(namespace)
-	err = c.CreateJob(etcd, job)
+	err = c.CreateJob(ctx, backend, job)
 	if err != nil {
 		return err
 	}
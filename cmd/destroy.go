@@ -2,8 +2,95 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Destroy(etcdServers []string, namespace string, name string) error {
-	return fmt.Errorf("not implemented")
+// how long to wait for an agent to tear down a job's local unit
+const destroyTimeout = 60 * time.Second
+
+func Destroy(ctx context.Context, backend cluster.Backend, namespace string, jobID string, force bool) error {
+	c := cluster.NewNamespace(namespace)
+	job, err := c.GetJob(ctx, backend, jobID)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := c.GetInstanceStatuses(ctx, backend, job)
+	if err != nil {
+		return err
+	}
+
+	// stop instances still waiting for a node first, so the scheduler can't
+	// place them while we're tearing the rest down
+	for _, status := range statuses {
+		if status.Node != "" || status.DesiredState != cluster.JobStateRunning {
+			continue
+		}
+
+		log.Println("stopping pending job", status.ID)
+		_, instance := cluster.ParseInstanceID(status.ID)
+		err = c.Unschedule(ctx, backend, job.Instance(instance))
+		if err != nil {
+			return fmt.Errorf("unable to stop job %v", err)
+		}
+	}
+
+	// then find which nodes are running instances of the job, if any,
+	// including any that were placed before we stopped them
+	statuses, err = c.GetInstanceStatuses(ctx, backend, job)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if status.Node == "" {
+			continue
+		}
+
+		node, err := c.GetNode(ctx, backend, status.Node)
+		if err != nil {
+			return err
+		}
+
+		// make sure the node's agent is around to clean up after the job,
+		// otherwise we'd leave the unit running with nothing managing it
+		_, err = getAgentJobs(node)
+		responding := err == nil
+		if !responding {
+			if !force {
+				return fmt.Errorf("job %s is assigned to unresponsive node %s, use --force to destroy it anyway: %v",
+					status.ID, node.Name, err)
+			}
+			log.Println("node", node.Name, "is not responding, destroying job anyway")
+		}
+
+		log.Println("unscheduling job", status.ID, "from node", node.Name)
+		_, instance := cluster.ParseInstanceID(status.ID)
+		err = c.Unschedule(ctx, backend, job.Instance(instance))
+		if err != nil {
+			return fmt.Errorf("unable to unschedule job %v", err)
+		}
+
+		if responding {
+			log.Println("waiting for node", node.Name, "to remove job", status.ID)
+			err = waitForAgentJobRemoval(node, status.ID, destroyTimeout)
+			if err != nil && !force {
+				return fmt.Errorf("%v, use --force to destroy it anyway", err)
+			}
+		}
+	}
+
+	log.Println("destroying job", jobID)
+	err = c.DestroyJob(ctx, backend, jobID)
+	if err != nil {
+		return err
+	}
+
+	log.Println("destroyed job", jobID)
+	return nil
 }
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/agent"
+	"github.com/sofuture/kubernotes/cluster"
+	"github.com/sofuture/kubernotes/scheduler"
+)
+
+// Run a whole cluster in this process, an agent and a scheduler sharing a
+// backend, starting a job for each of the provided unit files. Unless a
+// backend is provided, the cluster is kept in memory, where nothing but this
+// process can reach it, and only the provided unit files can be run. Provide
+// one, such as a file backend, to manage the cluster with the other commands.
+// Jobs are run as processes unless localKind says otherwise, keeping their
+// unit files and logs in localDir, or a temporary directory if it's empty.
+func Dev(ctx context.Context, backend cluster.Backend, namespace string, bind string, name string, cpuShares int,
+	blockIOShares int, memoryMegabytes int, unitPaths []string, localKind string, localDir string) error {
+
+	if localDir == "" {
+		dir, err := ioutil.TempDir("", "kubernotes-dev")
+		if err != nil {
+			return fmt.Errorf("could not create job directory %v", err)
+		}
+		defer os.RemoveAll(dir)
+		localDir = dir
+	}
+
+	local, err := newLocal(localKind, namespace, name, localDir)
+	if err != nil {
+		return err
+	}
+
+	if backend == nil {
+		backend = cluster.NewMemory()
+	}
+	c := cluster.NewNamespace(namespace)
+
+	// jobs are started before the agent joins, and left pending until the
+	// scheduler sees it has
+	for _, unitPath := range unitPaths {
+		unitBytes, err := ioutil.ReadFile(unitPath)
+		if err != nil {
+			return err
+		}
+
+		jobName := strings.TrimSuffix(filepath.Base(unitPath), filepath.Ext(unitPath))
+		job, err := cluster.LoadJob(jobName, string(unitBytes))
+		if err != nil {
+			return fmt.Errorf("error parsing unit file %s %v", unitPath, err)
+		}
+
+		// a backend we were given may already have the job from last time
+		_, err = c.GetJob(ctx, backend, jobName)
+		if err == nil {
+			err = c.UpdateJob(ctx, backend, job)
+		} else {
+			err = c.CreateJob(ctx, backend, job)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = c.ScheduleReplicas(ctx, backend, job)
+		if err != nil {
+			return fmt.Errorf("unable to schedule job %v", err)
+		}
+		log.Println("started job", jobName)
+	}
+
+	agent := &agent.Agent{
+		Bind:            bind,
+		Namespace:       c,
+		CPUShares:       cpuShares,
+		BlockIOShares:   blockIOShares,
+		MemoryMegabytes: memoryMegabytes,
+		NodeName:        name,
+		ClusterBackend:  backend,
+		Local:           local,
+	}
+
+	scheduler := &scheduler.Scheduler{
+		Name:           name,
+		Namespace:      c,
+		ClusterBackend: backend,
+	}
+
+	// if either stops, stop the other too, and wait for both before the job
+	// directory is removed from under them
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- agent.Run(ctx)
+	}()
+	go func() {
+		errs <- scheduler.Run(ctx)
+	}()
+
+	err = <-errs
+	cancel()
+	if otherErr := <-errs; err == nil {
+		err = otherErr
+	}
+	return err
+}
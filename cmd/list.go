@@ -2,8 +2,184 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
 )
 
-func List(etcdServers []string, namespace string, name string) error {
-	return fmt.Errorf("not implemented")
+func List(ctx context.Context, backend cluster.Backend, namespace string, name string) error {
+	c := cluster.NewNamespace(namespace)
+
+	// if we were given a job name, only show that job
+	if name != "" {
+		job, err := c.GetJob(ctx, backend, name)
+		if err != nil {
+			return err
+		}
+		statuses, err := c.GetInstanceStatuses(ctx, backend, job)
+		if err != nil {
+			return err
+		}
+		runStates, err := getRunStates(ctx, backend, c)
+		if err != nil {
+			return err
+		}
+		printJob(job, statuses, runStates)
+		return nil
+	}
+
+	jobs, err := c.GetJobs(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := getJobStatuses(ctx, backend, c, jobs)
+	if err != nil {
+		return err
+	}
+
+	runStates, err := getRunStates(ctx, backend, c)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNODE\tCPU\tIO\tMEMORY\tDESIRED\tSTATE\tACTUAL")
+	for _, job := range jobs {
+		// each instance of a replicated job gets its own row
+		for _, status := range statuses[job.ID] {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%dM\t%s\t%s\t%s\n", status.ID, displayNode(status.Node),
+				job.CPUShares, job.BlockIOWeight, job.MemoryLimitMegabytes, status.DesiredState, status.ObservedState,
+				runStates.display(status))
+		}
+	}
+	return w.Flush()
+}
+
+// print the full details of a single job, including it's unit file
+func printJob(job *cluster.Job, statuses []cluster.JobStatus, runStates runStates) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", job.ID)
+	fmt.Fprintf(w, "Replicas:\t%d\n", job.GetReplicas())
+	for _, status := range statuses {
+		// only call out instances when there's more than one
+		if len(statuses) > 1 {
+			fmt.Fprintf(w, "Instance:\t%s\n", status.ID)
+		}
+		fmt.Fprintf(w, "Node:\t%s\n", displayNode(status.Node))
+		fmt.Fprintf(w, "Desired state:\t%s\n", status.DesiredState)
+		fmt.Fprintf(w, "State:\t%s\n", status.ObservedState)
+		if status.Reason != "" {
+			fmt.Fprintf(w, "Reason:\t%s\n", status.Reason)
+		}
+		if !status.LastTransitionTime.IsZero() {
+			fmt.Fprintf(w, "Since:\t%s\n", status.LastTransitionTime.Local().Format(time.RFC1123))
+		}
+
+		// what the node running it last saw
+		fmt.Fprintf(w, "Actual state:\t%s\n", runStates.display(status))
+		if state, ok := runStates.get(status); ok {
+			if state.MainPID != 0 {
+				fmt.Fprintf(w, "Main PID:\t%d\n", state.MainPID)
+			}
+			fmt.Fprintf(w, "Restarts:\t%d\n", state.Restarts)
+			if !state.StartedAt.IsZero() {
+				fmt.Fprintf(w, "Started:\t%s\n", state.StartedAt.Local().Format(time.RFC1123))
+			}
+			if !state.ExitedAt.IsZero() {
+				fmt.Fprintf(w, "Exited:\t%s (code %d)\n", state.ExitedAt.Local().Format(time.RFC1123), state.ExitCode)
+			}
+		}
+	}
+	fmt.Fprintf(w, "CPU shares:\t%d\n", job.CPUShares)
+	fmt.Fprintf(w, "Block IO weight:\t%d\n", job.BlockIOWeight)
+	fmt.Fprintf(w, "Memory limit:\t%dM\n", job.MemoryLimitMegabytes)
+	fmt.Fprintf(w, "Priority:\t%d\n", job.Priority)
+	if job.Strategy != "" {
+		fmt.Fprintf(w, "Strategy:\t%s\n", job.Strategy)
+	}
+	for _, constraint := range job.Requires {
+		fmt.Fprintf(w, "Requires:\t%s\n", constraint)
+	}
+	for _, constraint := range job.Prefers {
+		fmt.Fprintf(w, "Prefers:\t%s\n", constraint)
+	}
+	for _, jobID := range job.Affinity {
+		fmt.Fprintf(w, "Runs with:\t%s\n", jobID)
+	}
+	for _, jobID := range job.AntiAffinity {
+		fmt.Fprintf(w, "Runs apart from:\t%s\n", jobID)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%s", job.UnitFile)
+}
+
+// Get the status of every instance of each of the provided jobs, keyed by job
+// ID.
+func getJobStatuses(ctx context.Context, backend cluster.Backend, c *cluster.Namespace, jobs []cluster.Job) (map[string][]cluster.JobStatus, error) {
+	ret := make(map[string][]cluster.JobStatus)
+	for i := range jobs {
+		statuses, err := c.GetInstanceStatuses(ctx, backend, &jobs[i])
+		if err != nil {
+			return nil, err
+		}
+		ret[jobs[i].ID] = statuses
+	}
+	return ret, nil
+}
+
+// What the nodes that are up have reported about the jobs they run, keyed by
+// node name and then job ID.
+type runStates map[string]map[string]cluster.RunState
+
+// Get what each node that's up has reported. Reports from nodes that are down
+// can't be trusted, so they're left out.
+func getRunStates(ctx context.Context, backend cluster.Backend, c *cluster.Namespace) (runStates, error) {
+	live, err := c.GetLiveNodeNames(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(runStates)
+	for node := range live {
+		states, err := c.GetRunStates(ctx, backend, node)
+		if err != nil {
+			return nil, err
+		}
+		ret[node] = make(map[string]cluster.RunState)
+		for _, state := range states {
+			ret[node][state.ID] = state
+		}
+	}
+	return ret, nil
+}
+
+// Get what the node a job is assigned to last reported about it, if anything.
+func (r runStates) get(status cluster.JobStatus) (cluster.RunState, bool) {
+	state, ok := r[status.Node][status.ID]
+	return state, ok
+}
+
+// Describe what a job is actually doing, as far as we know.
+func (r runStates) display(status cluster.JobStatus) string {
+	if status.Node == "" {
+		return "-"
+	}
+	state, ok := r.get(status)
+	if !ok {
+		return "unknown"
+	}
+	return state.String()
+}
+
+func displayNode(node string) string {
+	if node == "" {
+		return "-"
+	}
+	return node
 }
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"log"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+func Migrate(ctx context.Context, backend cluster.Backend, namespace string, destinationURL string) error {
+	destination, err := cluster.NewBackend(destinationURL)
+	if err != nil {
+		return err
+	}
+
+	log.Println("migrating namespace", namespace, "to", destinationURL)
+	c := cluster.NewNamespace(namespace)
+	err = c.Migrate(ctx, backend, destination)
+	if err != nil {
+		return err
+	}
+
+	log.Println("migrated namespace", namespace)
+	return nil
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+)
+
+func Scale(ctx context.Context, backend cluster.Backend, namespace string, jobID string, replicas int) error {
+	c := cluster.NewNamespace(namespace)
+	job, err := c.GetJob(ctx, backend, jobID)
+	if err != nil {
+		return err
+	}
+
+	log.Println("scaling job", jobID, "to", replicas, "replicas")
+	statuses, err := c.Scale(ctx, backend, job, replicas)
+	if err != nil {
+		return fmt.Errorf("unable to scale job %v", err)
+	}
+
+	for _, status := range statuses {
+		switch {
+		case status.IsScheduled:
+			log.Println(status.ID, "scheduled on node:", status.Node)
+		case status.IsPending():
+			log.Println("leaving job", status.ID, "pending until the scheduler finds room,", status.Reason)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+	"github.com/sofuture/kubernotes/scheduler"
+)
+
+func Scheduler(ctx context.Context, backend cluster.Backend, namespace string, interval time.Duration, leaseTTL time.Duration) error {
+	// name ourselves uniquely, so we can tell if we're the leader
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("unable to determine hostname %v", err)
+	}
+
+	scheduler := scheduler.Scheduler{
+		Name:           fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		Interval:       interval,
+		LeaseTTL:       leaseTTL,
+		Namespace:      cluster.NewNamespace(namespace),
+		ClusterBackend: backend,
+	}
+	return scheduler.Run(ctx)
+}
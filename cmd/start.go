@@ -3,33 +3,90 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
 
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Start(etcdServers []string, namespace string, jobID string) error {
-	etcd, err := cluster.NewEtcd(etcdServers)
+func Start(ctx context.Context, backend cluster.Backend, namespace string, jobID string, dryRun bool, explain bool) error {
+	c := cluster.NewNamespace(namespace)
+	job, err := c.GetJob(ctx, backend, jobID)
 	if err != nil {
 		return err
 	}
 
-	c := cluster.NewNamespace(namespace)
-	job, err := c.GetJob(etcd, jobID)
-	if err != nil {
-		return err
+	if dryRun || explain {
+		return planStart(ctx, backend, c, job, explain)
 	}
 
 	log.Println("scheduling job:", jobID)
-	status, err := c.Schedule(etcd, job)
+	statuses, err := c.ScheduleReplicas(ctx, backend, job)
 	if err != nil {
 		return fmt.Errorf("unable to schedule job %v", err)
 	}
 
-	if status.IsScheduled {
-		log.Println("scheduled on node:", status.Node)
-	} else {
-		log.Println("unable to find resources to run job", status.ID)
+	for _, status := range statuses {
+		if status.IsScheduled {
+			log.Println("scheduled", status.ID, "on node:", status.Node, status.Reason)
+		} else {
+			log.Println("leaving job", status.ID, "pending until the scheduler finds room,", status.Reason)
+		}
+	}
+
+	return nil
+}
+
+// Show where each instance of a job that isn't running would be placed,
+// including any jobs that would be preempted, without placing it. Instances
+// are planned independently of each other. When explaining, the decision made
+// about every node is shown too.
+func planStart(ctx context.Context, backend cluster.Backend, c *cluster.Namespace, job *cluster.Job, explain bool) error {
+	for i := 0; i < job.GetReplicas(); i++ {
+		instance := job.Instance(i)
+
+		placement, err := c.PlanSchedule(ctx, backend, instance)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case placement.AlreadyScheduled:
+			fmt.Printf("%s is already scheduled on node %s\n", instance.ID, placement.Node)
+			continue
+		case placement.Node == "":
+			fmt.Printf("%s would be left pending, %s\n", instance.ID, placement.Reason)
+		case len(placement.Preempted) > 0:
+			fmt.Printf("%s would be scheduled on node %s, preempting %s\n", instance.ID, placement.Node,
+				strings.Join(placement.Preempted, ", "))
+		default:
+			fmt.Printf("%s would be scheduled on node %s\n", instance.ID, placement.Node)
+		}
+
+		if explain {
+			printDecisions(placement)
+		}
 	}
 
 	return nil
 }
+
+// print what the scheduler made of each node when placing a job
+func printDecisions(placement *cluster.Placement) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  NODE\tDECISION\tREASON")
+	for _, decision := range placement.Decisions {
+		verdict := "rejected"
+		switch {
+		case decision.Node == placement.Node:
+			verdict = "chosen"
+		case decision.Rank > 0:
+			verdict = "candidate"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", decision.Node, verdict, decision.Reason)
+	}
+	w.Flush()
+}
@@ -2,8 +2,116 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+	"github.com/sofuture/kubernotes/scheduler"
 )
 
-func Status(etcdServers []string, namespace string) error {
-	return fmt.Errorf("not implemented")
+func Status(ctx context.Context, backend cluster.Backend, namespace string) error {
+	c := cluster.NewNamespace(namespace)
+	nodes, err := c.GetNodes(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	live, err := c.GetLiveNodeNames(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := c.GetJobs(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := getJobStatuses(ctx, backend, c, jobs)
+	if err != nil {
+		return err
+	}
+
+	runStates, err := getRunStates(ctx, backend, c)
+	if err != nil {
+		return err
+	}
+
+	// compare how many instances should be running with how many are
+	instances := 0
+	pending := 0
+	desired := 0
+	running := 0
+	for _, jobStatuses := range statuses {
+		for _, status := range jobStatuses {
+			instances++
+			if status.IsPending() {
+				pending++
+			}
+			if status.DesiredState == cluster.JobStateRunning {
+				desired++
+			}
+			if state, ok := runStates.get(status); ok && state.IsRunning() {
+				running++
+			}
+		}
+	}
+
+	// totals only count nodes that are up, since that's what we can schedule on
+	total := &cluster.Resources{}
+	free := &cluster.Resources{}
+	down := 0
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tENDPOINT\tSTATE\tJOBS\tCPU (FREE/TOTAL)\tIO (FREE/TOTAL)\tMEMORY (FREE/TOTAL)")
+	for _, node := range nodes {
+		resources, err := node.GetFreeResources(ctx, backend)
+		if err != nil {
+			return err
+		}
+
+		state := "up"
+		if !live[node.Name] {
+			state = "down"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d/%d\t%d/%d\t%dM/%dM\n", node.Name, node.Endpoint, state, len(node.JobIDs),
+			resources.CPUShares, node.CPUShares,
+			resources.BlockIOShares, node.BlockIOShares,
+			resources.MemoryMegabytes, node.MemoryMegabytes)
+
+		if !live[node.Name] {
+			down++
+			continue
+		}
+
+		total.CPUShares += node.CPUShares
+		total.BlockIOShares += node.BlockIOShares
+		total.MemoryMegabytes += node.MemoryMegabytes
+		free.CPUShares += resources.CPUShares
+		free.BlockIOShares += resources.BlockIOShares
+		free.MemoryMegabytes += resources.MemoryMegabytes
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	leader, err := c.GetLeader(ctx, backend, scheduler.LeaderRole)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Namespace:\t%s\n", namespace)
+	fmt.Fprintf(w, "Nodes:\t%d (%d down)\n", len(nodes), down)
+	fmt.Fprintf(w, "CPU shares:\t%d free of %d\n", free.CPUShares, total.CPUShares)
+	fmt.Fprintf(w, "Block IO shares:\t%d free of %d\n", free.BlockIOShares, total.BlockIOShares)
+	fmt.Fprintf(w, "Memory:\t%dM free of %dM\n", free.MemoryMegabytes, total.MemoryMegabytes)
+	fmt.Fprintf(w, "Scheduler:\t%s\n", displayNode(leader))
+	fmt.Fprintf(w, "Jobs:\t%d (%d instances, %d pending)\n", len(jobs), instances, pending)
+	fmt.Fprintf(w, "Running:\t%d of %d instances that should be\n", running, desired)
+	return w.Flush()
 }
@@ -4,23 +4,20 @@ import (
 	"fmt"
 	"log"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Stop(etcdServers []string, namespace string, jobID string) error {
-	etcd, err := cluster.NewEtcd(etcdServers)
-	if err != nil {
-		return err
-	}
-
+func Stop(ctx context.Context, backend cluster.Backend, namespace string, jobID string) error {
 	c := cluster.NewNamespace(namespace)
-	job, err := c.GetJob(etcd, jobID)
+	job, err := c.GetJob(ctx, backend, jobID)
 	if err != nil {
 		return err
 	}
 
 	log.Println("unscheduling job:", jobID)
-	err = c.Unschedule(etcd, job)
+	err = c.UnscheduleReplicas(ctx, backend, job)
 	if err != nil {
 		return fmt.Errorf("unable to unschedule job %v", err)
 	}
@@ -5,20 +5,16 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"golang.org/x/net/context"
+
 	"github.com/sofuture/kubernotes/cluster"
 )
 
-func Tail(etcdServers []string, namespace string, jobID string, count int) error {
-
-	// connect to etcd
-	etcd, err := cluster.NewEtcd(etcdServers)
-	if err != nil {
-		return err
-	}
+func Tail(ctx context.Context, backend cluster.Backend, namespace string, jobID string, count int) error {
 
 	// find which node is running the job, if any
 	c := cluster.NewNamespace(namespace)
-	node, err := c.GetNodeRunningJob(etcd, jobID)
+	node, err := c.GetNodeRunningJob(ctx, backend, jobID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,3 @@
+// Package scheduler provides the controller that keeps placing pending jobs
+// as room becomes available in the cluster.
+package scheduler
@@ -0,0 +1,222 @@
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+	"github.com/sofuture/kubernotes/txn"
+)
+
+// How often to look for work when nothing has changed, unless otherwise
+// specified. Nodes going down only show up this way, as their heartbeats
+// expire.
+const DefaultInterval = 5 * time.Second
+
+// How long to spend handing over leadership when shutting down.
+const resignTimeout = 5 * time.Second
+
+// The role schedulers campaign for, so only one of them acts at a time.
+const LeaderRole = "scheduler"
+
+type Scheduler struct {
+	// Unique name of this scheduler, to tell the leader apart from the rest
+	Name string
+
+	Interval       time.Duration
+	LeaseTTL       time.Duration
+	Namespace      *cluster.Namespace
+	ClusterBackend cluster.Backend
+
+	mu      sync.Mutex
+	leading bool
+	fence   txn.Compare
+
+	// campaigns and passes take turns, so our lease isn't refreshed, moving
+	// the fence on our writes, part way through a pass
+	passMu sync.Mutex
+}
+
+// Run the scheduler until the context is cancelled, handing leadership over
+// to another scheduler if we have it.
+func (s *Scheduler) Run(ctx context.Context) error {
+	// stop campaigning and watching when we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes := make(chan struct{}, 1)
+
+	// let the loop know something changed, without blocking if it already
+	// has a pass queued up
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	// only one scheduler acts at a time, the rest wait to take over
+	election := cluster.NewElection(s.Namespace.GetName(), LeaderRole, s.Name, s.LeaseTTL)
+	resigned := make(chan struct{})
+	go func() {
+		s.lead(ctx, election, notify)
+		close(resigned)
+	}()
+
+	// jobs being started and stopped, and nodes joining or having their jobs
+	// change, may let us place something
+	go s.watch(ctx, "job statuses", s.Namespace.WatchJobStatuses, notify)
+	go s.watch(ctx, "nodes", s.Namespace.WatchNodes, notify)
+
+	ticker := time.NewTicker(s.interval())
+	defer ticker.Stop()
+
+	log.Println("scheduling pending jobs as the cluster changes, and every", s.interval())
+	for {
+		s.scheduleIfLeading(ctx)
+
+		select {
+		case <-changes:
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Println("shutting down scheduler")
+			<-resigned
+			return nil
+		}
+	}
+}
+
+func (s *Scheduler) interval() time.Duration {
+	if s.Interval == 0 {
+		return DefaultInterval
+	}
+	return s.Interval
+}
+
+func (s *Scheduler) isLeading() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leading
+}
+
+func (s *Scheduler) setLeading(leading bool, fence txn.Compare) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leading = leading
+	s.fence = fence
+}
+
+func (s *Scheduler) getFence() txn.Compare {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fence
+}
+
+// Keep campaigning to be the leader, or to stay the leader if we are, until
+// the context is cancelled. If the leader dies, somebody else takes over
+// within the lease ttl, plus the time between campaigns.
+func (s *Scheduler) lead(ctx context.Context, election *cluster.Election, notify func()) {
+	// refresh well inside the ttl, so a single slow write doesn't cost us
+	// leadership
+	ticker := time.NewTicker(election.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		s.passMu.Lock()
+		wasLeading := s.isLeading()
+		leading, err := election.Campaign(ctx, s.ClusterBackend)
+		s.setLeading(leading, election.Fence())
+		s.passMu.Unlock()
+
+		if err != nil {
+			log.Println("problem campaigning to be the scheduler", err)
+		}
+
+		if leading != wasLeading {
+			if leading {
+				log.Println("became the scheduler for namespace", s.Namespace.GetName())
+				notify()
+			} else {
+				log.Println("no longer the scheduler for namespace", s.Namespace.GetName())
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.resign(election)
+			return
+		}
+	}
+}
+
+func (s *Scheduler) watch(ctx context.Context, what string,
+	watch func(context.Context, cluster.Backend, uint64) (uint64, error), notify func()) {
+
+	var since uint64
+	for {
+		index, err := watch(ctx, s.ClusterBackend, since)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// we may have fallen too far behind to pick up where we left
+			// off, so start watching afresh. the ticker covers anything we
+			// miss in the meantime.
+			log.Println("problem watching", what, err)
+			since = 0
+			select {
+			case <-time.After(s.interval()):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		since = index
+		notify()
+	}
+}
+
+// Make a pass if we're the leader. Every write the pass makes is fenced by our
+// lease, so if somebody has taken over since we last campaigned, nothing we do
+// sticks.
+func (s *Scheduler) scheduleIfLeading(ctx context.Context) {
+	s.passMu.Lock()
+	defer s.passMu.Unlock()
+
+	if !s.isLeading() {
+		return
+	}
+	s.scheduleOnce(ctx, cluster.Fenced(s.ClusterBackend, s.getFence()))
+}
+
+func (s *Scheduler) scheduleOnce(ctx context.Context, backend cluster.Backend) {
+	statuses, err := s.Namespace.Reschedule(ctx, backend)
+	if err != nil {
+		// failures here are usually transient, so try again next time around
+		log.Println("unable to schedule pending jobs", err)
+	}
+
+	for _, status := range statuses {
+		if status.IsScheduled {
+			log.Println("scheduled job", status.ID, "on node", status.Node)
+		}
+	}
+}
+
+// Give up leadership, so another scheduler can take over without waiting for
+// our lease to expire. The context we ran with is done by now, so this gets
+// one of its own.
+func (s *Scheduler) resign(election *cluster.Election) {
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+
+	err := election.Resign(ctx, s.ClusterBackend)
+	if err != nil {
+		log.Println("problem resigning as the scheduler", err)
+	}
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/cluster"
+	"github.com/sofuture/kubernotes/testtools"
+)
+
+func TestSchedulerPlacesPendingJobsAsRoomFreesUp(t *testing.T) {
+	ctx := context.Background()
+
+	tb := testtools.TestBackend{}
+	c := cluster.NewNamespace("test")
+	s := &Scheduler{Namespace: c, ClusterBackend: tb}
+
+	node := &cluster.Node{Namespace: "test", Name: "node", CPUShares: 500}
+	err := node.JoinCluster(ctx, tb)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	running := &cluster.Job{ID: "running", CPUShares: 500}
+	waiting := &cluster.Job{ID: "waiting", CPUShares: 500}
+	for _, job := range []*cluster.Job{running, waiting} {
+		err = c.CreateJob(ctx, tb, job)
+		if err != nil {
+			t.Fatal("unable to create job", err)
+		}
+		_, err = c.Schedule(ctx, tb, job)
+		if err != nil {
+			t.Fatal("got an error scheduling job", job.ID, err)
+		}
+	}
+
+	// nothing has changed, so the waiting job stays pending
+	s.scheduleOnce(ctx, s.ClusterBackend)
+
+	status, err := c.GetJobStatus(ctx, tb, waiting.ID)
+	if err != nil {
+		t.Fatal("unable to get job status", err)
+	}
+	if !status.IsPending() {
+		t.Fatal("expected waiting job to be pending")
+	}
+
+	// once the running job stops, the waiting job takes its place
+	err = c.Unschedule(ctx, tb, running)
+	if err != nil {
+		t.Fatal("unable to unschedule job", err)
+	}
+
+	s.scheduleOnce(ctx, s.ClusterBackend)
+
+	status, err = c.GetJobStatus(ctx, tb, waiting.ID)
+	if err != nil {
+		t.Fatal("unable to get job status", err)
+	}
+	if status.Node != node.Name {
+		t.Fatal("expected waiting job to be placed once room freed up")
+	}
+}
+
+func TestDeposedSchedulerCantPlaceJobs(t *testing.T) {
+	ctx := context.Background()
+
+	backend := cluster.NewMemory()
+	c := cluster.NewNamespace("test")
+
+	node := &cluster.Node{Namespace: "test", Name: "node", CPUShares: 500}
+	err := node.JoinCluster(ctx, backend)
+	if err != nil {
+		t.Fatal("failed to join cluster", err)
+	}
+
+	job := &cluster.Job{ID: "job", CPUShares: 500}
+	err = c.CreateJob(ctx, backend, job)
+	if err != nil {
+		t.Fatal("unable to create job", err)
+	}
+
+	// we lead, but lose our lease to somebody else part way through a pass
+	ours := cluster.NewElection("test", LeaderRole, "ours", 0)
+	leading, err := ours.Campaign(ctx, backend)
+	if err != nil || !leading {
+		t.Fatal("expected to be the leader", err)
+	}
+	s := &Scheduler{Namespace: c, ClusterBackend: backend}
+	s.setLeading(true, ours.Fence())
+
+	err = backend.DeleteKey(ctx, "/kubernotes/clusters/test/leaders/"+LeaderRole, false)
+	if err != nil {
+		t.Fatal("unable to expire lease", err)
+	}
+	theirs := cluster.NewElection("test", LeaderRole, "theirs", 0)
+	leading, err = theirs.Campaign(ctx, backend)
+	if err != nil || !leading {
+		t.Fatal("expected them to be the leader", err)
+	}
+
+	_, err = c.Schedule(ctx, cluster.Fenced(backend, ours.Fence()), job)
+	if err == nil {
+		t.Fatal("expected scheduling to fail without our lease")
+	}
+	s.scheduleIfLeading(ctx)
+
+	status, err := c.GetJobStatus(ctx, backend, job.ID)
+	if err != nil {
+		t.Fatal("unable to get job status", err)
+	}
+	if status.Node != "" {
+		t.Fatal("expected a deposed scheduler not to place the job, but it's on", status.Node)
+	}
+
+	// whoever holds the lease can
+	_, err = c.Schedule(ctx, cluster.Fenced(backend, theirs.Fence()), job)
+	if err != nil {
+		t.Fatal("unable to schedule job", err)
+	}
+	status, _ = c.GetJobStatus(ctx, backend, job.ID)
+	if status.Node != node.Name {
+		t.Fatal("expected the leader to place the job")
+	}
+}
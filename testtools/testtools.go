@@ -3,23 +3,32 @@ package testtools
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/sofuture/kubernotes/txn"
 )
 
 // simple mock backend for testing
 type TestBackend map[string]string
 
-func (t TestBackend) WatchForChanges(key string, since uint64) (uint64, error) {
+func (t TestBackend) WatchForChanges(ctx context.Context, key string, since uint64) (uint64, error) {
 	return 0, nil
 }
 
-func (t TestBackend) WriteKey(key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
+func (t TestBackend) WriteKey(ctx context.Context, key string, value string, directory bool, prevExist etcd.PrevExistType, prevIndex uint64) error {
 	t[key] = value
 	return nil
 }
 
-func (t TestBackend) ReadKey(key string) (string, uint64, error) {
+func (t TestBackend) WriteKeyWithTTL(ctx context.Context, key string, value string, ttl time.Duration, prevExist etcd.PrevExistType, prevIndex uint64) error {
+	t[key] = value
+	return nil
+}
+
+func (t TestBackend) ReadKey(ctx context.Context, key string) (string, uint64, error) {
 	val, ok := t[key]
 	if !ok {
 		return "", 0, fmt.Errorf("key %s does not exist", key)
@@ -27,7 +36,7 @@ func (t TestBackend) ReadKey(key string) (string, uint64, error) {
 	return val, 0, nil
 }
 
-func (t TestBackend) ReadKeyChildren(key string) ([]string, uint64, error) {
+func (t TestBackend) ReadKeyChildren(ctx context.Context, key string) ([]string, uint64, error) {
 	ret := make([]string, 0)
 	for k, v := range t {
 		if strings.HasPrefix(k, key) {
@@ -37,15 +46,33 @@ func (t TestBackend) ReadKeyChildren(key string) ([]string, uint64, error) {
 	return ret, 0, nil
 }
 
-func (t TestBackend) CheckIfKeyExists(key string) (bool, error) {
+func (t TestBackend) CheckIfKeyExists(ctx context.Context, key string) (bool, error) {
 	_, ok := t[key]
-	if !ok {
-		return false, nil
+	if ok {
+		return true, nil
+	}
+
+	// directories exist implicitly if they have children
+	for k := range t {
+		if strings.HasPrefix(k, key+"/") {
+			return true, nil
+		}
 	}
-	return true, nil
+	return false, nil
 }
 
-func (t TestBackend) DeleteKey(key string, directory bool) error {
+func (t TestBackend) DeleteKey(ctx context.Context, key string, directory bool) error {
 	delete(t, key)
 	return nil
 }
+
+func (t TestBackend) Txn(ctx context.Context, compares []txn.Compare, writes []txn.Write) error {
+	for _, write := range writes {
+		if write.Delete {
+			delete(t, write.Key)
+			continue
+		}
+		t[write.Key] = write.Value
+	}
+	return nil
+}
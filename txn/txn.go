@@ -0,0 +1,22 @@
+// Package txn describes transactions made against Kubernotes cluster backends.
+package txn
+
+import (
+	etcd "github.com/coreos/etcd/client"
+)
+
+// A condition a transaction is made on. The key must exist, or not, as
+// PrevExist says, and if PrevIndex is nonzero it must not have changed since.
+type Compare struct {
+	Key       string
+	PrevExist etcd.PrevExistType
+	PrevIndex uint64
+}
+
+// A change made by a transaction, either writing a value to a key, or
+// deleting the key and everything below it.
+type Write struct {
+	Key    string
+	Value  string
+	Delete bool
+}